@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"distributed-chord/node"
 	"distributed-chord/utils"
 	"fmt"
 	"log"
-	"net/rpc"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -23,49 +26,40 @@ func showmenu() {
 	fmt.Println(red + "Press 5 to see all nodes in the network" + reset)
 	fmt.Println(red + "Press 6 to see all the successor list" + reset)
 	fmt.Println(red + "Press 7 to simulate network partition/node sleeping" + reset)
+	fmt.Println(red + "Press 8 to leave the network" + reset)
+	fmt.Println(red + "Press 9 to resume or discard an interrupted transfer" + reset)
+	fmt.Println(red + "Press 10 to accept or reject incoming transfer offers" + reset)
+	fmt.Println(red + "Press 11 to publish a file" + reset)
+	fmt.Println(red + "Press 12 to fetch a published file by name" + reset)
+	fmt.Println(red + "Press 13 to list or search the file catalog" + reset)
+	fmt.Println(red + "Press 14 to send a file to several nodes" + reset)
+	fmt.Println(red + "Press 15 to cancel a transfer" + reset)
+	fmt.Println(red + "Press 16 to show the progress of transfers" + reset)
+	fmt.Println(red + "Press 17 to trace the lookup of a key" + reset)
 	fmt.Println(red + "--------------------------------" + reset)
 }
 
-func getAllNodes(n *node.Node) ([]node.Pointer, error) {
-	nodes := []node.Pointer{}
-	visited := make(map[int]bool)
-	currentID := n.ID
-	currentIP := n.IP
-	nodes = append(nodes, node.Pointer{ID: currentID, IP: currentIP})
-	visited[currentID] = true
-	currentSuccessor := n.Successor
-
-	for {
-		if currentSuccessor.ID == n.ID {
-			// We've come full circle
-			break
-		}
-		if visited[currentSuccessor.ID] {
-			// We've already visited this node
-			break
-		}
-
-		client, err := rpc.Dial("tcp", currentSuccessor.IP)
-		if err != nil {
-			return nil, err
-		}
-		var successorInfo node.NodeInfo
-		err = client.Call("Node.GetNodeInfo", struct{}{}, &successorInfo)
-		client.Close()
-		if err != nil {
-			return nil, err
-		}
-		nodes = append(nodes, node.Pointer{ID: successorInfo.ID, IP: successorInfo.IP})
-		visited[successorInfo.ID] = true
-		currentSuccessor = successorInfo.Successor
+// leaveOnSignal hands off this node's keys and leaves the ring when the process receives SIGTERM or SIGINT
+func leaveOnSignal(n *node.Node) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	fmt.Printf("\nReceived %v, leaving the network...\n", sig)
+	if err := n.Depart(); err != nil {
+		fmt.Printf("Failed to leave the network: %v\n", err)
+		os.Exit(1)
 	}
-	return nodes, nil
+	os.Exit(0)
 }
 
 func main() {
 	joinAddr := os.Getenv("BOOTSTRAP_ADDR")
 	chordPort := os.Getenv("CHORD_PORT")
 
+	if err := utils.LoadM(); err != nil {
+		log.Fatalf("Failed to configure ring width: %v", err)
+	}
+
 	containerIP, err := utils.GetContainerIP()
 
 	fmt.Printf("Container IP: %s\n", containerIP)
@@ -74,21 +68,80 @@ func main() {
 	}
 	n := node.CreateNode(containerIP + ":" + chordPort)
 
-	fmt.Printf("Node %d created\n", n.ID)
+	chunking, err := node.ParseChunkingStrategy(os.Getenv("CHUNK_STRATEGY"))
+	if err != nil {
+		log.Fatalf("Failed to configure chunking: %v", err)
+	}
+	n.Chunking = chunking
 
-	go n.StartRPCServer()
+	workers, err := node.LoadTransferWorkers()
+	if err != nil {
+		log.Fatalf("Failed to configure transfers: %v", err)
+	}
+	n.Workers = workers
+
+	consent, err := node.LoadConsentPolicy()
+	if err != nil {
+		log.Fatalf("Failed to configure transfer consent: %v", err)
+	}
+	n.Consent = consent
+
+	bandwidth, err := node.LoadBandwidthLimits()
+	if err != nil {
+		log.Fatalf("Failed to configure bandwidth limits: %v", err)
+	}
+	n.Bandwidth = bandwidth
+
+	rpcTimeout, err := node.LoadRPCTimeout()
+	if err != nil {
+		log.Fatalf("Failed to configure RPC timeout: %v", err)
+	}
+	n.RPCTimeout = rpcTimeout
+
+	lookupMode, err := node.LoadLookupMode()
+	if err != nil {
+		log.Fatalf("Failed to configure lookups: %v", err)
+	}
+	n.LookupMode = lookupMode
+
+	faults, err := node.LoadFaults()
+	if err != nil {
+		log.Fatalf("Failed to configure faults: %v", err)
+	}
+	for _, fault := range faults {
+		if err := n.InjectFault(fault); err != nil {
+			log.Fatalf("Failed to inject fault %s: %v", fault, err)
+		}
+	}
 
 	if joinAddr != "" {
-		// Join the network
-		n.Join(joinAddr)
+		// Join the network. The ID may be re-derived here if another node already owns it,
+		// so the RPC server is only started once the ring has accepted the final ID.
+		if err := n.Join(joinAddr); err != nil {
+			log.Fatalf("Failed to join network: %v", err)
+		}
 	}
 
+	fmt.Printf("Node %s created (%d-bit ring)\n", n.ID, utils.M)
+
+	go n.StartRPCServer()
+
 	// Stabilize the chord network
 	go n.Stabilize()
 	// Update finger table
 	go n.FixFingers()
 	// Periodically check if predecessor is down
 	go n.CheckPredecessor()
+	// Periodically restore missing replicas of the chunks this node owns
+	go n.MaintainReplicas()
+	// Leave the ring gracefully when the container is stopped
+	go leaveOnSignal(n)
+	// Finish assembling the files that were being received when the node stopped
+	go n.ResumeReceives()
+	// Print every change in the progress of a transfer
+	if os.Getenv("PROGRESS_LOG") == "true" {
+		go n.LogProgress()
+	}
 
 	showmenu()
 
@@ -102,21 +155,27 @@ func main() {
 			continue
 		case 1:
 			fmt.Println("Finger Table:")
-			for i, entry := range n.FingerTable {
+			for i, entry := range n.Routing().FingerTable {
 				// fmt.Printf("Finger table entry %d: Node %d (%s)\n", i+1, entry)
-				if entry.ID != 0 {
-					fmt.Printf("- Finger table entry %d: Node %d (%s)\n", i+1, entry.ID, entry.IP)
+				if !entry.ID.IsZero() {
+					fmt.Printf("- Finger table entry %d: Node %s (%s)\n", i+1, entry.ID, entry.IP)
 				} else {
 					fmt.Printf("- Finger table entry %d: No node assigned\n", i+1)
 				}
 			}
 		case 2:
-			fmt.Printf("Successor: %v, Predecessor: %v\n", n.Successor, n.Predecessor)
+			routing := n.Routing()
+			fmt.Printf("Successor: %v, Predecessor: %v\n", routing.Successor, routing.Predecessor)
 		case 3:
-			var targetNodeID int
+			var targetInput string
 			var fileName string
 			fmt.Print("Enter Target Node ID: ")
-			fmt.Scan(&targetNodeID)
+			fmt.Scan(&targetInput)
+			targetNodeID, err := utils.ParseID(targetInput)
+			if err != nil {
+				fmt.Printf("Invalid node ID: %v\n", err)
+				continue
+			}
 
 			// if targetNodeID == n.ID {
 			// 	fmt.Println("Cannot transfer file to self")
@@ -125,13 +184,13 @@ func main() {
 
 			// Checking if target node exists or is alive
 			nodeExists := false
-			nodes, err := getAllNodes(n)
+			nodes, err := node.GetAllNodes(n)
 			if err != nil {
 				fmt.Printf("Error getting all nodes: %v\n", err)
 			} else {
 				for _, node := range nodes {
 					if node.ID == targetNodeID {
-						fmt.Printf("Node %d exists in the network\n", targetNodeID)
+						fmt.Printf("Node %s exists in the network\n", targetNodeID)
 						nodeExists = true
 						break
 					}
@@ -139,20 +198,29 @@ func main() {
 			}
 
 			if !nodeExists {
-				fmt.Printf("Node %d does not exist in the network\n", targetNodeID)
+				fmt.Printf("Node %s does not exist in the network\n", targetNodeID)
 				continue
 			}
 
 			// time.Sleep(5 * time.Second)
 			fmt.Print("Enter the file name to transfer: ")
 			fmt.Scan(&fileName)
+
+			var storageMode string
+			fmt.Print("Enter the storage mode (replicate or ec:<data shards>:<parity shards>): ")
+			fmt.Scan(&storageMode)
+			options, err := node.ParseTransferOptions(storageMode)
+			if err != nil {
+				fmt.Printf("Invalid storage mode: %v\n", err)
+				continue
+			}
 			// time.Sleep(5 * time.Second)
 			fmt.Printf("File transfer initiated successfully.\n")
-			fmt.Printf("File Name: %s, Target Node IP: %d\n", fileName, targetNodeID)
+			fmt.Printf("File Name: %s, Target Node IP: %s\n", fileName, targetNodeID)
 			// time.Sleep(5 * time.Second)
 
 			// Call a function to handle the file transfer (implement this function in node package)
-			err2 := n.RequestFileTransfer(targetNodeID, fileName)
+			err2 := n.RequestFileTransfer(targetNodeID, fileName, options)
 
 			if err2 != nil {
 				fmt.Printf("File transfer failed: %v\n", err2)
@@ -162,24 +230,202 @@ func main() {
 		case 4:
 			showmenu()
 		case 5:
-			nodes, err := getAllNodes(n)
+			nodes, err := node.GetAllNodes(n)
 			if err != nil {
 				fmt.Printf("Error getting all nodes: %v\n", err)
 			} else {
 				fmt.Println("Nodes in the network:")
 				for _, node := range nodes {
-					fmt.Printf("Node ID: %d, IP: %s\n", node.ID, node.IP)
+					fmt.Printf("Node ID: %s, IP: %s\n", node.ID, node.IP)
 				}
 			}
 		case 6:
-			fmt.Printf("Successor List: %v\n", n.SuccessorList)
+			fmt.Printf("Successor List: %v\n", n.Routing().SuccessorList)
 
 		case 7:
 			fmt.Printf("Simulating network partition/node sleeping for 10 seconds\n")
-			node.IsSleeping.Store(true)
+			n.Sleeping.Store(true)
 			time.Sleep(7 * time.Second)
-			node.IsSleeping.Store(false)
+			n.Sleeping.Store(false)
 			fmt.Printf("Network partition/node sleeping simulation over\n")
+		case 8:
+			fmt.Println("Leaving the network...")
+			if err := n.Depart(); err != nil {
+				fmt.Printf("Failed to leave the network: %v\n", err)
+				continue
+			}
+			fmt.Println("Left the network. Node shutting down...")
+			os.Exit(0)
+		case 9:
+			pending := n.PendingSends()
+			if len(pending) == 0 {
+				fmt.Println("No interrupted transfers")
+				continue
+			}
+			fmt.Println("Interrupted transfers:")
+			for _, transferID := range pending {
+				fmt.Printf("- %s\n", transferID)
+			}
+
+			var transferID, action string
+			fmt.Print("Enter the transfer ID: ")
+			fmt.Scan(&transferID)
+			fmt.Print("Resume or discard the transfer? (resume/discard): ")
+			fmt.Scan(&action)
+			switch action {
+			case "resume":
+				err = n.ResumeSend(transferID)
+			case "discard":
+				err = n.DiscardSend(transferID)
+			default:
+				err = fmt.Errorf("unknown action %q", action)
+			}
+			if err != nil {
+				fmt.Printf("Failed to %s transfer: %v\n", action, err)
+			}
+		case 10:
+			offers := n.PendingOffers()
+			if len(offers) == 0 {
+				fmt.Println("No pending transfer offers")
+				continue
+			}
+			fmt.Println("Pending transfer offers:")
+			for _, offer := range offers {
+				fmt.Printf("- %s: %s (%d bytes) from node %s, expires in %.0f seconds\n",
+					offer.TransferID, offer.FileName, offer.FileSize, offer.SenderID, time.Until(offer.Expires).Seconds())
+			}
+
+			var transferID, answer string
+			fmt.Print("Enter the transfer ID: ")
+			fmt.Scan(&transferID)
+			fmt.Print("Do you want to receive the file? (yes/no): ")
+			fmt.Scan(&answer)
+			if err := n.AnswerOffer(transferID, answer == "yes"); err != nil {
+				fmt.Printf("Failed to answer offer: %v\n", err)
+			}
+		case 11:
+			var fileName, storageMode string
+			fmt.Print("Enter the file name to publish: ")
+			fmt.Scan(&fileName)
+			fmt.Print("Enter the storage mode (replicate or ec:<data shards>:<parity shards>): ")
+			fmt.Scan(&storageMode)
+			options, err := node.ParseTransferOptions(storageMode)
+			if err != nil {
+				fmt.Printf("Invalid storage mode: %v\n", err)
+				continue
+			}
+			if err := n.Publish(fileName, options); err != nil {
+				fmt.Printf("Publishing failed: %v\n", err)
+			}
+		case 12:
+			var fileName string
+			fmt.Print("Enter the name of the published file: ")
+			fmt.Scan(&fileName)
+			if err := n.FetchFile(fileName); err != nil {
+				fmt.Printf("Fetching failed: %v\n", err)
+			}
+		case 13:
+			var mode, text string
+			fmt.Print("Enter the search (list, prefix or keyword): ")
+			fmt.Scanln(&mode)
+			if mode != node.CATALOG_LIST {
+				fmt.Print("Enter the search text: ")
+				text, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+			}
+			query, err := node.ParseCatalogQuery(mode, strings.TrimSpace(text))
+			if err != nil {
+				fmt.Printf("Invalid search: %v\n", err)
+				continue
+			}
+			var reply node.Message
+			if err := n.QueryCatalog(node.Message{Query: query}, &reply); err != nil {
+				fmt.Printf("Catalog search failed: %v\n", err)
+				continue
+			}
+			if len(reply.Unreachable) > 0 {
+				fmt.Printf("%d nodes could not be searched, some files may be missing\n", len(reply.Unreachable))
+			}
+			fmt.Printf("%d files found:\n", len(reply.Catalog))
+			for _, entry := range reply.Catalog {
+				fmt.Printf("- %s (%d bytes), %s on node %s at %s\n", entry.FileName, entry.FileSize, entry.Kind,
+					entry.Owner, entry.Time.Format(time.RFC3339))
+			}
+		case 14:
+			var targetsInput, fileName, storageMode string
+			fmt.Print("Enter the target node IDs, separated by commas: ")
+			fmt.Scan(&targetsInput)
+			var targetNodeIDs []utils.ID
+			for _, field := range strings.Split(targetsInput, ",") {
+				if field = strings.TrimSpace(field); field == "" {
+					continue
+				}
+				targetNodeID, err := utils.ParseID(field)
+				if err != nil {
+					fmt.Printf("Invalid node ID: %v\n", err)
+					targetNodeIDs = nil
+					break
+				}
+				targetNodeIDs = append(targetNodeIDs, targetNodeID)
+			}
+			if len(targetNodeIDs) == 0 {
+				fmt.Println("No target nodes given")
+				continue
+			}
+			fmt.Print("Enter the file name to transfer: ")
+			fmt.Scan(&fileName)
+			fmt.Print("Enter the storage mode (replicate or ec:<data shards>:<parity shards>): ")
+			fmt.Scan(&storageMode)
+			options, err := node.ParseTransferOptions(storageMode)
+			if err != nil {
+				fmt.Printf("Invalid storage mode: %v\n", err)
+				continue
+			}
+			if _, err := n.RequestMultiTransfer(targetNodeIDs, fileName, options); err != nil {
+				fmt.Printf("File transfer failed: %v\n", err)
+			}
+		case 15:
+			fmt.Println("Running transfers:")
+			for _, transferID := range n.ActiveTransfers() {
+				fmt.Printf("- %s\n", transferID)
+			}
+			fmt.Println("Interrupted transfers:")
+			for _, transferID := range n.PendingSends() {
+				fmt.Printf("- %s\n", transferID)
+			}
+			var transferID string
+			fmt.Print("Enter the transfer ID to cancel: ")
+			fmt.Scan(&transferID)
+			if err := n.Cancel(transferID); err != nil {
+				fmt.Printf("Cancelling failed: %v\n", err)
+			}
+		case 16:
+			progress := n.Progress("")
+			if len(progress) == 0 {
+				fmt.Println("No transfers")
+			}
+			for _, p := range progress {
+				fmt.Printf("- %s\n", p)
+				for _, peer := range n.PeerProgress(p.TransferID) {
+					fmt.Printf("  on the other side: %s\n", peer)
+				}
+			}
+		case 17:
+			var keyInput string
+			fmt.Print("Enter a ring ID, or a name to hash: ")
+			fmt.Scan(&keyInput)
+			key, err := utils.ParseID(keyInput)
+			if err != nil {
+				key = utils.Hash(keyInput)
+			}
+			var reply node.Message
+			if err := n.FindSuccessor(node.Message{ID: key}, &reply); err != nil {
+				fmt.Printf("Lookup failed: %v\n", err)
+				continue
+			}
+			fmt.Printf("Key %s is owned by node %s (%s), found in %d hops (%s lookup):\n", key, reply.ID, reply.IP, reply.Hops, n.LookupMode)
+			for i, hop := range reply.Path {
+				fmt.Printf("- %d: Node %s (%s)\n", i, hop.ID, hop.IP)
+			}
 		default:
 			// fmt.Println(choice)
 			fmt.Println("Invalid choice")
@@ -1,11 +1,15 @@
 package node
 
 import (
+	"context"
+	"crypto/sha256"
+	"distributed-chord/utils"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
 )
 
 const (
@@ -17,51 +21,100 @@ const (
 
 // Assembler is a function that assembles the chunks of a file
 func (n *Node) Assembler(message Message, reply *Message) error {
-	n.Lock.Lock()
-	n.AssemblerChunks = message.ChunkTransferParams.Chunks // Update the chunks list
-	n.Lock.Unlock()
-
-	// Single node failure - Simulate target node faliure during assembly
-	// os.Exit(1)
+	ctx, err := n.beginTransfer(message.TransferID, message.IP)
+	if err != nil {
+		return err
+	}
+	defer n.transfers.end(message.TransferID)
+	return n.assemble(ctx, message)
+}
 
-	//Simulate node sleep during assembly, node will continue assembly process if it wakes up
-	//time.Sleep(2 * time.Minute)
+// assemble fetches the chunks of a file and joins them into the output folder. The fetched chunks are recorded
+// in the transfer's journal, so when the download fails or ctx is cancelled a later run (after a restart, see
+// ResumeReceives) only fetches the chunks that are still missing. The progress of each phase is reported
+// under the transfer ID.
+func (n *Node) assemble(ctx context.Context, message Message) (err error) {
+	if message.Type != FILE_FETCH {
+		n.Lock.Lock()
+		n.AssemblerChunks = message.ChunkTransferParams.Chunks // Update the chunks list
+		n.Lock.Unlock()
+	}
 
 	if message.ChunkTransferParams.Chunks == nil || len(message.ChunkTransferParams.Chunks) == 0 {
 		return fmt.Errorf("no chunks to assemble")
 	}
+	journal := n.openReceiveJournal(message)
+	n.progress.begin(journal.TransferID, message.FileName, ROLE_RECEIVER)
+	defer func() {
+		switch {
+		case err == nil:
+			n.progress.finish(journal.TransferID, PHASE_DONE)
+		case ctx.Err() != nil:
+			n.progress.finish(journal.TransferID, PHASE_CANCELLED)
+		default:
+			n.progress.finish(journal.TransferID, PHASE_FAILED)
+		}
+	}()
 
-	// Get the name of the first chunk to decipher the output file name and chunk template
-	tempChunkFile := message.ChunkTransferParams.Chunks[0].ChunkName
-
-	// Get the output file name from the chunk name
-	outputFileName, err := getFileNames(tempChunkFile, message.ID)
+	// Chunk names only carry the content digest, so the output file name comes from the transfer metadata
+	outputFileName, err := getFileNames(message.FileName, message.ID)
 	if err != nil {
-		return fmt.Errorf(err.Error())
+		return err
 	}
 
-	// Single node failure - Simulate node failure before/during assembly (after sending chunk info)
-	// fmt.Printf("Pausing for 10 seconds before assembly. You can stop the sender now to simulate failure.\n")
-	// time.Sleep(10 * time.Second)
+	// Fault Tolerance - Target failing or sleeping before assembly, after the sender handed over the chunk info.
+	// The sender or the chunk holders may also crash at this point.
+	n.faultPoint(FAULT_BEFORE_ASSEMBLY)
 
-	// Killing for experiment simulation
-	// fmt.Printf("Pausing for 15 seconds before assembly. You can stop the node now to simulate failure.\n")
-	// time.Sleep(15 * time.Second)
+	erasure := message.ChunkTransferParams.Erasure
+	if erasure.DataShards > 0 {
+		// Any k shards rebuild the data shards, which are then joined like chunks and stripped of their padding
+		err = n.getShards(ctx, journal, message.ChunkTransferParams.Chunks, erasure)
+		if ctx.Err() != nil {
+			return n.receiveCancelled(journal)
+		}
+		if err != nil {
+			fmt.Printf("Error collecting shards: %v\n", err)
+			return err
+		}
 
-	// Multiple Node Failures - Simulate node failure after during assembly
-	// fmt.Printf("Pausing for 20 seconds during assembly. Crash other nodes now.\n")
-	// time.Sleep(20 * time.Second)
+		n.progress.phase(journal.TransferID, PHASE_ASSEMBLING, erasure.DataShards, erasure.FileSize)
+		err = n.assembleChunks(outputFileName, message.ChunkTransferParams.Chunks[:erasure.DataShards], n.assembled(journal.TransferID))
+		if err == nil {
+			err = os.Truncate(n.path(outputFolder, outputFileName), erasure.FileSize)
+		}
+	} else {
+		err = n.getAllChunks(ctx, journal, message.ChunkTransferParams.Chunks)
+		if ctx.Err() != nil {
+			return n.receiveCancelled(journal)
+		}
+		if err != nil {
+			fmt.Printf("Error collecting chunks: %v\n", err)
+			return err
+		}
 
-	err = n.getAllChunks(message.ChunkTransferParams.Chunks)
+		n.progress.phase(journal.TransferID, PHASE_ASSEMBLING, len(message.ChunkTransferParams.Chunks), message.FileSize)
+		err = n.assembleChunks(outputFileName, message.ChunkTransferParams.Chunks, n.assembled(journal.TransferID))
+	}
 	if err != nil {
-		fmt.Printf("Error collecting chunks: %v\n", err)
+		fmt.Printf("Error assembling chunks: %v\n", err)
+		fmt.Printf("Aborting assembling...\n")
 		return err
 	}
 
-	err = assembleChunks(outputFileName, message.ChunkTransferParams.Chunks)
+	if ctx.Err() != nil {
+		os.Remove(n.path(outputFolder, outputFileName))
+		return n.receiveCancelled(journal)
+	}
+
+	err = verifyFileDigest(n.path(outputFolder, outputFileName), message.ChunkTransferParams.FileDigest)
 	if err != nil {
-		fmt.Printf("Error assembling chunks: %v\n", err)
+		fmt.Printf("Error verifying assembled file: %v\n", err)
 		fmt.Printf("Aborting assembling...\n")
+		os.Remove(n.path(outputFolder, outputFileName))
+		// Fetching the same chunks again would give the same file, so the transfer is dropped
+		n.removeChunksRemotely(assembleFolder, message.ChunkTransferParams.Chunks)
+		journal.remove()
 		return err
 	}
 
@@ -69,117 +122,162 @@ func (n *Node) Assembler(message Message, reply *Message) error {
 
 	// Clean up the assemble folder
 	n.removeChunksRemotely(assembleFolder, message.ChunkTransferParams.Chunks)
-	n.removeChunksRemotely(dataFolder, message.ChunkTransferParams.Chunks)
+	journal.remove()
+	if message.Type == FILE_FETCH {
+		return nil // A published file stays in the ring for other nodes to fetch
+	}
+	if message.Type != MULTI_TRANSFER {
+		// The chunks of a multi-recipient transfer are removed by the sender once every target is done
+		n.releaseChunks(message.TransferID, message.ChunkTransferParams.Chunks)
+	}
+	if info, err := os.Stat(n.path(outputFolder, outputFileName)); err == nil {
+		n.addToCatalog(ctx, outputFileName, info.Size(), CATALOG_TRANSFERRED)
+	}
 
-	_, err = CallRPCMethod(message.IP, "Node.AssemblerComplete", Message{})
+	_, err = n.CallRPCMethod(message.IP, "Node.AssemblerComplete", Message{
+		ID:         n.ID,
+		IP:         n.IP,
+		FileName:   message.FileName,
+		TransferID: message.TransferID,
+	})
 	if err != nil {
 		fmt.Printf("Error notifying sender of assembly completion: %v\n", err)
 	}
 	return nil
 }
 
-// Gets all the chunks from the nodes and compiles them into the /assemble folder.
-func (n *Node) getAllChunks(chunkInfo []ChunkInfo) error {
+// Gets all the chunks from the nodes and compiles them into the /assemble folder, several chunks at a time.
+// Chunks that repeat in the file are only fetched once, and chunks the journal lists as fetched not at all.
+func (n *Node) getAllChunks(ctx context.Context, journal *receiveJournal, chunkInfo []ChunkInfo) error {
 	// Create the assemble folder if it doesn't exist
-	if err := os.MkdirAll(assembleFolder, 0755); err != nil {
+	if err := os.MkdirAll(n.path(assembleFolder), 0755); err != nil {
 		return fmt.Errorf("error creating assemble folder: %v", err)
 	}
 
+	unique := []ChunkInfo{}
+	occurrences := make(map[string]int64)
 	for _, chunk := range chunkInfo {
-		var reply Message
-		message := Message{
-			ID: chunk.Key,
-			ChunkTransferParams: ChunkTransferRequest{
-				ChunkName: chunk.ChunkName,
-			},
+		if occurrences[chunk.ChunkName] == 0 {
+			unique = append(unique, chunk)
 		}
+		occurrences[chunk.ChunkName]++
+	}
+	n.progress.phase(journal.TransferID, PHASE_FETCHING, len(unique), journal.FileSize)
 
-		// Incase the node fails during assembly, we have upto 3 retries to handle it(can be changed)
-		// time.Sleep(5 * time.Second)
-		maxRetries := 3
-		retries := 0
-		chunkFound := false
-		var chunkData []byte
-
-		// Start of the retry loop
-		for retries < maxRetries {
-			// Find the successor of the chunk key
-			n.FindSuccessor(message, &reply)
-			targetNode := Pointer{ID: reply.ID, IP: reply.IP}
-
-			// Introduce a sleep to simulate delay
-			// fmt.Printf("Simulating delay before contacting target node %d (%s). You can stop the node now to simulate failure.\n", targetNode.ID, targetNode.IP)
-			// time.Sleep(10 * time.Second)
-
-			// Attempt to get the successor list from the target node
-			successorReply, err := CallRPCMethod(targetNode.IP, "Node.GetSuccessorList", Message{})
+	return n.forEachChunk(ctx, unique, func(ctx context.Context, i int, chunk ChunkInfo) error {
+		destinationPath := n.path(assembleFolder, chunk.ChunkName)
+		if !journal.haveChunk(chunk) {
+			// Save the chunk data in the assemble directory
+			err := n.fetchChunk(ctx, chunk, destinationPath)
 			if err != nil {
-				fmt.Printf("Failed to get successor list from node %d: %v\n", targetNode.ID, err)
-				// Node might have failed; retry FindSuccessor
-				retries++
-				fmt.Printf("Retrying FindSuccessor for chunk %s (attempt %d of %d)\n", chunk.ChunkName, retries, maxRetries)
-				continue // Retry from the beginning of the loop
+				return err
 			}
+			journal.markFetched(chunk.ChunkName)
+		}
+		// A chunk that repeats covers that many parts of the file
+		n.progress.advance(journal.TransferID, 1, fileSize(destinationPath)*occurrences[chunk.ChunkName])
+		return nil
+	})
+}
 
-			// Initialize the list of nodes to try, starting with the target node
-			nodesToTry := []Pointer{targetNode}
-			// Append the successors to the nodesToTry list
-			nodesToTry = append(nodesToTry, successorReply.SuccessorList...)
-
-			// Iterate over the nodes to try
-			for _, node := range nodesToTry {
-				// Attempt to get the chunk from the node
-				reply, err := CallRPCMethod(node.IP, "Node.SendChunk", message)
-				if err != nil {
-					fmt.Printf("Error receiving chunk %s from node %d: %v\n", chunk.ChunkName, node.ID, err)
-					continue // Try the next node
-				}
-
-				// Check if the chunk data is present
-				if reply.ChunkTransferParams.Data == nil || len(reply.ChunkTransferParams.Data) == 0 {
-					fmt.Printf("Node %d does not have the chunk %s\n", node.ID, chunk.ChunkName)
-					continue // Try the next node
-				}
-
-				// Chunk has been found
-				chunkData = reply.ChunkTransferParams.Data
-				chunkFound = true
-				fmt.Printf("Chunk %s successfully retrieved from node %d\n", chunk.ChunkName, node.ID)
-				break
-			}
+// fetchChunk streams one chunk from its owner or the owner's successors into destinationPath, checking its digest
+func (n *Node) fetchChunk(ctx context.Context, chunk ChunkInfo, destinationPath string) error {
+	var reply Message
+	message := Message{
+		ID: chunk.Key,
+		ChunkTransferParams: ChunkTransferRequest{
+			ChunkName: chunk.ChunkName,
+		},
+	}
 
-			if chunkFound {
-				break // Exit the retry loop
-			} else {
-				// If we haven't found the chunk, increment retries and attempt FindSuccessor again
-				retries++
-				fmt.Printf("Chunk %s not found, retrying FindSuccessor (attempt %d of %d)\n", chunk.ChunkName, retries, maxRetries)
-			}
+	// Incase the node fails during assembly, we have upto 3 retries to handle it(can be changed)
+	maxRetries := 3
+	retries := 0
+	chunkFound := false
+
+	// Start of the retry loop
+	for retries < maxRetries {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		if !chunkFound {
-			return fmt.Errorf("failed to retrieve chunk %s from any node after %d attempts", chunk.ChunkName, maxRetries)
+		// Find the successor of the chunk key
+		if err := n.FindSuccessor(message, &reply); err != nil {
+			fmt.Printf("Failed to find the holder of chunk %s: %v\n", chunk.ChunkName, err)
+			retries++
+			fmt.Printf("Retrying FindSuccessor for chunk %s (attempt %d of %d)\n", chunk.ChunkName, retries, maxRetries)
+			continue
 		}
+		targetNode := Pointer{ID: reply.ID, IP: reply.IP}
+
+		// Holder failing before it is contacted
+		n.faultPoint(FAULT_FETCH_CHUNK)
 
-		// Save the chunk data in the assemble directory
-		destinationPath := filepath.Join(assembleFolder, chunk.ChunkName)
-		err := os.WriteFile(destinationPath, chunkData, 0644)
+		// Attempt to get the successor list from the target node
+		successorReply, err := n.CallRPCMethodContext(ctx, targetNode.IP, "Node.GetSuccessorList", Message{})
 		if err != nil {
-			return fmt.Errorf("error writing chunk %s to %s: %v", chunk.ChunkName, destinationPath, err)
+			fmt.Printf("Failed to get successor list from node %s: %v\n", targetNode.ID, err)
+			// Node might have failed; retry FindSuccessor
+			retries++
+			fmt.Printf("Retrying FindSuccessor for chunk %s (attempt %d of %d)\n", chunk.ChunkName, retries, maxRetries)
+			continue // Retry from the beginning of the loop
+		}
+
+		// Initialize the list of nodes to try, starting with the target node
+		nodesToTry := []Pointer{targetNode}
+		// Append the successors to the nodesToTry list
+		nodesToTry = append(nodesToTry, successorReply.SuccessorList...)
+
+		// Iterate over the nodes to try
+		for _, node := range nodesToTry {
+			// Attempt to get the chunk from the node. A missing or corrupted replica counts as a failure.
+			_, err := n.downloadChunk(ctx, node.IP, chunk.ChunkName, chunk.Digest, destinationPath)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				fmt.Printf("Error receiving chunk %s from node %s: %v\n", chunk.ChunkName, node.ID, err)
+				continue // Try the next node
+			}
+
+			// Chunk has been found
+			chunkFound = true
+			fmt.Printf("Chunk %s successfully retrieved from node %s\n", chunk.ChunkName, node.ID)
+			break
 		}
+
+		if chunkFound {
+			break // Exit the retry loop
+		} else {
+			// If we haven't found the chunk, increment retries and attempt FindSuccessor again
+			retries++
+			fmt.Printf("Chunk %s not found, retrying FindSuccessor (attempt %d of %d)\n", chunk.ChunkName, retries, maxRetries)
+		}
+	}
+
+	if !chunkFound {
+		return fmt.Errorf("failed to retrieve chunk %s from any node after %d attempts", chunk.ChunkName, maxRetries)
 	}
 	return nil
 }
 
-// Function to assemble all the chunks from the assemble folder
-func assembleChunks(outputFileName string, chunks []ChunkInfo) error {
+// assembled returns the callback that reports the chunks joined by assembleChunks
+func (n *Node) assembled(transferID string) func(int64) {
+	return func(written int64) {
+		n.progress.advance(transferID, 1, written)
+	}
+}
+
+// Function to assemble all the chunks from the assemble folder. onChunk is called with the size of each chunk
+// once it was written.
+func (n *Node) assembleChunks(outputFileName string, chunks []ChunkInfo, onChunk func(int64)) error {
 
 	// Making the output file
-	if err := os.MkdirAll(outputFolder, 0755); err != nil {
+	if err := os.MkdirAll(n.path(outputFolder), 0755); err != nil {
 		return fmt.Errorf("error creating output folder: %v", err)
 	}
 
-	outputFilePath := filepath.Join(outputFolder, outputFileName)
+	outputFilePath := n.path(outputFolder, outputFileName)
 	outFile, err := os.Create(outputFilePath)
 
 	if err != nil {
@@ -189,42 +287,80 @@ func assembleChunks(outputFileName string, chunks []ChunkInfo) error {
 
 	for i, chunk := range chunks {
 		// filename-chunk
-		content, err := ioutil.ReadFile(filepath.Join(assembleFolder, chunk.ChunkName))
+		chunkFile, err := os.Open(n.path(assembleFolder, chunk.ChunkName))
 		if err != nil {
 			return fmt.Errorf("error reading chunk %s-chunk%d.txt: %v", chunk.ChunkName, int(i+1), err)
 		}
 
-		_, err = outFile.Write(content)
+		written, err := io.Copy(outFile, chunkFile)
+		chunkFile.Close()
 		if err != nil {
 			return fmt.Errorf("error writing chunk %s-chunk%d.txt to output file: %v", chunk.ChunkName, int(i+1), err)
 		}
+		onChunk(written)
 	}
 
 	return nil
 }
 
-func getFileNames(chunkName string, senderID int) (string, error) {
-	for i, v := range chunkName {
-		if v == '-' && chunkName[i+1:i+6] == "chunk" {
-			return chunkName[:i] + "_from_" + strconv.Itoa(senderID) + filepath.Ext(chunkName), nil
-		}
+// verifyFileDigest checks the assembled file against the whole-file digest sent by the sender
+func verifyFileDigest(filePath string, expected string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return fmt.Errorf("error reading %s: %v", filePath, err)
 	}
-	return "", fmt.Errorf("error getting output file name")
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != expected {
+		return fmt.Errorf("file digest mismatch for %s: expected %q, got %s", filePath, expected, digest)
+	}
+	return nil
 }
 
-// SendChunk handles sending a chunk to a requesting node
+func getFileNames(fileName string, senderID utils.ID) (string, error) {
+	fileName = filepath.Base(fileName)
+	if fileName == "" || fileName == "." || fileName == string(filepath.Separator) {
+		return "", fmt.Errorf("error getting output file name")
+	}
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "_from_" + senderID.String() + ext, nil
+}
+
+// SendChunk handles sending one block of a chunk to a requesting node, starting at the requested offset. The
+// block is charged to the upload limit of this node, and the reply tells the caller how long to wait for it.
 func (n *Node) SendChunk(request Message, reply *Message) error {
-	sourcePath := filepath.Join(dataFolder, request.ChunkTransferParams.ChunkName)
+	sourcePath := n.path(dataFolder, request.ChunkTransferParams.ChunkName)
 
-	// Read the chunk data from the shared directory
-	data, err := os.ReadFile(sourcePath)
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk from %s: %v", sourcePath, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to read chunk from %s: %v", sourcePath, err)
 	}
 
-	// Send the chunk data as the reply
+	// Read at most one block from the shared directory
+	block := make([]byte, min(int64(blockSize), max(info.Size()-request.ChunkTransferParams.Offset, 0)))
+	bytesRead, err := file.ReadAt(block, request.ChunkTransferParams.Offset)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read chunk from %s: %v", sourcePath, err)
+	}
+	wait := reserveUpload(n.bulkContext(context.Background()), bytesRead)
+
 	*reply = Message{ChunkTransferParams: ChunkTransferRequest{
-		Data: data,
+		ChunkName: request.ChunkTransferParams.ChunkName,
+		Block:     block[:bytesRead],
+		Offset:    request.ChunkTransferParams.Offset,
+		Size:      info.Size(),
+		RefCount:  n.refs.get(request.ChunkTransferParams.ChunkName),
+		Wait:      wait,
 	}}
 	return nil
 }
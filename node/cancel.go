@@ -0,0 +1,228 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a cancelled transfer ID is remembered, so a late chunk list or resume of it is refused
+const cancelledTransferTTL = 10 * time.Minute
+
+// activeTransfer is a transfer this node is running, as sender or receiver
+type activeTransfer struct {
+	cancel context.CancelFunc
+	peers  []string // IPs of the other participants, told when the transfer is cancelled here
+}
+
+// transferRegistry holds the transfers running on this node so they can be cancelled by ID
+type transferRegistry struct {
+	mu        sync.Mutex
+	active    map[string]*activeTransfer
+	cancelled map[string]time.Time
+}
+
+// begin registers a running transfer and returns the context its loops run under. A transfer that was
+// cancelled can't start again.
+func (r *transferRegistry) begin(transferID string, peers ...string) (context.Context, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		r.active = make(map[string]*activeTransfer)
+		r.cancelled = make(map[string]time.Time)
+	}
+	for id, at := range r.cancelled {
+		if time.Since(at) > cancelledTransferTTL {
+			delete(r.cancelled, id)
+		}
+	}
+	if _, ok := r.cancelled[transferID]; ok {
+		return nil, fmt.Errorf("transfer %s was cancelled", transferID)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.active[transferID] = &activeTransfer{cancel: cancel, peers: peers}
+	return ctx, nil
+}
+
+// end unregisters a transfer once its loops returned
+func (r *transferRegistry) end(transferID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if transfer, ok := r.active[transferID]; ok {
+		transfer.cancel()
+		delete(r.active, transferID)
+	}
+}
+
+// cancel stops a running transfer and remembers its ID. It returns the peers of the transfer and whether it
+// was running.
+func (r *transferRegistry) cancel(transferID string) ([]string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancelled == nil {
+		r.cancelled = make(map[string]time.Time)
+	}
+	r.cancelled[transferID] = time.Now()
+	transfer, ok := r.active[transferID]
+	if !ok {
+		return nil, false
+	}
+	transfer.cancel()
+	return transfer.peers, true
+}
+
+// peers returns the peers of a running transfer, and whether it is running
+func (r *transferRegistry) peers(transferID string) ([]string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transfer, ok := r.active[transferID]
+	if !ok {
+		return nil, false
+	}
+	return transfer.peers, true
+}
+
+// ActiveTransfers returns the IDs of the transfers running on this node
+func (n *Node) ActiveTransfers() []string {
+	n.transfers.mu.Lock()
+	defer n.transfers.mu.Unlock()
+	ids := []string{}
+	for id := range n.transfers.active {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Cancel aborts a transfer on this node and tells the other participants. A running transfer stops its
+// Chunker or Assembler loops and cleans up after itself, an interrupted one is cleaned up from its journal.
+// The sender removes the chunks from /local and the ring, the receiver removes what it fetched into /assemble.
+func (n *Node) Cancel(transferID string) error {
+	if transferID == "" {
+		return fmt.Errorf("no transfer ID to cancel")
+	}
+	return n.cancelTransfer(transferID, Message{})
+}
+
+// CancelTransfer is how the other participants of a transfer cancel it on this node, see Cancel. The caller
+// in message.ID and message.IP must take part in the transfer: a target of a multi-recipient transfer only
+// drops itself out, the other recipients carry on. The reply is CANCELLED.
+func (n *Node) CancelTransfer(message Message, reply *Message) error {
+	transferID := message.TransferID
+	if transferID == "" {
+		return fmt.Errorf("no transfer ID to cancel")
+	}
+	if message.IP == "" {
+		return fmt.Errorf("cancelling transfer %s needs the address of the caller", transferID)
+	}
+
+	if transfer := n.recipients.get(transferID); transfer != nil {
+		if !transfer.hasTarget(message.ID, message.IP) {
+			return fmt.Errorf("node %s at %s is not a target of transfer %s", message.ID, message.IP, transferID)
+		}
+		n.recipients.update(transferID, message.ID, RECIPIENT_CANCELLED, nil)
+		fmt.Printf("[NODE-%s] Node %s cancelled its part of transfer %s\n", n.ID, message.ID, transferID)
+		*reply = Message{Type: CANCELLED, TransferID: transferID}
+		return nil
+	}
+
+	if !slices.Contains(n.transferPeers(transferID), message.IP) {
+		return fmt.Errorf("node at %s does not take part in transfer %s", message.IP, transferID)
+	}
+	if err := n.cancelTransfer(transferID, message); err != nil {
+		return err
+	}
+	*reply = Message{Type: CANCELLED, TransferID: transferID}
+	return nil
+}
+
+// cancelTransfer stops or discards a transfer and tells its peers, except the caller that cancelled it
+func (n *Node) cancelTransfer(transferID string, caller Message) error {
+	peers, running := n.transfers.cancel(transferID)
+	if !running {
+		var err error
+		if peers, err = n.discardJournals(transferID); err != nil {
+			return err
+		}
+	}
+	if caller.IP != "" {
+		fmt.Printf("[NODE-%s] Transfer %s was cancelled by node %s\n", n.ID, transferID, caller.ID)
+	} else {
+		fmt.Printf("[NODE-%s] Transfer %s cancelled\n", n.ID, transferID)
+	}
+
+	for _, peer := range peers {
+		if peer == "" || peer == caller.IP || peer == n.IP {
+			continue
+		}
+		_, err := n.CallRPCMethod(peer, "Node.CancelTransfer", Message{ID: n.ID, IP: n.IP, TransferID: transferID})
+		if err != nil {
+			fmt.Printf("Failed to tell %s that transfer %s was cancelled: %v\n", peer, transferID, err)
+		}
+	}
+	return nil
+}
+
+// transferPeers returns the IPs of the other participants of a transfer, from the registry while it runs and
+// from its journals once it was interrupted
+func (n *Node) transferPeers(transferID string) []string {
+	if peers, running := n.transfers.peers(transferID); running {
+		return peers
+	}
+	peers := []string{}
+	if journal, err := n.loadSendJournal(transferID); err == nil {
+		peers = append(peers, journal.peers()...)
+	}
+	journal := &receiveJournal{root: n.root}
+	if err := readJournal(journalPath(n.root, transferID, receiveJournalExt), journal); err == nil {
+		peers = append(peers, journal.SenderIP)
+	}
+	return peers
+}
+
+// discardJournals cleans up a transfer that is not running but left journals behind, and returns the peers
+// of the transfer
+func (n *Node) discardJournals(transferID string) ([]string, error) {
+	peers := []string{}
+	found := false
+	if journal, err := n.loadSendJournal(transferID); err == nil {
+		found = true
+		peers = append(peers, journal.peers()...)
+		n.discardSend(journal)
+	}
+	journal := &receiveJournal{root: n.root}
+	if err := readJournal(journalPath(n.root, transferID, receiveJournalExt), journal); err == nil {
+		found = true
+		peers = append(peers, journal.SenderIP)
+		n.discardReceive(journal)
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown transfer %s", transferID)
+	}
+	return peers, nil
+}
+
+// discardReceive removes what an incoming transfer fetched into /assemble, along with its journal. The
+// chunks in the ring belong to the sender, which removes them.
+func (n *Node) discardReceive(journal *receiveJournal) {
+	if len(journal.Chunks) > 0 {
+		n.removeChunksRemotely(assembleFolder, journal.Chunks)
+	}
+	journal.remove()
+}
+
+// receiveCancelled cleans up an incoming transfer whose loops stopped because it was cancelled
+func (n *Node) receiveCancelled(journal *receiveJournal) error {
+	fmt.Printf("Transfer %s was cancelled, removing the fetched chunks\n", journal.TransferID)
+	n.discardReceive(journal)
+	return fmt.Errorf("transfer %s was cancelled", journal.TransferID)
+}
+
+// sendCancelled cleans up an outgoing transfer whose loops stopped because it was cancelled
+func (n *Node) sendCancelled(journal *sendJournal) {
+	fmt.Printf("Transfer %s was cancelled, removing its chunks\n", journal.TransferID)
+	n.discardSend(journal)
+}
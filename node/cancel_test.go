@@ -0,0 +1,47 @@
+package node
+
+import "testing"
+
+func TestCancelTransferOnlyByParticipants(t *testing.T) {
+	s := runScenario(t, Scenario{Name: "ring", Steps: ringSteps("a", "b", "c")})
+	a, b, c := s.Node("a"), s.Node("b"), s.Node("c")
+
+	ctx, err := a.transfers.begin("single", b.IP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CallRPCMethod(a.IP, "Node.CancelTransfer", Message{ID: c.ID, IP: c.IP, TransferID: "single"}); err == nil {
+		t.Error("a node that doesn't take part in the transfer cancelled it")
+	}
+	if _, err := c.CallRPCMethod(a.IP, "Node.CancelTransfer", Message{TransferID: "single"}); err == nil {
+		t.Error("a caller without an address cancelled the transfer")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("transfer was cancelled by a node that doesn't take part in it")
+	}
+	if _, err := b.CallRPCMethod(a.IP, "Node.CancelTransfer", Message{ID: b.ID, IP: b.IP, TransferID: "single"}); err != nil {
+		t.Fatalf("the target could not cancel the transfer: %v", err)
+	}
+	if ctx.Err() == nil {
+		t.Error("transfer still runs after its target cancelled it")
+	}
+
+	targets := []Pointer{{ID: b.ID, IP: b.IP}, {ID: c.ID, IP: c.IP}}
+	a.recipients.start("multi", &sendJournal{Targets: targets}, []RecipientStatus{
+		{TargetID: b.ID, TargetIP: b.IP, State: RECIPIENT_ASSEMBLING},
+		{TargetID: c.ID, TargetIP: c.IP, State: RECIPIENT_ASSEMBLING},
+	})
+	// A target can only drop itself out
+	if _, err := c.CallRPCMethod(a.IP, "Node.CancelTransfer", Message{ID: b.ID, IP: c.IP, TransferID: "multi"}); err == nil {
+		t.Error("a target cancelled the part of another target")
+	}
+	if _, err := c.CallRPCMethod(a.IP, "Node.CancelTransfer", Message{ID: c.ID, IP: c.IP, TransferID: "multi"}); err != nil {
+		t.Fatalf("a target could not drop out: %v", err)
+	}
+	for _, recipient := range a.recipients.get("multi").recipients {
+		cancelled := recipient.State == RECIPIENT_CANCELLED
+		if cancelled != (recipient.TargetID == c.ID) {
+			t.Errorf("recipient %s is %s", recipient.TargetIP, recipient.State)
+		}
+	}
+}
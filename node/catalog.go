@@ -0,0 +1,201 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"distributed-chord/utils"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const catalogExt = ".catalog"
+
+// Kinds of catalog entries
+const (
+	CATALOG_PUBLISHED   = "published"   // File published under its name, fetchable by any node
+	CATALOG_TRANSFERRED = "transferred" // File transferred to a node and assembled in its output folder
+)
+
+// Catalog search modes
+const (
+	CATALOG_LIST    = "list"    // Every file
+	CATALOG_PREFIX  = "prefix"  // Files whose name starts with the query
+	CATALOG_KEYWORD = "keyword" // Files whose name contains every word of the query, ignoring case
+)
+
+// CatalogEntry records one file known to the ring. Entries are stored like chunks, on the owner of their key
+// and its successor list, so they survive nodes leaving and are repaired by anti-entropy.
+type CatalogEntry struct {
+	FileName string
+	FileSize int64
+	Owner    utils.ID // Node holding the file: the publisher, or the receiver of a transfer
+	OwnerIP  string
+	Kind     string // CATALOG_PUBLISHED or CATALOG_TRANSFERRED
+	Time     time.Time
+}
+
+// CatalogQuery selects catalog entries
+type CatalogQuery struct {
+	Mode string // CATALOG_LIST, CATALOG_PREFIX or CATALOG_KEYWORD
+	Text string
+}
+
+// catalogChunkName names the entry of a file. A file published again, or transferred again to the same
+// node, keeps its name and so replaces its previous entry.
+func catalogChunkName(entry CatalogEntry) string {
+	sum := sha256.Sum256([]byte(entry.Kind + "\x00" + entry.Owner.String() + "\x00" + entry.FileName))
+	return hex.EncodeToString(sum[:]) + catalogExt
+}
+
+func isCatalogEntry(chunkName string) bool {
+	return strings.HasSuffix(chunkName, catalogExt)
+}
+
+// matches reports whether entry is selected by the query
+func (q CatalogQuery) matches(entry CatalogEntry) bool {
+	switch q.Mode {
+	case CATALOG_PREFIX:
+		return strings.HasPrefix(entry.FileName, q.Text)
+	case CATALOG_KEYWORD:
+		name := strings.ToLower(entry.FileName)
+		for _, keyword := range strings.Fields(strings.ToLower(q.Text)) {
+			if !strings.Contains(name, keyword) {
+				return false
+			}
+		}
+		return true
+	default:
+		return true
+	}
+}
+
+// ParseCatalogQuery checks a search mode and builds the query
+func ParseCatalogQuery(mode string, text string) (CatalogQuery, error) {
+	switch mode {
+	case CATALOG_LIST, CATALOG_PREFIX, CATALOG_KEYWORD:
+		return CatalogQuery{Mode: mode, Text: text}, nil
+	default:
+		return CatalogQuery{}, fmt.Errorf("unknown catalog search %q (expected list, prefix or keyword)", mode)
+	}
+}
+
+// addToCatalog stores the catalog entry of a file in the ring. A missing entry doesn't affect the file
+// itself, so failures are only reported.
+func (n *Node) addToCatalog(ctx context.Context, fileName string, fileSize int64, kind string) {
+	entry := CatalogEntry{
+		FileName: fileName,
+		FileSize: fileSize,
+		Owner:    n.ID,
+		OwnerIP:  n.IP,
+		Kind:     kind,
+		Time:     time.Now(),
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = n.storeRecord(ctx, catalogChunkName(entry), data)
+	}
+	if err != nil {
+		fmt.Printf("Failed to add %s to the catalog: %v\n", fileName, err)
+	}
+}
+
+// removeFromCatalog drops the catalog entry of a file from the ring, e.g. the entry of the previous publisher
+// of a file that another node published again
+func (n *Node) removeFromCatalog(fileName string, owner utils.ID, kind string) {
+	entryName := catalogChunkName(CatalogEntry{FileName: fileName, Owner: owner, Kind: kind})
+	n.releaseChunks("", []ChunkInfo{{Key: chunkKey(entryName), ChunkName: entryName}})
+}
+
+// SearchCatalog returns the catalog entries stored on this node that match message.Query
+func (n *Node) SearchCatalog(message Message, reply *Message) error {
+	chunks, err := n.listSharedChunks()
+	if err != nil {
+		return err
+	}
+	entries := []CatalogEntry{}
+	for _, chunk := range chunks {
+		if !isCatalogEntry(chunk.ChunkName) {
+			continue
+		}
+		data, err := os.ReadFile(n.path(dataFolder, chunk.ChunkName))
+		if err != nil {
+			continue // Removed while we were listing
+		}
+		var entry CatalogEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			fmt.Printf("Skipping unreadable catalog entry %s: %v\n", chunk.ChunkName, err)
+			continue
+		}
+		if message.Query.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	*reply = Message{Catalog: entries}
+	return nil
+}
+
+// QueryCatalog searches the catalog across the ring. This RPC is the catalog's API for other programs. Every
+// node is asked for its matching entries at the same time, and the copies held by replica holders are merged
+// into one entry per file. The nodes that couldn't be searched are listed in reply.Unreachable; the entries
+// they hold are usually found on their replica holders anyway.
+func (n *Node) QueryCatalog(message Message, reply *Message) error {
+	nodes, err := GetAllNodes(n)
+	if err != nil {
+		return fmt.Errorf("failed to list the nodes in the ring: %v", err)
+	}
+
+	// A node that is slow or down only holds up the search by its own RPC timeout
+	found := make([][]CatalogEntry, len(nodes))
+	reached := make([]bool, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node Pointer) {
+			defer wg.Done()
+			nodeReply, err := n.CallRPCMethod(node.IP, "Node.SearchCatalog", Message{Query: message.Query})
+			if err != nil {
+				fmt.Printf("Failed to search the catalog on node %s: %v\n", node.ID, err)
+				return
+			}
+			found[i] = nodeReply.Catalog
+			reached[i] = true
+		}(i, node)
+	}
+	wg.Wait()
+
+	unreachable := []Pointer{}
+	for i, node := range nodes {
+		if !reached[i] {
+			unreachable = append(unreachable, node)
+		}
+	}
+
+	merged := make(map[string]CatalogEntry)
+	for _, nodeEntries := range found {
+		for _, entry := range nodeEntries {
+			name := catalogChunkName(entry)
+			if existing, ok := merged[name]; !ok || entry.Time.After(existing.Time) {
+				merged[name] = entry // A replica that missed an update can hold an older copy
+			}
+		}
+	}
+
+	entries := make([]CatalogEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FileName != entries[j].FileName {
+			return entries[i].FileName < entries[j].FileName
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	*reply = Message{Catalog: entries, Unreachable: unreachable}
+	return nil
+}
@@ -0,0 +1,29 @@
+package node
+
+import "testing"
+
+func TestRepublishReplacesCatalogEntry(t *testing.T) {
+	s := runScenario(t, Scenario{Name: "ring", Steps: ringSteps("a", "b", "c", "d")})
+	for i, name := range []string{"a", "c"} {
+		if err := s.WriteFile(name, "notes.txt", fileData(1000+i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Node(name).Publish("notes.txt", TransferOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var reply Message
+	if err := s.Node("b").QueryCatalog(Message{Query: CatalogQuery{Mode: CATALOG_LIST}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Unreachable) != 0 {
+		t.Errorf("nodes %v could not be searched", reply.Unreachable)
+	}
+	if len(reply.Catalog) != 1 {
+		t.Fatalf("catalog holds %d entries after the file was published twice, want 1: %v", len(reply.Catalog), reply.Catalog)
+	}
+	if entry := reply.Catalog[0]; entry.Owner != s.Node("c").ID || entry.Kind != CATALOG_PUBLISHED {
+		t.Errorf("catalog entry is %s by %s, want published by c", entry.Kind, entry.OwnerIP)
+	}
+}
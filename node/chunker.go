@@ -1,186 +1,414 @@
 package node
 
 import (
+	"context"
+	"crypto/sha256"
 	"distributed-chord/utils"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
+const assemblyTimeout = 60 * time.Second // How long ChunkLocationReceiver waits for the target to assemble the file
+
 type ChunkInfo struct {
-	Key       int
+	Key       utils.ID
 	ChunkName string
+	Digest    string // SHA-256 of the chunk content, checked on every hop
 }
 
-func (n *Node) Chunker(fileName string, targetNodeIP string, startTime time.Time) []ChunkInfo {
-	dataDir := "/local" // Change if needed
-	var chunkSize int
-	const TargetRetry = 10 * time.Second
+// contentChunkName is the name of a chunk with the given content digest
+func contentChunkName(digest string) string {
+	return digest + ".chunk"
+}
+
+// Chunker cuts the file of a transfer into chunks, stores them in the ring and hands their locations to the
+// target, or publishes them under the file name. Every step is recorded in the journal, so when the journal already lists the chunks (the transfer
+// is being resumed) the file is not cut again and only the chunks that were not stored yet are sent.
+// The progress of each phase is reported under the transfer ID.
+func (n *Node) Chunker(ctx context.Context, journal *sendJournal) (sent []ChunkInfo) {
+	fileName, targetNodeIP := journal.FileName, journal.TargetIP
+	n.progress.begin(journal.TransferID, fileName, ROLE_SENDER)
+	defer func() {
+		switch {
+		case sent != nil:
+			n.progress.finish(journal.TransferID, PHASE_DONE)
+		case ctx.Err() != nil:
+			n.progress.finish(journal.TransferID, PHASE_CANCELLED)
+		default:
+			n.progress.finish(journal.TransferID, PHASE_FAILED)
+		}
+	}()
+
+	if len(journal.Chunks) == 0 {
+		size := fileSize(n.path(localFolder, fileName))
+		n.progress.phase(journal.TransferID, PHASE_CHUNKING, 0, size)
+		chunks, fileDigest, erasure, err := n.cutFile(journal.TransferID, fileName, journal.Options)
+		if err != nil {
+			fmt.Println("Error chunking file:", err)
+			if len(chunks) > 0 {
+				n.removeChunksRemotely(localFolder, chunks)
+			}
+			journal.remove()
+			return nil
+		}
+		journal.setChunks(chunks, size, fileDigest, erasure)
+	} else {
+		stored := 0
+		for i := range journal.Chunks {
+			if journal.stored(i) {
+				stored++
+			}
+		}
+		fmt.Printf("Resuming transfer %s: %d of %d chunks already stored\n", journal.TransferID, stored, len(journal.Chunks))
+	}
+	chunks := journal.Chunks
+
+	// Chunks stored before the transfer was interrupted count as done
+	var total int64
+	sizes := make([]int64, len(chunks))
+	for i, chunk := range chunks {
+		sizes[i] = fileSize(n.path(localFolder, chunk.ChunkName))
+		total += sizes[i]
+	}
+	n.progress.phase(journal.TransferID, PHASE_REPLICATING, len(chunks), total)
+	for i := range chunks {
+		if journal.stored(i) {
+			n.progress.advance(journal.TransferID, 1, sizes[i])
+		}
+	}
+
+	var err error
+	if journal.Erasure.DataShards > 0 {
+		fmt.Println("Sending the shards to the ring ...")
+		err = n.sendShards(ctx, journal)
+	} else {
+		fmt.Println("Sending the chunks to the receiver folder of the target node ...")
+		err = n.send(ctx, journal)
+	}
+	// A transfer that was cancelled is cleaned up right away, any other failure leaves it for a resume
+	abort := func() []ChunkInfo {
+		if ctx.Err() != nil {
+			n.sendCancelled(journal)
+		} else {
+			fmt.Println("Choose option 9 to resume the transfer or discard it.")
+		}
+		return nil
+	}
+	if err != nil {
+		// The chunks already stored stay in the ring, so a resume only sends the rest
+		fmt.Printf("Failed to send chunks for transfer %s: %v\n", journal.TransferID, err)
+		return abort()
+	}
+
+	if journal.Publish {
+		if err := n.publishManifest(ctx, journal); err != nil {
+			fmt.Printf("Failed to publish the manifest of %s: %v\n", fileName, err)
+			return abort()
+		}
+		n.removeChunksRemotely(localFolder, chunks)
+		journal.remove()
+		return chunks
+	}
+
+	message := Message{
+		ID:         n.ID,
+		IP:         n.IP,
+		FileName:   fileName,
+		FileSize:   journal.FileSize,
+		TransferID: journal.TransferID,
+		ChunkTransferParams: ChunkTransferRequest{
+			Chunks:     chunks,
+			FileDigest: journal.FileDigest,
+			Erasure:    journal.Erasure,
+		},
+	}
+	if len(journal.Targets) > 0 {
+		message.Type = MULTI_TRANSFER
+		n.progress.phase(journal.TransferID, PHASE_LOCATING, len(journal.Targets), 0)
+		if !n.sendToTargets(ctx, journal, message) {
+			return abort()
+		}
+		journal.remove()
+		return chunks
+	}
+	n.progress.phase(journal.TransferID, PHASE_LOCATING, 1, 0)
+	if !n.sendChunkLocations(ctx, targetNodeIP, message) {
+		return abort()
+	}
+	n.progress.advance(journal.TransferID, 1, 0)
+	journal.remove()
+	return chunks
+}
+
+// cutFile writes the chunks or erasure-coded shards of a file in /local to /local. It returns the chunks,
+// the digest of the whole file and, for erasure-coded transfers, the shard layout.
+func (n *Node) cutFile(transferID string, fileName string, options TransferOptions) ([]ChunkInfo, string, ErasureParams, error) {
+	dataDir := n.path(localFolder)
 	var chunks []ChunkInfo
 
 	// checking if the file exists in the loacl file path of the docker container
 	filePath := filepath.Join(dataDir, fileName)
 	fileInfo, err := os.Stat(filePath)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		fmt.Printf("File %s does not exist in directory %s\n", fileName, dataDir)
-		return nil
+	if os.IsNotExist(err) {
+		return nil, "", ErasureParams{}, fmt.Errorf("file %s does not exist in directory %s", fileName, dataDir)
 	} else if err != nil {
-		fmt.Printf("Error checking file existence: %v\n", err)
-		return nil
+		return nil, "", ErasureParams{}, fmt.Errorf("error checking file existence: %v", err)
 	}
 
-	fileSize := fileInfo.Size()    // Convert to KB
-	fileSizenew := fileSize / 1000 // Convert to MB
-
-	// Calculate number of chunks using logarithmic scaling
-	// log2(fileSize) rounded up, with a minimum of 1 and maximum of 20
-	numChunks := int(math.Ceil(math.Log2(math.Max(float64(fileSizenew), 1))))
-	// numChunks = max(1, min(numChunks, 20))
+	fileSize := fileInfo.Size()
+	if fileSize == 0 {
+		return nil, "", ErasureParams{}, fmt.Errorf("file %s is empty, nothing to send", fileName)
+	}
 
-	// Dynamically calculate chunk size
-	chunkSize = int(math.Ceil(float64(fileSize) / float64(numChunks)))
-	fmt.Printf("Chunk size: %v, number of Chunks: %v", chunkSize, numChunks)
 	// Open the source file
 	file, err := os.Open(filePath)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return nil
+		return nil, "", ErasureParams{}, fmt.Errorf("error opening file: %v", err)
 	}
 	defer file.Close()
 
-	ext := filepath.Ext(fileName)
-	baseName := strings.TrimSuffix(fileName, ext)
-
-	buffer := make([]byte, chunkSize)
-	chunkNumber := 1
+	if options.DataShards > 0 {
+		// Each shard is stored once instead of on the owner and its whole successor list
+		fmt.Printf("Erasure coding %s (%d bytes) into %d data and %d parity shards\n", fileName, fileSize, options.DataShards, options.ParityShards)
+		shards, params, fileDigest, err := writeShards(file, fileSize, options, dataDir)
+		n.progress.advance(transferID, len(shards), fileSize)
+		return shards, fileDigest, params, err
+	}
 
-	// Single node failure - Simulate node failure before chunking (before sending chunk info)
-	// fmt.Println("Waiting for 10 seconds before chunking. You can now kill the sender node.")
-	// time.Sleep(10 * time.Second)
+	strategy := n.Chunking
+	if strategy == nil {
+		strategy = LogChunking{}
+	}
+	fmt.Printf("Chunking %s (%d bytes) with the %s strategy\n", fileName, fileSize, strategy.Name())
 
-	for {
-		bytesRead, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			fmt.Println("Error reading file:", err)
-			return nil
-		}
-		if bytesRead == 0 {
-			break
-		}
+	chunkNumber := 1
+	fileHash := sha256.New() // Whole-file digest, checked by the target after assembly
 
-		// Create the chunk file name by appending the chunk number at the end of the sanitized path without extension
-		os.Setenv("TZ", "Asia/Singapore")
-		timestamp := time.Now().In(time.Local).Format("02012006_150405")
-		chunkFileName := fmt.Sprintf("%s-chunk-%d-%d-%s%s", baseName, chunkNumber, n.ID, timestamp, ext)
-		chunkFilePath := filepath.Join(dataDir, chunkFileName)
-		err = os.WriteFile(chunkFilePath, buffer[:bytesRead], 0644)
-		if err != nil {
-			fmt.Printf("Error writing chunk file %s: %v\n", chunkFileName, err)
-			return nil
-		}
+	// Single node failure - sender fails before chunking (before sending chunk info)
+	n.faultPoint(FAULT_BEFORE_CHUNKING)
 
-		fmt.Printf("Chunk %d written: %s\n", chunkNumber, chunkFilePath)
-		hashedKey := utils.Hash(chunkFileName)
-		chunks = append(chunks, ChunkInfo{
-			Key:       hashedKey,
-			ChunkName: chunkFileName,
-		})
+	// Chunks are content-addressed: the name is the digest of the content, so identical chunks from any
+	// file or any send share one name, one key and one copy on each holder
+	writer := &chunkFileWriter{dir: dataDir, cut: func(chunk ChunkInfo, size int64) error {
+		fmt.Printf("Chunk %d written: %s\n", chunkNumber, filepath.Join(dataDir, chunk.ChunkName))
+		n.progress.advance(transferID, 1, size)
+		chunks = append(chunks, chunk)
 
-		//Simulate Target Node failure during chunking
-
-		//Force exit the target node after writing a few chunks (e.g., after 2 chunks)
-		// if chunkNumber == 2 {
-		// 	fmt.Printf("Triggering target node failure...\n")
-		// 	_, err = CallRPCMethod(targetNodeIP, "Node.ForceExit", Message{})
-		// 	if err != nil {
-		// 		fmt.Printf("Failed to trigger target node failure: %v\n", err)
-		// 	}
-		// }
+		// Sender or target failure during chunking, e.g. after the second chunk
+		n.faultPoint(FAULT_CHUNK_WRITTEN)
 
 		fmt.Printf("Chunks: %v\n", chunks)
 		chunkNumber++
-	}
-
-	fmt.Println("Sending the chunks to the receiver folder of the target node ...")
-	err = n.send(chunks, targetNodeIP)
-	if err != nil {
-		fmt.Printf("Target Node is down,failed to send chunks to target node: %v\n", err)
-		// Cleanup chunks since sending failed
-		n.removeChunksRemotely(localFolder, chunks)
-		n.removeChunksRemotely(dataFolder, chunks)
 		return nil
+	}}
+	defer writer.abort()
+	err = strategy.Split(io.TeeReader(file, fileHash), fileSize, writer)
+	return chunks, hex.EncodeToString(fileHash.Sum(nil)), ErasureParams{}, err
+}
+
+// chunkFileWriter stores the chunks a ChunkingStrategy cuts as files in dir. Each chunk is written to a
+// temporary file while it is hashed, and renamed after its digest when it is cut.
+type chunkFileWriter struct {
+	dir     string
+	current *digestWriter
+	cut     func(chunk ChunkInfo, size int64) error // Called once each chunk is stored
+}
+
+func (w *chunkFileWriter) Write(data []byte) error {
+	if w.current == nil {
+		writer, err := newDigestWriter(w.dir, contentChunkName)
+		if err != nil {
+			return err
+		}
+		w.current = writer
 	}
+	return w.current.write(data)
+}
 
-	// Send the chunk info to the target node for assembling
-	elapsedTime := time.Since(startTime).Seconds()
-	if elapsedTime >= 10 {
-		fmt.Println("\nFile transfer took longer than expected. Please retry.")
-		// Clean up chunks
-		n.removeChunksRemotely(localFolder, chunks)
-		n.removeChunksRemotely(dataFolder, chunks)
+func (w *chunkFileWriter) Cut() error {
+	writer := w.current
+	if writer == nil {
 		return nil
 	}
+	w.current = nil
+	chunkName, digest, err := writer.finish()
+	if err != nil {
+		return err
+	}
+	return w.cut(ChunkInfo{Key: chunkKey(chunkName), ChunkName: chunkName, Digest: digest}, writer.size)
+}
 
-	message := Message{
-		ID: n.ID,
-		IP: n.IP,
-		ChunkTransferParams: ChunkTransferRequest{
-			Chunks: chunks,
-		},
+// abort drops a chunk that was not cut, after Split failed
+func (w *chunkFileWriter) abort() {
+	if w.current != nil {
+		w.current.abort()
+		w.current = nil
 	}
+}
+
+// sendChunkLocations hands the chunk list to the target node so it can assemble the file, then removes the
+// local copies of the chunks. On failure it returns false and leaves the chunks in place, so the transfer
+// can be resumed from its journal.
+func (n *Node) sendChunkLocations(ctx context.Context, targetNodeIP string, message Message) bool {
+	chunks := message.ChunkTransferParams.Chunks
+
+	// Send the chunk info to the target node for assembling. However long the chunks took to store, the
+	// transfer goes on: it is only given up when the target can't be reached or the transfer is cancelled.
 	fmt.Printf("Sending chunk info to the target node at %s. Chunk info %v\n", targetNodeIP, chunks)
 
-	// Uncomment this for target node sleeping before receiving chunk info
+	// Target node failing or sleeping before it receives the chunk info
 	fmt.Printf("Going to send to chunk location receiver\n")
-	// fmt.Printf("Kill the target node in the 3 second duration.\n")
-	// time.Sleep(3 * time.Second)
-	
+	n.faultPoint(FAULT_BEFORE_CHUNK_INFO)
+
+	if err := n.handChunkLocations(ctx, targetNodeIP, message); err != nil {
+		return false
+	}
+
+	n.removeChunksRemotely(localFolder, chunks)
+
+	return true
+}
+
+// handChunkLocations calls ChunkLocationReceiver on the target, retrying for a while if it can't be reached.
+// The call returns once the target assembled the file or gave up.
+func (n *Node) handChunkLocations(ctx context.Context, targetNodeIP string, message Message) error {
+	const TargetRetry = 10 * time.Second
 	retryInterval := 2 * time.Second
 	retryStartTime := time.Now()
 	var sendErr error
 
 	for time.Since(retryStartTime) < TargetRetry {
-		_, sendErr = CallRPCMethod(targetNodeIP, "Node.ChunkLocationReceiver", message)
+		_, sendErr = n.CallRPCMethodContext(ctx, targetNodeIP, "Node.ChunkLocationReceiver", message)
 		if sendErr == nil {
 			// Successfully sent the chunk info
 			break
 		}
+		if ctx.Err() != nil {
+			return ctx.Err() // The target aborted because the transfer was cancelled
+		}
+		var remoteErr *RemoteError
+		if errors.As(sendErr, &remoteErr) {
+			fmt.Printf("Target node failed to assemble the file: %v\n", remoteErr.Err)
+			return sendErr // The target got the chunk info, trying again would only repeat the assembly
+		}
 		fmt.Printf("Failed to send chunk info to target node: %v. Retrying in %v...\n", sendErr, retryInterval)
-		time.Sleep(retryInterval)
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	if sendErr != nil {
 		fmt.Printf("Failed to send chunk info to target node after %v: %v\n", TargetRetry, sendErr)
-		n.removeChunksRemotely(localFolder, chunks)
-		n.removeChunksRemotely(dataFolder, chunks)
-		return nil
 	}
-
-	n.removeChunksRemotely(localFolder, chunks)
-
-	return chunks
+	return sendErr
 }
 
-// ReceiveChunk handles receiving a chunk and saving it to the shared directory
+// ReceiveChunk handles receiving one block of a chunk. Blocks are appended to a partial file, and the chunk
+// is moved into the shared directory once the final block arrived and the digest matches. Blocks are
+// charged to the download limit of this node, and the reply tells the caller how long to wait before the next.
 func (n *Node) ReceiveChunk(request Message, reply *Message) error {
-	destinationPath := filepath.Join("/shared", request.ChunkTransferParams.ChunkName)
-
-	// Write the chunk data to the shared directory
-	err := os.WriteFile(destinationPath, request.ChunkTransferParams.Data, 0644)
+	chunkName := request.ChunkTransferParams.ChunkName
+	wait := reserveDownload(n.bulkContext(context.Background()), len(request.ChunkTransferParams.Block))
+	partialPath, err := n.receiveBlock(request.ChunkTransferParams)
 	if err != nil {
-		return fmt.Errorf("failed to write chunk to %s: %v", destinationPath, err)
+		return err
+	}
+	*reply = Message{Type: "CHUNK_TRANSFER", ChunkTransferParams: ChunkTransferRequest{ChunkName: chunkName, Wait: wait}}
+	if partialPath == "" {
+		return nil // More blocks to come
 	}
 
-	*reply = Message{Type: "CHUNK_TRANSFER", ChunkTransferParams: request.ChunkTransferParams}
+	destinationPath := n.path(dataFolder, chunkName)
+	if err := os.Rename(partialPath, destinationPath); err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("failed to write chunk to %s: %v", destinationPath, err)
+	}
+	n.forgetDigest(chunkName)
+
+	// A transfer adds its reference, once however often it is resumed, while a replica copied from another
+	// holder takes over its count
+	if request.Type == CHUNK_REPLICA {
+		n.refs.set(chunkName, max(request.ChunkTransferParams.RefCount, 1))
+	} else {
+		n.refs.addOnce(chunkName, request.TransferID)
+	}
 	return nil
 }
 
-func (n *Node) send(chunks []ChunkInfo, targetNodeIP string) error {
-	for _, chunk := range chunks {
+// pushChunk copies a chunk from /shared on this node into the /shared folder of the node at ip, along with its reference count
+func (n *Node) pushChunk(ip string, chunkName string) error {
+	digest, err := n.chunkDigest(chunkName)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk %s: %v", chunkName, err)
+	}
+	request := Message{
+		Type: CHUNK_REPLICA,
+		ChunkTransferParams: ChunkTransferRequest{
+			ChunkName: chunkName,
+			Digest:    digest,
+			RefCount:  n.refs.get(chunkName),
+		},
+	}
+	return n.uploadChunk(n.bulkContext(context.Background()), ip, n.path(dataFolder, chunkName), request)
+}
+
+// storeChunkRef adds the reference of a transfer to chunk on the node at ip. The file at path is only uploaded
+// if the node doesn't already hold the same content. It reports whether the data was uploaded. The node counts
+// the reference of a transfer once, so a resumed transfer can store the same chunk again.
+func (n *Node) storeChunkRef(ctx context.Context, ip string, chunk ChunkInfo, path string, transferID string) (bool, error) {
+	if n.hasChunk(ip, chunk, chunk.Digest) {
+		_, err := n.CallRPCMethodContext(ctx, ip, "Node.AddChunkRef", Message{
+			TransferID:          transferID,
+			ChunkTransferParams: ChunkTransferRequest{ChunkName: chunk.ChunkName},
+		})
+		if err == nil {
+			return false, nil
+		}
+		// The chunk was dropped in the meantime, so upload it after all
+	}
+
+	request := Message{
+		Type:       "CHUNK_TRANSFER",
+		TransferID: transferID,
+		ChunkTransferParams: ChunkTransferRequest{
+			ChunkName: chunk.ChunkName,
+			Digest:    chunk.Digest,
+		},
+	}
+	err := n.uploadChunk(ctx, ip, path, request)
+	return err == nil, err
+}
+
+// replicaHolders returns the owner of a key followed by its successors, without duplicates.
+// In rings with fewer than r+1 nodes the successor list wraps around and repeats nodes.
+func replicaHolders(owner Pointer, successorList []Pointer) []Pointer {
+	holders := []Pointer{owner}
+	seen := map[string]bool{owner.IP: true}
+	for _, successor := range successorList {
+		if successor.IP == "" || seen[successor.IP] {
+			continue
+		}
+		seen[successor.IP] = true
+		holders = append(holders, successor)
+	}
+	return holders
+}
+
+// send stores every chunk of a transfer on its owner and the owner's successor list, several chunks at a
+// time. Chunks the journal already lists as stored are skipped. It returns TransferErrors listing the chunks
+// whose owner could not be reached.
+func (n *Node) send(ctx context.Context, journal *sendJournal) error {
+	err := n.forEachChunk(ctx, journal.Chunks, func(ctx context.Context, i int, chunk ChunkInfo) error {
+		if journal.replicated(i) {
+			return nil
+		}
 		var key = chunk.Key
 		var chunkName = chunk.ChunkName
 
@@ -188,67 +416,68 @@ func (n *Node) send(chunks []ChunkInfo, targetNodeIP string) error {
 		var reply Message
 		err := n.FindSuccessor(message, &reply)
 		if err != nil {
-			fmt.Printf("Failed to find successor: %v\n", err)
-			continue
+			return fmt.Errorf("failed to find successor: %v", err)
 		}
 		sendToNodeIP := reply.IP
 		fmt.Printf("Sending chunk %s to node IP: %s\n", chunkName, sendToNodeIP)
 
 		// Get the successor list of the node
-		successorReply, err := CallRPCMethod(sendToNodeIP, "Node.GetSuccessorList", Message{})
+		successorReply, err := n.CallRPCMethodContext(ctx, sendToNodeIP, "Node.GetSuccessorList", Message{})
 		if err != nil {
-			fmt.Printf("Failed to get successor list: %v\n", err)
-			continue
+			return fmt.Errorf("failed to get successor list: %v", err)
 		}
 		successorList := successorReply.SuccessorList
 		fmt.Printf("Successor list: %v\n", successorList)
 
-		// Read the chunk data from the local directory
-		chunkPath := filepath.Join("/local", chunkName)
-		data, err := os.ReadFile(chunkPath)
+		// Refuse to distribute a chunk that changed since it was written
+		chunkPath := n.path(localFolder, chunkName)
+		digest, err := hashFile(chunkPath)
 		if err != nil {
-			fmt.Printf("Failed to read chunk %s: %v\n", chunkName, err)
-			continue
+			return fmt.Errorf("failed to read chunk: %v", err)
 		}
-
-		// Create the chunk transfer request
-		request := Message{
-			Type: "CHUNK_TRANSFER",
-			ChunkTransferParams: ChunkTransferRequest{
-				ChunkName: chunkName,
-				Data:      data,
-			},
-		}
-
-		_, err = CallRPCMethod(sendToNodeIP, "Node.ReceiveChunk", request)
-		if err != nil {
-			fmt.Printf("Failed to send chunk %s to node %s: %v\n", chunkName, sendToNodeIP, err)
-			continue
+		if digest != chunk.Digest {
+			return fmt.Errorf("chunk %s in %s does not match its digest", chunkName, localFolder)
 		}
 
-		fmt.Printf("Chunk %s sent successfully to node %s\n", chunkName, sendToNodeIP)
-
-		for i := 0; i < len(successorList); i++ {
-			request2 := Message{
-				Type: "CHUNK_TRANSFER",
-				ChunkTransferParams: ChunkTransferRequest{
-					ChunkName: chunkName,
-					Data:      data,
-				},
+		// Store a reference on the owner first, then on every replica holder. Holders that already
+		// have the chunk, from another file or an earlier send, only get their reference count bumped.
+		// Each holder is journaled before and after its upload, so a resume skips the holders that are
+		// done and retries the others, whose reference is only counted once.
+		holders := replicaHolders(Pointer{ID: reply.ID, IP: reply.IP}, successorList)
+		for h, holder := range holders {
+			if !journal.replicaDone(i, holder.IP) {
+				journal.startReplica(i, holder.IP)
+				uploaded, err := n.storeChunkRef(ctx, holder.IP, chunk, chunkPath, journal.TransferID)
+				if err != nil {
+					if h == 0 {
+						// The owner is unreachable, FindSuccessor will pick another one on the next lookup
+						return fmt.Errorf("failed to send chunk to owner %s: %v", holder.IP, err)
+					}
+					fmt.Printf("Failed to send chunk %s to node %s: %v\n", chunkName, holder.IP, err)
+					continue
+				}
+				journal.finishReplica(i, holder.IP)
+				if uploaded {
+					fmt.Printf("Chunk %s sent successfully to node %s\n", chunkName, holder.IP)
+				} else {
+					fmt.Printf("Chunk %s already present on node %s, added a reference\n", chunkName, holder.IP)
+				}
 			}
-
-			successor := successorList[i]
-			_, err = CallRPCMethod(successor.IP, "Node.ReceiveChunk", request2)
-			fmt.Printf("Sending chunk to successor node with IP %v\n", successor.IP)
-			if err != nil {
-				fmt.Printf("Failed to send chunk %s to node %s: %v\n", chunkName, successor.IP, err)
-				continue
+			if h == 0 && !journal.stored(i) {
+				journal.markStored(i)
+				n.progress.advance(journal.TransferID, 1, fileSize(chunkPath))
+				n.faultPoint(FAULT_CHUNK_STORED)
 			}
-			fmt.Printf("Chunk %s sent successfully to node %s\n", chunkName, successor.IP)
 		}
-
+		journal.markReplicated(i)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !journal.Publish {
+		fmt.Printf("Chunk info sent successfully to node %s\n", journal.TargetIP)
 	}
-	fmt.Printf("Chunk info sent successfully to node %s\n", targetNodeIP)
 	return nil
 }
 
@@ -262,47 +491,37 @@ func (n *Node) send(chunks []ChunkInfo, targetNodeIP string) error {
 // }
 
 func (n *Node) ChunkLocationReceiver(message Message, reply *Message) error {
-
-	// Fault Tolerance - Torget node is unreachabele/sleeping before the chunks array are sent (may or may not come back alive)
-	// fmt.Printf("[NODE-%d] Simulating sleep. Ignoring requests for 12 seconds...Kill the current node\n", n.ID)
-	// os.Exit(0)
+	// Fault Tolerance - Target node is unreachable/sleeping when the chunks array is sent (may or may not come back alive)
+	n.faultPoint(FAULT_CHUNK_INFO_RECEIVED)
 
 	// Validate chunk information
 	if message.ChunkTransferParams.Chunks == nil || len(message.ChunkTransferParams.Chunks) == 0 {
 		return fmt.Errorf("no chunks to process")
 	}
 
-	//Simulate target node failure before assembly
-	//os.Exit(1)
-
 	// Create a copy of the chunks to pass to the goroutine
 	chunksCopy := make([]ChunkInfo, len(message.ChunkTransferParams.Chunks))
 	copy(chunksCopy, message.ChunkTransferParams.Chunks)
 
-	// Single node failure - Simulate node failure before chunking (before sending chunk info)
-	// time.Sleep(10 * time.Second)
-
 	done := make(chan error, 1)
 	// Trigger assembler as a goroutine
 	go func() {
-		// Simulate a pause to allow demonstration of node disconnection
-		// fmt.Println("Waiting for 30 seconds before assembly. You can now kill the sender node.")
-
 		// Create a new message for the assembler
 		assemblerMessage := Message{
-			ID: message.ID,
-			IP: message.IP,
+			Type:       message.Type,
+			ID:         message.ID,
+			IP:         message.IP,
+			FileName:   message.FileName,
+			TransferID: message.TransferID,
 			ChunkTransferParams: ChunkTransferRequest{
-				Chunks: chunksCopy,
+				Chunks:     chunksCopy,
+				FileDigest: message.ChunkTransferParams.FileDigest,
+				Erasure:    message.ChunkTransferParams.Erasure,
 			},
 		}
 
 		var assemblerReply Message
 
-		// Multiple Node Failures - Simulate node failure after chunking/before assembly
-		// fmt.Printf("Pausing for 20 seconds before assembly. Crash other nodes now.\n")
-		// time.Sleep(20 * time.Second)
-
 		err := n.Assembler(assemblerMessage, &assemblerReply)
 		done <- err
 	}()
@@ -317,7 +536,7 @@ func (n *Node) ChunkLocationReceiver(message Message, reply *Message) error {
 		}
 
 	// If the target node is down during assembly using time.sleep()
-	case <-time.After(60 * time.Second):
+	case <-time.After(assemblyTimeout):
 
 		return fmt.Errorf("assembly timeout,target node is asleep.")
 
@@ -331,9 +550,13 @@ func (n *Node) ChunkLocationReceiver(message Message, reply *Message) error {
 }
 
 func (n *Node) AssemblerComplete(message Message, reply *Message) error {
-	green := "\033[32m"  // ANSI code for red text
-	reset := "\033[0m" // ANSI code to reset color
+	green := "\033[32m" // ANSI code for red text
+	reset := "\033[0m"  // ANSI code to reset color
+	if n.recipients.complete(message.TransferID, message.ID) {
+		fmt.Printf(green+"Node %s assembled %s. Time taken: %v\n"+reset, message.ID, message.FileName, time.Since(n.StartReq))
+		return nil
+	}
 	fmt.Printf("File Transfer has successfully completed.\n")
-	fmt.Printf(green + "Time taken: %v\n" + reset, time.Since(n.StartReq))
+	fmt.Printf(green+"Time taken: %v\n"+reset, time.Since(n.StartReq))
 	return nil
 }
@@ -0,0 +1,212 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// ChunkingStrategy decides where a file is cut into chunks
+type ChunkingStrategy interface {
+	// Split reads the whole file from r and writes it to w in order, calling w.Cut at the end of each chunk.
+	// Writes are at most blockSize bytes, so a chunk is never held in memory whole.
+	Split(r io.Reader, fileSize int64, w ChunkWriter) error
+	Name() string
+}
+
+// ChunkWriter receives the chunks a ChunkingStrategy cuts a file into
+type ChunkWriter interface {
+	// Write appends data to the current chunk. The slice is only valid until Write returns.
+	Write(data []byte) error
+	// Cut ends the current chunk. The next Write starts a new one.
+	Cut() error
+}
+
+// FixedChunking cuts a file into chunks of Size bytes, the last one possibly shorter
+type FixedChunking struct {
+	Size int
+}
+
+// LogChunking is the original strategy: ceil(log2(size in KB)) chunks of equal size, with at least one chunk
+type LogChunking struct{}
+
+// ContentDefinedChunking cuts a file where a rolling hash of the content matches a mask, so the boundaries
+// move with the content. Inserting a few bytes only changes the chunks around the insertion.
+type ContentDefinedChunking struct {
+	Min int // No boundary before this many bytes
+	Avg int // Expected chunk size, rounded to a power of two
+	Max int // Forced boundary after this many bytes
+}
+
+const (
+	defaultFixedChunkSize = 64 * 1024
+	defaultCDCMin         = 2 * 1024
+	defaultCDCAvg         = 8 * 1024
+	defaultCDCMax         = 64 * 1024
+)
+
+func (c FixedChunking) Name() string {
+	return fmt.Sprintf("fixed(%d)", c.Size)
+}
+
+func (c FixedChunking) Split(r io.Reader, fileSize int64, w ChunkWriter) error {
+	return splitFixed(r, c.Size, w)
+}
+
+func (c LogChunking) Name() string {
+	return "log"
+}
+
+func (c LogChunking) Split(r io.Reader, fileSize int64, w ChunkWriter) error {
+	// log2(fileSize in KB) rounded up. Files under 2 KB would get zero chunks, so use at least one.
+	numChunks := int(math.Ceil(math.Log2(math.Max(float64(fileSize/1000), 1))))
+	numChunks = max(numChunks, 1)
+	chunkSize := int(math.Ceil(float64(fileSize) / float64(numChunks)))
+	fmt.Printf("Chunk size: %v, number of Chunks: %v\n", chunkSize, numChunks)
+	return splitFixed(r, max(chunkSize, 1), w)
+}
+
+func (c ContentDefinedChunking) Name() string {
+	return fmt.Sprintf("cdc(%d/%d/%d)", c.Min, c.Avg, c.Max)
+}
+
+func (c ContentDefinedChunking) Split(r io.Reader, fileSize int64, w ChunkWriter) error {
+	// A boundary is found when the top log2(Avg) bits of the gear hash are all zero, which happens
+	// on average once every Avg bytes past Min. The top bits depend on the last 64 bytes read.
+	mask := ^uint64(0) << uint(64-(bits.Len(uint(c.Avg))-1))
+	reader := bufio.NewReader(r)
+	buffer := make([]byte, 0, min(c.Max, blockSize))
+	length := 0 // Bytes in the current chunk, including the buffered ones
+	var hash uint64
+
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buffer = append(buffer, b)
+		length++
+		hash = (hash << 1) + gearTable[b]
+
+		boundary := (length >= c.Min && hash&mask == 0) || length >= c.Max
+		if boundary || len(buffer) == cap(buffer) {
+			if err := w.Write(buffer); err != nil {
+				return err
+			}
+			buffer = buffer[:0]
+		}
+		if boundary {
+			if err := w.Cut(); err != nil {
+				return err
+			}
+			length = 0
+			hash = 0
+		}
+	}
+	if len(buffer) > 0 {
+		if err := w.Write(buffer); err != nil {
+			return err
+		}
+	}
+	if length > 0 {
+		return w.Cut()
+	}
+	return nil
+}
+
+// splitFixed cuts chunks of exactly size bytes except for the last one
+func splitFixed(r io.Reader, size int, w ChunkWriter) error {
+	buffer := make([]byte, min(size, blockSize))
+	for {
+		length := 0 // Bytes written to the current chunk
+		for length < size {
+			bytesRead, err := io.ReadFull(r, buffer[:min(len(buffer), size-length)])
+			if bytesRead > 0 {
+				if err := w.Write(buffer[:bytesRead]); err != nil {
+					return err
+				}
+				length += bytesRead
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if length > 0 {
+					return w.Cut()
+				}
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := w.Cut(); err != nil {
+			return err
+		}
+	}
+}
+
+// gearTable maps each byte to a pseudo-random value for the rolling hash. It is generated from a fixed
+// seed so every node cuts the same content at the same places.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x9E3779B97F4A7C15)
+	for i := range table {
+		// splitmix64
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ParseChunkingStrategy reads a strategy spec such as "log", "fixed:65536" or "cdc:2048:8192:65536"
+// (min, average and max chunk sizes in bytes). Sizes can be left out to use the defaults.
+func ParseChunkingStrategy(spec string) (ChunkingStrategy, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ":")
+	sizes := make([]int, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		size, err := strconv.Atoi(part)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid chunk size %q in chunking strategy %q", part, spec)
+		}
+		sizes = append(sizes, size)
+	}
+
+	switch parts[0] {
+	case "", "log":
+		if len(sizes) > 0 {
+			return nil, fmt.Errorf("the log chunking strategy takes no sizes")
+		}
+		return LogChunking{}, nil
+	case "fixed":
+		strategy := FixedChunking{Size: defaultFixedChunkSize}
+		if len(sizes) > 1 {
+			return nil, fmt.Errorf("the fixed chunking strategy takes one size")
+		}
+		if len(sizes) == 1 {
+			strategy.Size = sizes[0]
+		}
+		return strategy, nil
+	case "cdc":
+		strategy := ContentDefinedChunking{Min: defaultCDCMin, Avg: defaultCDCAvg, Max: defaultCDCMax}
+		if len(sizes) != 0 && len(sizes) != 3 {
+			return nil, fmt.Errorf("the cdc chunking strategy takes min, average and max sizes")
+		}
+		if len(sizes) == 3 {
+			strategy = ContentDefinedChunking{Min: sizes[0], Avg: sizes[1], Max: sizes[2]}
+		}
+		if strategy.Min > strategy.Avg || strategy.Avg > strategy.Max {
+			return nil, fmt.Errorf("cdc chunk sizes must satisfy min <= average <= max")
+		}
+		return strategy, nil
+	default:
+		return nil, fmt.Errorf("unknown chunking strategy %q (expected log, fixed or cdc)", parts[0])
+	}
+}
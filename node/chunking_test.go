@@ -0,0 +1,138 @@
+package node
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// memoryChunks collects the chunks a strategy cuts, checking that no write is larger than a block
+type memoryChunks struct {
+	t       *testing.T
+	chunks  [][]byte
+	current []byte
+}
+
+func (w *memoryChunks) Write(data []byte) error {
+	if len(data) > blockSize {
+		w.t.Errorf("write of %d bytes, more than a block", len(data))
+	}
+	w.current = append(w.current, data...)
+	return nil
+}
+
+func (w *memoryChunks) Cut() error {
+	if len(w.current) == 0 {
+		w.t.Error("cut of an empty chunk")
+	}
+	w.chunks = append(w.chunks, w.current)
+	w.current = nil
+	return nil
+}
+
+func split(t *testing.T, strategy ChunkingStrategy, data []byte) [][]byte {
+	t.Helper()
+	w := &memoryChunks{t: t}
+	if err := strategy.Split(bytes.NewReader(data), int64(len(data)), w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.current) > 0 {
+		t.Fatalf("%d bytes written after the last cut", len(w.current))
+	}
+	if joined := bytes.Join(w.chunks, nil); !bytes.Equal(joined, data) {
+		t.Fatalf("chunks don't add up to the file: %d bytes, want %d", len(joined), len(data))
+	}
+	return w.chunks
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestContentDefinedChunkSizes(t *testing.T) {
+	cdc := ContentDefinedChunking{Min: defaultCDCMin, Avg: defaultCDCAvg, Max: defaultCDCMax}
+	inputs := map[string][]byte{
+		"random": randomData(1, 2*1024*1024),
+		"zeros":  make([]byte, 300*1024), // The hash never matches, so every chunk ends at Max
+	}
+	for name, data := range inputs {
+		chunks := split(t, cdc, data)
+		for i, chunk := range chunks {
+			last := i == len(chunks)-1
+			if len(chunk) > cdc.Max || (!last && len(chunk) < cdc.Min) {
+				t.Errorf("%s: chunk %d has %d bytes, want between %d and %d", name, i, len(chunk), cdc.Min, cdc.Max)
+			}
+		}
+	}
+}
+
+func TestContentDefinedChunkingIsDeterministic(t *testing.T) {
+	cdc := ContentDefinedChunking{Min: defaultCDCMin, Avg: defaultCDCAvg, Max: defaultCDCMax}
+	data := randomData(2, 1024*1024)
+	first, second := split(t, cdc, data), split(t, cdc, data)
+	if len(first) != len(second) {
+		t.Fatalf("splitting twice gave %d and %d chunks", len(first), len(second))
+	}
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Fatalf("chunk %d differs between two splits of the same data", i)
+		}
+	}
+}
+
+func TestContentDefinedChunkingResynchronises(t *testing.T) {
+	cdc := ContentDefinedChunking{Min: defaultCDCMin, Avg: defaultCDCAvg, Max: defaultCDCMax}
+	data := randomData(3, 1024*1024)
+	insertAt := len(data) / 3
+	edited := append(append(append([]byte{}, data[:insertAt]...), []byte("a few inserted bytes")...), data[insertAt:]...)
+
+	original := map[string]bool{}
+	for _, chunk := range split(t, cdc, data) {
+		original[digestBytes(chunk)] = true
+	}
+	chunks := split(t, cdc, edited)
+	changed, offset := 0, 0
+	for _, chunk := range chunks {
+		if !original[digestBytes(chunk)] {
+			changed++
+			if offset+len(chunk) < insertAt {
+				t.Errorf("chunk at offset %d before the insertion changed", offset)
+			}
+		}
+		offset += len(chunk)
+	}
+	// Only the chunks around the insertion change, the boundaries after it are found again
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after inserting bytes at one place, want at most 2", changed, len(chunks))
+	}
+
+	// Fixed-size chunks all shift instead, which is what content-defined chunking avoids
+	fixed := FixedChunking{Size: defaultCDCAvg}
+	original = map[string]bool{}
+	for _, chunk := range split(t, fixed, data) {
+		original[digestBytes(chunk)] = true
+	}
+	shifted := 0
+	for _, chunk := range split(t, fixed, edited) {
+		if !original[digestBytes(chunk)] {
+			shifted++
+		}
+	}
+	if shifted <= changed {
+		t.Errorf("fixed-size chunking changed %d chunks, no more than content-defined chunking's %d", shifted, changed)
+	}
+}
+
+func TestFixedChunkSizes(t *testing.T) {
+	data := randomData(4, 3*blockSize+100)
+	for _, size := range []int{1000, blockSize, 2*blockSize + 7} {
+		chunks := split(t, FixedChunking{Size: size}, data)
+		for i, chunk := range chunks {
+			if i < len(chunks)-1 && len(chunk) != size {
+				t.Errorf("chunk %d of fixed(%d) has %d bytes", i, size, len(chunk))
+			}
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErasureParams describes an erasure-coded transfer. The file is split into DataShards shards of ShardSize
+// bytes (the last one zero-padded) plus ParityShards Reed-Solomon parity shards, and any DataShards of
+// them are enough to rebuild the file. A zero DataShards means the chunks are fully replicated instead.
+type ErasureParams struct {
+	DataShards   int
+	ParityShards int
+	ShardSize    int
+	FileSize     int64
+}
+
+// TransferOptions are chosen per file transfer
+type TransferOptions struct {
+	DataShards   int // Use erasure coding with this many data shards, 0 for full replication
+	ParityShards int // Number of parity shards when erasure coding
+}
+
+const maxShards = 256 // GF(2^8) has 256 elements, so a code can't have more shards than that
+
+// ParseTransferOptions reads a storage mode such as "replicate" or "ec:4:2" (4 data shards, 2 parity shards)
+func ParseTransferOptions(spec string) (TransferOptions, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ":")
+	switch parts[0] {
+	case "", "replicate":
+		return TransferOptions{}, nil
+	case "ec":
+		if len(parts) != 3 {
+			return TransferOptions{}, fmt.Errorf("erasure coding needs the number of data and parity shards, e.g. ec:4:2")
+		}
+		k, errK := strconv.Atoi(parts[1])
+		m, errM := strconv.Atoi(parts[2])
+		if errK != nil || errM != nil || k < 1 || m < 0 || k+m > maxShards {
+			return TransferOptions{}, fmt.Errorf("invalid shard counts in %q: need k >= 1, m >= 0 and k+m <= %d", spec, maxShards)
+		}
+		return TransferOptions{DataShards: k, ParityShards: m}, nil
+	default:
+		return TransferOptions{}, fmt.Errorf("unknown storage mode %q (expected replicate or ec:<k>:<m>)", parts[0])
+	}
+}
+
+// shardChunkName is the name of an erasure-coded shard with the given content digest. Shards use their own
+// extension so replica maintenance leaves them alone: their redundancy comes from the parity shards.
+func shardChunkName(digest string) string {
+	return digest + ".shard"
+}
+
+func isShard(chunkName string) bool {
+	return strings.HasSuffix(chunkName, ".shard")
+}
+
+// writeShards splits the file into data shards, computes the parity shards and writes all of them to dataDir.
+// It returns the shards in order (data shards first) and the whole-file digest. The shards are encoded one
+// stripe of blockSize bytes at a time, so memory stays at k+m blocks whatever the size of the file.
+func writeShards(file io.ReaderAt, fileSize int64, options TransferOptions, dataDir string) ([]ChunkInfo, ErasureParams, string, error) {
+	k, m := options.DataShards, options.ParityShards
+	params := ErasureParams{
+		DataShards:   k,
+		ParityShards: m,
+		ShardSize:    int((fileSize + int64(k) - 1) / int64(k)),
+		FileSize:     fileSize,
+	}
+
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, io.NewSectionReader(file, 0, fileSize)); err != nil {
+		return nil, params, "", fmt.Errorf("error reading file: %v", err)
+	}
+
+	// Shards are written under temporary names and renamed once their digest is known
+	writers := make([]*digestWriter, k+m)
+	defer func() {
+		for _, writer := range writers {
+			if writer != nil {
+				writer.abort()
+			}
+		}
+	}()
+	for i := range writers {
+		writer, err := newDigestWriter(dataDir, shardChunkName)
+		if err != nil {
+			return nil, params, "", err
+		}
+		writers[i] = writer
+	}
+
+	matrix := encodingMatrix(k, m)
+	blocks := make([][]byte, k+m)
+	for i := range blocks {
+		blocks[i] = make([]byte, min(blockSize, params.ShardSize))
+	}
+	stripe := make([][]byte, k+m)
+	for offset := 0; offset < params.ShardSize; offset += blockSize {
+		size := min(blockSize, params.ShardSize-offset)
+		for i := range stripe {
+			stripe[i] = blocks[i][:size]
+		}
+		for i := 0; i < k; i++ {
+			bytesRead, err := file.ReadAt(stripe[i], int64(i)*int64(params.ShardSize)+int64(offset))
+			if err != nil && err != io.EOF {
+				return nil, params, "", fmt.Errorf("error reading file: %v", err)
+			}
+			clear(stripe[i][bytesRead:]) // The last data shard is zero-padded
+		}
+		encodeParity(matrix, stripe, k)
+		for i, writer := range writers {
+			if err := writer.write(stripe[i]); err != nil {
+				return nil, params, "", err
+			}
+		}
+	}
+
+	chunks := make([]ChunkInfo, 0, k+m)
+	for i, writer := range writers {
+		shardName, digest, err := writer.finish()
+		writers[i] = nil
+		if err != nil {
+			return chunks, params, "", err
+		}
+		fmt.Printf("Shard %d of %d written: %s\n", i+1, k+m, shardName)
+		chunks = append(chunks, ChunkInfo{Key: chunkKey(shardName), ChunkName: shardName, Digest: digest})
+	}
+	return chunks, params, hex.EncodeToString(fileHash.Sum(nil)), nil
+}
+
+// sendShards stores each shard once, on a different node where possible. A shard goes to the owner of its
+// key, or to the first node in the owner's successor list that doesn't hold another shard of the file yet,
+// so fetchChunk still finds it by looking at the owner and its successors.
+func (n *Node) sendShards(ctx context.Context, journal *sendJournal) error {
+	shards := journal.Chunks
+	// Placement depends on the shards placed before, so holders are picked one shard at a time and the
+	// uploads then run in parallel
+	holders := make([]Pointer, len(shards))
+	used := make(map[string]bool)
+	for i, shard := range shards {
+		if journal.stored(i) {
+			continue // Sent before the transfer was interrupted
+		}
+		var reply Message
+		err := n.FindSuccessor(Message{ID: shard.Key}, &reply)
+		if err != nil {
+			return fmt.Errorf("failed to find owner of shard %s: %v", shard.ChunkName, err)
+		}
+		owner := Pointer{ID: reply.ID, IP: reply.IP}
+		holder := owner
+		if used[owner.IP] {
+			successorReply, err := n.CallRPCMethodContext(ctx, owner.IP, "Node.GetSuccessorList", Message{})
+			if err == nil {
+				for _, successor := range successorReply.SuccessorList {
+					if successor.IP != "" && !used[successor.IP] {
+						holder = successor
+						break
+					}
+				}
+			}
+			if holder == owner {
+				fmt.Printf("Not enough nodes to place shard %s on a distinct node, sharing node %s\n", shard.ChunkName, owner.ID)
+			}
+		}
+		used[holder.IP] = true
+		holders[i] = holder
+	}
+
+	return n.forEachChunk(ctx, shards, func(ctx context.Context, i int, shard ChunkInfo) error {
+		if journal.stored(i) {
+			return nil
+		}
+		holder := holders[i]
+		uploaded, err := n.storeChunkRef(ctx, holder.IP, shard, n.path(localFolder, shard.ChunkName), journal.TransferID)
+		if err != nil {
+			return fmt.Errorf("failed to send shard to node %s: %v", holder.ID, err)
+		}
+		if uploaded {
+			fmt.Printf("Shard %s sent successfully to node %s\n", shard.ChunkName, holder.ID)
+		} else {
+			fmt.Printf("Shard %s already present on node %s, added a reference\n", shard.ChunkName, holder.ID)
+		}
+		journal.markStored(i)
+		n.progress.advance(journal.TransferID, 1, int64(journal.Erasure.ShardSize))
+		return nil
+	})
+}
+
+// getShards fetches shards until DataShards of them arrived, rebuilds any missing data shard from the parity
+// shards and writes the data shards to the /assemble folder. The data shards are fetched first, in parallel,
+// and parity shards only replace the ones that failed.
+func (n *Node) getShards(ctx context.Context, journal *receiveJournal, shards []ChunkInfo, params ErasureParams) error {
+	k, m := params.DataShards, params.ParityShards
+	if len(shards) != k+m {
+		return fmt.Errorf("expected %d shards, got %d", k+m, len(shards))
+	}
+	if err := os.MkdirAll(n.path(assembleFolder), 0755); err != nil {
+		return fmt.Errorf("error creating assemble folder: %v", err)
+	}
+
+	// Shards are streamed to disk, and only read back into memory when a data shard has to be rebuilt
+	// Identical shards share a name and are fetched once
+	fetched := make([]bool, k+m)
+	index := make(map[string][]int)
+	for i, shard := range shards {
+		index[shard.ChunkName] = append(index[shard.ChunkName], i)
+	}
+	attempted := make(map[string]bool)
+	n.progress.phase(journal.TransferID, PHASE_FETCHING, k, int64(k)*int64(params.ShardSize))
+	found := 0
+	next := 0
+	for found < k && next < k+m {
+		batch := []ChunkInfo{}
+		for covered := 0; found+covered < k && next < k+m; next++ {
+			shard := shards[next]
+			if attempted[shard.ChunkName] {
+				continue
+			}
+			attempted[shard.ChunkName] = true
+			batch = append(batch, shard)
+			covered += len(index[shard.ChunkName])
+		}
+		err := n.forEachChunk(ctx, batch, func(ctx context.Context, _ int, shard ChunkInfo) error {
+			if !journal.haveChunk(shard) {
+				err := n.fetchChunk(ctx, shard, n.path(assembleFolder, shard.ChunkName))
+				if err != nil {
+					return err
+				}
+				journal.markFetched(shard.ChunkName)
+			}
+			info, err := os.Stat(n.path(assembleFolder, shard.ChunkName))
+			if err != nil || info.Size() != int64(params.ShardSize) {
+				return fmt.Errorf("shard has the wrong size")
+			}
+			for _, i := range index[shard.ChunkName] {
+				fetched[i] = true
+			}
+			n.progress.advance(journal.TransferID, len(index[shard.ChunkName]), int64(len(index[shard.ChunkName]))*info.Size())
+			return nil
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Printf("Some shards are unavailable: %v\n", err)
+		}
+		found = 0
+		for _, ok := range fetched {
+			if ok {
+				found++
+			}
+		}
+	}
+	if found < k {
+		return fmt.Errorf("only %d of the %d shards needed to rebuild the file are available", found, k)
+	}
+	if !slices.Contains(fetched[:k], false) {
+		return nil // All data shards arrived
+	}
+
+	return rebuildDataShards(n.path(assembleFolder), shards, fetched, params)
+}
+
+// rebuildDataShards writes the data shards that weren't fetched to dir, computed from k of the fetched ones.
+// The shards are read and rebuilt one stripe of blockSize bytes at a time, like writeShards encodes them.
+func rebuildDataShards(dir string, shards []ChunkInfo, fetched []bool, params ErasureParams) error {
+	k, m := params.DataShards, params.ParityShards
+	present := []int{}
+	for i, ok := range fetched {
+		if ok && len(present) < k {
+			present = append(present, i)
+		}
+	}
+	decode, err := decodingMatrix(present, k, m)
+	if err != nil {
+		return err
+	}
+
+	inputs := make([]*os.File, len(present))
+	defer func() {
+		for _, input := range inputs {
+			if input != nil {
+				input.Close()
+			}
+		}
+	}()
+	for j, i := range present {
+		input, err := os.Open(filepath.Join(dir, shards[i].ChunkName))
+		if err != nil {
+			return fmt.Errorf("error reading shard %s: %v", shards[i].ChunkName, err)
+		}
+		inputs[j] = input
+	}
+
+	missing := []int{}
+	outputs := []*os.File{}
+	defer func() {
+		for _, output := range outputs {
+			output.Close()
+		}
+	}()
+	for i := 0; i < k; i++ {
+		if fetched[i] {
+			continue
+		}
+		destinationPath := filepath.Join(dir, shards[i].ChunkName)
+		output, err := os.Create(destinationPath)
+		if err != nil {
+			return fmt.Errorf("error writing shard %s to %s: %v", shards[i].ChunkName, destinationPath, err)
+		}
+		missing = append(missing, i)
+		outputs = append(outputs, output)
+	}
+
+	stripe := make([][]byte, len(present))
+	for j := range stripe {
+		stripe[j] = make([]byte, min(blockSize, params.ShardSize))
+	}
+	block := make([]byte, min(blockSize, params.ShardSize))
+	for offset := 0; offset < params.ShardSize; offset += blockSize {
+		size := min(blockSize, params.ShardSize-offset)
+		for j, input := range inputs {
+			stripe[j] = stripe[j][:size]
+			if _, err := io.ReadFull(input, stripe[j]); err != nil {
+				return fmt.Errorf("error reading shard %s: %v", shards[present[j]].ChunkName, err)
+			}
+		}
+		for x, i := range missing {
+			combineShards(block[:size], decode[i], stripe)
+			if _, err := outputs[x].Write(block[:size]); err != nil {
+				return fmt.Errorf("error writing shard %s: %v", shards[i].ChunkName, err)
+			}
+		}
+	}
+	for x, output := range outputs {
+		err := output.Close()
+		outputs[x] = nil
+		if err != nil {
+			return fmt.Errorf("error writing shard %s: %v", shards[missing[x]].ChunkName, err)
+		}
+	}
+	outputs = nil
+	return nil
+}
+
+// Reed-Solomon over GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1. The code is systematic: the
+// encoding matrix is a Vandermonde matrix turned into [identity; parity rows], so the data shards are
+// stored as they are and any k rows of the matrix are invertible.
+
+var gfExp, gfLog = func() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// invertMatrix inverts a square matrix with Gauss-Jordan elimination
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+	size := len(matrix)
+	work := make([][]byte, size)
+	for i := range matrix {
+		work[i] = make([]byte, 2*size)
+		copy(work[i], matrix[i])
+		work[i][size+i] = 1
+	}
+
+	for col := 0; col < size; col++ {
+		pivot := -1
+		for row := col; row < size; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+		for row := 0; row < size; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	inverse := make([][]byte, size)
+	for i := range work {
+		inverse[i] = work[i][size:]
+	}
+	return inverse, nil
+}
+
+// encodingMatrix returns the (k+m) x k systematic encoding matrix
+func encodingMatrix(k, m int) [][]byte {
+	vandermonde := make([][]byte, k+m)
+	for row := range vandermonde {
+		vandermonde[row] = make([]byte, k)
+		for col := 0; col < k; col++ {
+			vandermonde[row][col] = gfPow(byte(row), col)
+		}
+	}
+	// The top k rows of a Vandermonde matrix with distinct rows are always invertible
+	topInverse, _ := invertMatrix(vandermonde[:k])
+	return multiplyMatrix(vandermonde, topInverse)
+}
+
+func multiplyMatrix(a, b [][]byte) [][]byte {
+	result := make([][]byte, len(a))
+	for i := range a {
+		result[i] = make([]byte, len(b[0]))
+		for j := range b[0] {
+			var sum byte
+			for x := range b {
+				sum ^= gfMul(a[i][x], b[x][j])
+			}
+			result[i][j] = sum
+		}
+	}
+	return result
+}
+
+// combineShards sets output to the linear combination sum(coefficients[i] * inputs[i])
+func combineShards(output []byte, coefficients []byte, inputs [][]byte) {
+	for i := range output {
+		output[i] = 0
+	}
+	for i, coefficient := range coefficients {
+		if coefficient == 0 {
+			continue
+		}
+		for j, b := range inputs[i] {
+			output[j] ^= gfMul(coefficient, b)
+		}
+	}
+}
+
+// encodeParity fills shards[k:] with the parity of the data shards shards[:k], using the encoding matrix
+func encodeParity(matrix [][]byte, shards [][]byte, k int) {
+	for i := k; i < len(shards); i++ {
+		combineShards(shards[i], matrix[i], shards[:k])
+	}
+}
+
+// decodingMatrix returns the matrix that turns the k shards at the indices present back into the k data
+// shards: data shard i is the combination of the present shards with the coefficients in row i
+func decodingMatrix(present []int, k, m int) ([][]byte, error) {
+	if len(present) < k {
+		return nil, fmt.Errorf("need %d shards to rebuild the file, have %d", k, len(present))
+	}
+	matrix := encodingMatrix(k, m)
+	rows := make([][]byte, k)
+	for j, i := range present[:k] {
+		rows[j] = matrix[i]
+	}
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to invert the decoding matrix: %v", err)
+	}
+	return decode, nil
+}
@@ -0,0 +1,154 @@
+package node
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGaloisFieldInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if product := gfMul(byte(a), gfInv(byte(a))); product != 1 {
+			t.Errorf("%d * inverse(%d) = %d, want 1", a, a, product)
+		}
+	}
+}
+
+func TestEncodingMatrixRowsAreInvertible(t *testing.T) {
+	k, m := 4, 3
+	matrix := encodingMatrix(k, m)
+	for _, present := range subsets(k+m, k) {
+		rows := make([][]byte, k)
+		for j, i := range present {
+			rows[j] = matrix[i]
+		}
+		inverse, err := invertMatrix(rows)
+		if err != nil {
+			t.Fatalf("rows %v: %v", present, err)
+		}
+		product := multiplyMatrix(inverse, rows)
+		for i := range product {
+			for j := range product[i] {
+				want := byte(0)
+				if i == j {
+					want = 1
+				}
+				if product[i][j] != want {
+					t.Fatalf("rows %v: inverse times matrix is not the identity: %v", present, product)
+				}
+			}
+		}
+	}
+}
+
+// subsets returns every subset of size of the numbers 0 to n-1, in increasing order
+func subsets(n, size int) [][]int {
+	if size == 0 {
+		return [][]int{{}}
+	}
+	all := [][]int{}
+	for first := 0; first <= n-size; first++ {
+		for _, rest := range subsets(n-first-1, size-1) {
+			subset := []int{first}
+			for _, i := range rest {
+				subset = append(subset, first+1+i)
+			}
+			all = append(all, subset)
+		}
+	}
+	return all
+}
+
+// encodeTestFile erasure-codes data into dir and returns the shards with their content
+func encodeTestFile(t *testing.T, dir string, data []byte, k, m int) ([]ChunkInfo, [][]byte, ErasureParams) {
+	t.Helper()
+	options := TransferOptions{DataShards: k, ParityShards: m}
+	shards, params, digest, err := writeShards(bytes.NewReader(data), int64(len(data)), options, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != digestBytes(data) {
+		t.Fatalf("file digest %s, want %s", digest, digestBytes(data))
+	}
+	if len(shards) != k+m {
+		t.Fatalf("%d shards written, want %d", len(shards), k+m)
+	}
+	contents := make([][]byte, len(shards))
+	for i, shard := range shards {
+		content, err := os.ReadFile(filepath.Join(dir, shard.ChunkName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) != params.ShardSize || digestBytes(content) != shard.Digest {
+			t.Fatalf("shard %d has %d bytes and digest %s, want %d bytes and %s", i, len(content), digestBytes(content), params.ShardSize, shard.Digest)
+		}
+		contents[i] = content
+	}
+	return shards, contents, params
+}
+
+func TestErasureRoundTrip(t *testing.T) {
+	k, m := 4, 2
+	sizes := map[string]int{
+		"tiny": 10,
+		// Shards of a little more than one block, so the last stripe is short and the last shard is padded
+		"partial stripe": k*(blockSize+1000) + 3,
+	}
+	for name, size := range sizes {
+		dir := t.TempDir()
+		data := randomData(int64(size), size)
+		shards, contents, params := encodeTestFile(t, dir, data, k, m)
+
+		// Every way of losing m shards: data shards, parity shards and a mix of both
+		for _, lost := range subsets(k+m, m) {
+			fetched := make([]bool, k+m)
+			for i := range fetched {
+				fetched[i] = true
+			}
+			for _, i := range lost {
+				fetched[i] = false
+				os.Remove(filepath.Join(dir, shards[i].ChunkName))
+			}
+
+			if err := rebuildDataShards(dir, shards, fetched, params); err != nil {
+				t.Fatalf("%s: rebuilding without shards %v: %v", name, lost, err)
+			}
+			rebuilt := []byte{}
+			for i := 0; i < k; i++ {
+				content, err := os.ReadFile(filepath.Join(dir, shards[i].ChunkName))
+				if err != nil {
+					t.Fatalf("%s: data shard %d missing after rebuilding without shards %v", name, i, lost)
+				}
+				rebuilt = append(rebuilt, content...)
+			}
+			if !bytes.Equal(rebuilt[:size], data) {
+				t.Fatalf("%s: file differs after rebuilding without shards %v", name, lost)
+			}
+
+			// Put the lost parity shards back for the next round, the data shards were rebuilt
+			for _, i := range lost {
+				if err := os.WriteFile(filepath.Join(dir, shards[i].ChunkName), contents[i], 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestErasureTooManyShardsLost(t *testing.T) {
+	k, m := 4, 2
+	dir := t.TempDir()
+	shards, _, params := encodeTestFile(t, dir, randomData(5, 5000), k, m)
+
+	fetched := make([]bool, k+m)
+	for i := m + 1; i < k+m; i++ {
+		fetched[i] = true
+	}
+	for i := 0; i <= m; i++ {
+		os.Remove(filepath.Join(dir, shards[i].ChunkName))
+	}
+	if err := rebuildDataShards(dir, shards, fetched, params); err == nil {
+		t.Fatalf("rebuilding after losing %d of %d shards succeeded", m+1, k+m)
+	}
+}
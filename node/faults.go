@@ -0,0 +1,182 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault points, at the places where the fault-tolerance scenarios of documentation/Meeting-3.md stop or kill a
+// node during a transfer
+const (
+	FAULT_BEFORE_CHUNKING     = "before-chunking"     // Sender, before it cuts the file into chunks
+	FAULT_CHUNK_WRITTEN       = "chunk-written"       // Sender, after each chunk is written to /local
+	FAULT_CHUNK_STORED        = "chunk-stored"        // Sender, after each chunk is stored on its owner
+	FAULT_BEFORE_CHUNK_INFO   = "before-chunk-info"   // Sender, before it hands the chunk list to the target
+	FAULT_CHUNK_INFO_RECEIVED = "chunk-info-received" // Target, when the chunk list arrives
+	FAULT_BEFORE_ASSEMBLY     = "before-assembly"     // Target, before it fetches the chunks
+	FAULT_FETCH_CHUNK         = "fetch-chunk"         // Target, before it contacts the holder of a chunk
+)
+
+var faultPoints = []string{
+	FAULT_BEFORE_CHUNKING,
+	FAULT_CHUNK_WRITTEN,
+	FAULT_CHUNK_STORED,
+	FAULT_BEFORE_CHUNK_INFO,
+	FAULT_CHUNK_INFO_RECEIVED,
+	FAULT_BEFORE_ASSEMBLY,
+	FAULT_FETCH_CHUNK,
+}
+
+// Fault actions
+const (
+	FAULT_CRASH = "crash" // The node dies on the spot
+	FAULT_SLEEP = "sleep" // The operation pauses for the fault's Duration, then carries on
+)
+
+// Fault is something that happens to a node when it reaches a fault point, such as "the sender crashes after
+// writing chunk 2" or "the target sleeps for 10 seconds before assembly"
+type Fault struct {
+	Point    string
+	Hit      int           // The fault fires the Hit-th time the point is reached, or every time when 0
+	Action   string        // FAULT_CRASH or FAULT_SLEEP
+	Duration time.Duration // How long FAULT_SLEEP pauses
+	Do       func()        // Runs instead of Action, for faults that hit other nodes
+}
+
+func (f Fault) String() string {
+	s := f.Point
+	if f.Hit > 0 {
+		s += "@" + strconv.Itoa(f.Hit)
+	}
+	switch {
+	case f.Do != nil:
+		return s + "=custom"
+	case f.Action == FAULT_SLEEP:
+		return s + "=" + FAULT_SLEEP + ":" + f.Duration.String()
+	default:
+		return s + "=" + f.Action
+	}
+}
+
+func (f Fault) validate() error {
+	known := false
+	for _, point := range faultPoints {
+		known = known || point == f.Point
+	}
+	if !known {
+		return fmt.Errorf("unknown fault point %q: expected one of %s", f.Point, strings.Join(faultPoints, ", "))
+	}
+	if f.Hit < 0 {
+		return fmt.Errorf("invalid hit %d for fault point %s", f.Hit, f.Point)
+	}
+	if f.Do == nil && f.Action != FAULT_CRASH && f.Action != FAULT_SLEEP {
+		return fmt.Errorf("invalid fault action %q: expected %s or %s", f.Action, FAULT_CRASH, FAULT_SLEEP)
+	}
+	return nil
+}
+
+// ParseFaults reads a comma-separated list of faults written as <point>[@<hit>]=crash or
+// <point>[@<hit>]=sleep:<duration>, for example "chunk-written@2=crash,before-assembly=sleep:10s"
+func ParseFaults(spec string) ([]Fault, error) {
+	faults := []Fault{}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		point, action, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q: expected <point>[@<hit>]=<action>", field)
+		}
+		fault := Fault{Point: point, Action: action}
+		if name, hit, ok := strings.Cut(point, "@"); ok {
+			n, err := strconv.Atoi(hit)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fault %q: %v", field, err)
+			}
+			fault.Point, fault.Hit = name, n
+		}
+		if name, duration, ok := strings.Cut(action, ":"); ok {
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fault %q: %v", field, err)
+			}
+			fault.Action, fault.Duration = name, d
+		}
+		if err := fault.validate(); err != nil {
+			return nil, err
+		}
+		faults = append(faults, fault)
+	}
+	return faults, nil
+}
+
+// LoadFaults reads the faults to inject from FAULTS, see ParseFaults. None are injected when it is unset.
+func LoadFaults() ([]Fault, error) {
+	return ParseFaults(os.Getenv("FAULTS"))
+}
+
+type armedFault struct {
+	Fault
+	hits int
+}
+
+// faultInjector holds the faults injected into a node
+type faultInjector struct {
+	mu     sync.Mutex
+	faults []*armedFault
+	crash  func() // Kills the node, os.Exit(1) when nil
+}
+
+// InjectFault arms a fault on this node
+func (n *Node) InjectFault(fault Fault) error {
+	if err := fault.validate(); err != nil {
+		return err
+	}
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	n.faults.faults = append(n.faults.faults, &armedFault{Fault: fault})
+	return nil
+}
+
+// ClearFaults disarms every fault injected into this node
+func (n *Node) ClearFaults() {
+	n.faults.mu.Lock()
+	defer n.faults.mu.Unlock()
+	n.faults.faults = nil
+}
+
+// faultPoint runs the faults armed for point. A crash doesn't return.
+func (n *Node) faultPoint(point string) {
+	n.faults.mu.Lock()
+	fire := []Fault{}
+	for _, fault := range n.faults.faults {
+		if fault.Point != point {
+			continue
+		}
+		fault.hits++
+		if fault.Hit == 0 || fault.hits == fault.Hit {
+			fire = append(fire, fault.Fault)
+		}
+	}
+	crash := n.faults.crash
+	n.faults.mu.Unlock()
+
+	for _, fault := range fire {
+		fmt.Printf("[NODE-%s] Fault %s\n", n.ID, fault)
+		switch {
+		case fault.Do != nil:
+			fault.Do()
+		case fault.Action == FAULT_SLEEP:
+			time.Sleep(fault.Duration)
+		case crash != nil:
+			crash()
+		default:
+			os.Exit(1)
+		}
+	}
+}
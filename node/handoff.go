@@ -0,0 +1,315 @@
+package node
+
+import (
+	"context"
+	"distributed-chord/utils"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Leave handles the RPC call asking this node to leave the ring gracefully. The node hands its chunks
+// to its successor, splices itself out of the ring and then shuts down.
+func (n *Node) Leave(message Message, reply *Message) error {
+	err := n.Depart()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Left the network. Node shutting down...")
+	go func() {
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// Depart hands every chunk in /shared to the successor, which now owns those keys, and then tells the
+// successor and predecessor to point at each other. It does not stop the process.
+func (n *Node) Depart() error {
+	routing := n.Routing()
+	successor := routing.Successor
+	predecessor := routing.Predecessor
+	successorList := routing.SuccessorList
+
+	if successor.IP == n.IP || successor == (Pointer{}) {
+		fmt.Printf("[NODE-%s] Last node in the ring, nothing to hand off\n", n.ID)
+		return nil
+	}
+
+	// Make sure the chunks go to a live node
+	_, err := n.CallRPCMethod(successor.IP, "Node.Ping", Message{})
+	if err != nil {
+		successor = n.findNextAlive()
+		if successor == (Pointer{}) {
+			return fmt.Errorf("[NODE-%s] no successor is alive to take over the keys", n.ID)
+		}
+		successorList = successorList[1:]
+	}
+
+	// Hand off the chunks
+	chunks, err := n.listSharedChunks()
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		err := n.pushChunk(successor.IP, chunk.ChunkName)
+		if err != nil {
+			return fmt.Errorf("failed to hand off chunk %s to node %s: %v", chunk.ChunkName, successor.ID, err)
+		}
+	}
+	fmt.Printf("[NODE-%s] Handed off %d chunks to node %s\n", n.ID, len(chunks), successor.ID)
+
+	// Splice the node out of the ring
+	_, err = n.CallRPCMethod(successor.IP, "Node.PredecessorLeaving", Message{
+		ID:        n.ID,
+		IP:        n.IP,
+		Neighbour: predecessor,
+	})
+	if err != nil {
+		fmt.Printf("[NODE-%s] Failed to tell successor about departure: %v\n", n.ID, err)
+	}
+
+	if predecessor != (Pointer{}) && predecessor.IP != n.IP {
+		_, err = n.CallRPCMethod(predecessor.IP, "Node.SuccessorLeaving", Message{
+			ID:            n.ID,
+			IP:            n.IP,
+			Neighbour:     successor,
+			SuccessorList: successorList,
+		})
+		if err != nil {
+			fmt.Printf("[NODE-%s] Failed to tell predecessor about departure: %v\n", n.ID, err)
+		}
+	}
+	return nil
+}
+
+// PredecessorLeaving is called by a departing predecessor. The node takes over the departing node's predecessor.
+func (n *Node) PredecessorLeaving(message Message, reply *Message) error {
+	n.updateRouting(func(s *RoutingState) {
+		if s.Predecessor.IP == message.IP {
+			s.Predecessor = message.Neighbour
+		}
+	})
+	return nil
+}
+
+// SuccessorLeaving is called by a departing successor. The node takes over the departing node's successor and successor list.
+func (n *Node) SuccessorLeaving(message Message, reply *Message) error {
+	successorList := []Pointer{}
+	for _, successor := range message.SuccessorList {
+		if successor.IP != message.IP && len(successorList) < r {
+			successorList = append(successorList, successor)
+		}
+	}
+	n.updateRouting(func(s *RoutingState) {
+		if s.Successor.IP == message.IP {
+			s.Successor = message.Neighbour
+			s.SuccessorList = successorList
+		}
+	})
+	return nil
+}
+
+// chunkKey is the placement key of a chunk. A chunk is stored on FindSuccessor(chunkKey(name)) and that node's successor list.
+// A file manifest is placed by the name of the file it describes, so it can be found from the file name alone.
+func chunkKey(chunkName string) utils.ID {
+	if isManifest(chunkName) {
+		return utils.Hash(manifestFileName(chunkName))
+	}
+	return utils.Hash(chunkName)
+}
+
+// listSharedChunks returns every chunk stored in this node's /shared folder
+func (n *Node) listSharedChunks() ([]ChunkInfo, error) {
+	entries, err := os.ReadDir(n.path(dataFolder))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list %s: %v", dataFolder, err)
+	}
+	chunks := []ChunkInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue // Skip bookkeeping such as the reference counts
+		}
+		chunks = append(chunks, ChunkInfo{Key: chunkKey(entry.Name()), ChunkName: entry.Name()})
+	}
+	return chunks, nil
+}
+
+// chunksInRange filters chunks down to the ones whose key falls in keyRange
+func chunksInRange(chunks []ChunkInfo, keyRange KeyRange) []ChunkInfo {
+	inRange := []ChunkInfo{}
+	for _, chunk := range chunks {
+		if utils.Between(chunk.Key, keyRange.Start, keyRange.End, true) {
+			inRange = append(inRange, chunk)
+		}
+	}
+	return inRange
+}
+
+// GetChunksInRange returns the chunks this node stores whose keys fall in message.Range, with their digests
+func (n *Node) GetChunksInRange(message Message, reply *Message) error {
+	chunks, err := n.listSharedChunks()
+	if err != nil {
+		return err
+	}
+	inRange := []ChunkInfo{}
+	for _, chunk := range chunksInRange(chunks, message.Range) {
+		digest, err := n.chunkDigest(chunk.ChunkName)
+		if err != nil {
+			continue // Removed while we were listing
+		}
+		chunk.Digest = digest
+		inRange = append(inRange, chunk)
+	}
+	*reply = Message{ChunkTransferParams: ChunkTransferRequest{Chunks: inRange}}
+	return nil
+}
+
+// startMigration runs migrateKeys in the background, so joining and stabilizing don't wait for the chunks
+func (n *Node) startMigration(successor Pointer, previous Pointer) {
+	n.migrations.Add(1)
+	go func() {
+		defer n.migrations.Done()
+		n.migrateKeys(successor, previous)
+	}()
+}
+
+// migrateKeys runs once the successor has accepted this node as its predecessor. It pulls the keys in
+// (previous, self] that this node now owns, then asks the old holders to drop copies outside their replica set.
+func (n *Node) migrateKeys(successor Pointer, previous Pointer) {
+	keyRange := KeyRange{Start: previous.ID, End: n.ID}
+	if previous == (Pointer{}) {
+		// The successor had no predecessor, so it owned everything up to itself
+		keyRange.Start = successor.ID
+	}
+
+	reply, err := n.CallRPCMethod(successor.IP, "Node.GetChunksInRange", Message{Range: keyRange})
+	if err != nil {
+		fmt.Printf("[NODE-%s] Failed to list keys to migrate from node %s: %v\n", n.ID, successor.ID, err)
+		return
+	}
+
+	pulled := 0
+	for _, chunk := range reply.ChunkTransferParams.Chunks {
+		if _, err := os.Stat(n.path(dataFolder, chunk.ChunkName)); err == nil {
+			continue // Already holding a replica
+		}
+		refCount, err := n.downloadChunk(n.bulkContext(context.Background()), successor.IP, chunk.ChunkName, chunk.Digest, n.path(dataFolder, chunk.ChunkName))
+		if err != nil {
+			fmt.Printf("[NODE-%s] Failed to pull chunk %s from node %s: %v\n", n.ID, chunk.ChunkName, successor.ID, err)
+			return
+		}
+		n.forgetDigest(chunk.ChunkName)
+		n.refs.set(chunk.ChunkName, max(refCount, 1))
+		pulled++
+	}
+	if pulled > 0 {
+		fmt.Printf("[NODE-%s] Pulled %d chunks in (%s, %s] from node %s\n", n.ID, pulled, keyRange.Start, keyRange.End, successor.ID)
+	}
+
+	// The old holders decide what to drop by looking at our successor list, so it has to be filled in first
+	n.updateSuccessorList()
+
+	successorReply, err := n.CallRPCMethod(successor.IP, "Node.GetSuccessorList", Message{})
+	if err != nil {
+		fmt.Printf("[NODE-%s] Failed to get successor list from node %s: %v\n", n.ID, successor.ID, err)
+		return
+	}
+	// Every key in the range is ours now, so they share one replica set: this node and its successor list
+	replicaSet := append([]Pointer{{ID: n.ID, IP: n.IP}}, n.Routing().SuccessorList...)
+	replicated, err := n.replicatedChunks(replicaSet, keyRange)
+	if err != nil {
+		fmt.Printf("[NODE-%s] Not pruning, failed to check the replica set: %v\n", n.ID, err)
+		return
+	}
+	holders := append([]Pointer{successor}, successorReply.SuccessorList...)
+	for _, holder := range holders {
+		if holder.IP == n.IP {
+			continue
+		}
+		_, err := n.CallRPCMethod(holder.IP, "Node.PruneChunks", Message{
+			Range:               keyRange,
+			SuccessorList:       replicaSet,
+			ChunkTransferParams: ChunkTransferRequest{Chunks: replicated},
+		})
+		if err != nil {
+			fmt.Printf("[NODE-%s] Failed to ask node %s to prune chunks: %v\n", n.ID, holder.ID, err)
+		}
+	}
+}
+
+// replicatedChunks returns the chunks in keyRange that every node of replicaSet stores. The first node of the
+// set is this one.
+func (n *Node) replicatedChunks(replicaSet []Pointer, keyRange KeyRange) ([]ChunkInfo, error) {
+	chunks, err := n.listSharedChunks()
+	if err != nil {
+		return nil, err
+	}
+	replicated := chunksInRange(chunks, keyRange)
+	for _, holder := range replicaSet[1:] {
+		if holder.IP == n.IP {
+			continue
+		}
+		reply, err := n.CallRPCMethod(holder.IP, "Node.GetChunksInRange", Message{Range: keyRange})
+		if err != nil {
+			return nil, err
+		}
+		held := make(map[string]bool)
+		for _, chunk := range reply.ChunkTransferParams.Chunks {
+			held[chunk.ChunkName] = true
+		}
+		kept := []ChunkInfo{}
+		for _, chunk := range replicated {
+			if held[chunk.ChunkName] {
+				kept = append(kept, chunk)
+			}
+		}
+		replicated = kept
+	}
+	return replicated, nil
+}
+
+// PruneChunks drops the chunks in message.Range that this node no longer has to store. The caller owns the
+// range and sends its replica set (itself and its successor list) in message.SuccessorList, along with the
+// chunks every node of that set already stores, so the check is local and takes no lookups. A node in the
+// replica set keeps everything, with an incomplete replica set nothing is dropped, and a chunk the replica set
+// doesn't fully hold yet is kept until a later join, so data is never dropped on a guess.
+func (n *Node) PruneChunks(message Message, reply *Message) error {
+	if len(message.SuccessorList) < r+1 {
+		return nil
+	}
+	for _, holder := range message.SuccessorList {
+		if holder.IP == n.IP {
+			return nil
+		}
+	}
+	replicated := make(map[string]bool)
+	for _, chunk := range message.ChunkTransferParams.Chunks {
+		replicated[chunk.ChunkName] = true
+	}
+	chunks, err := n.listSharedChunks()
+	if err != nil {
+		return err
+	}
+
+	dropped := 0
+	for _, chunk := range chunksInRange(chunks, message.Range) {
+		if !replicated[chunk.ChunkName] {
+			continue
+		}
+		err := os.Remove(n.path(dataFolder, chunk.ChunkName))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[NODE-%s] Failed to drop chunk %s: %v\n", n.ID, chunk.ChunkName, err)
+			continue
+		}
+		n.forgetDigest(chunk.ChunkName)
+		n.refs.set(chunk.ChunkName, 0)
+		dropped++
+	}
+	if dropped > 0 {
+		fmt.Printf("[NODE-%s] Dropped %d chunks that moved out of its replica set\n", n.ID, dropped)
+	}
+	return nil
+}
@@ -0,0 +1,431 @@
+package node
+
+import (
+	"distributed-chord/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalFolder keeps one journal per unfinished transfer, on the sender and on the receiver, so a restarted
+// node can resume the transfer instead of starting over
+const journalFolder = "/journal"
+
+const (
+	sendJournalExt    = ".send.json"
+	receiveJournalExt = ".receive.json"
+)
+
+// sendJournal records how far an outgoing transfer got. Chunks is empty until the file has been cut,
+// Stored[i] is set once Chunks[i] has a reference on its owner, and Replicated[i] once every holder of
+// Chunks[i] was tried. Replicas[i] records each holder before and after its upload.
+type sendJournal struct {
+	mu         sync.Mutex
+	root       string // Root of the node's folders, see CreateNodeAt. Not persisted.
+	TransferID string
+	FileName   string
+	TargetID   utils.ID
+	TargetIP   string
+	Options    TransferOptions
+	Publish    bool      // The chunks are published under the file name instead of sent to a target
+	Targets    []Pointer // Targets of a multi-recipient transfer, used instead of TargetID and TargetIP
+	Completed  []bool    // Completed[i] is set once Targets[i] assembled the file
+	Chunks     []ChunkInfo
+	Stored     []bool
+	Replicated []bool
+	Replicas   [][]replicaRecord
+	FileSize   int64
+	FileDigest string
+	Erasure    ErasureParams
+}
+
+// replicaRecord is one holder a chunk was sent to. Done is set once the holder stored the reference.
+type replicaRecord struct {
+	IP   string
+	Done bool
+}
+
+// receiveJournal records the chunk list of an incoming transfer and which chunks are already in /assemble
+type receiveJournal struct {
+	mu         sync.Mutex
+	root       string // Root of the node's folders, see CreateNodeAt. Not persisted.
+	Type       string // FILE_FETCH for a published file fetched by name
+	TransferID string
+	FileName   string
+	SenderID   utils.ID
+	SenderIP   string
+	Chunks     []ChunkInfo
+	FileSize   int64
+	FileDigest string
+	Erasure    ErasureParams
+	Fetched    map[string]bool
+}
+
+func newTransferID() string {
+	return newUploadID()
+}
+
+func journalPath(root string, transferID string, ext string) string {
+	return filepath.Join(root, journalFolder, transferID+ext)
+}
+
+// writeJournal persists a journal atomically, so a crash never leaves half a journal behind
+func writeJournal(path string, journal any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal %s: %v", path, err)
+	}
+	return os.Rename(tempPath, path)
+}
+
+func readJournal(path string, journal any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return fmt.Errorf("unreadable journal %s: %v", path, err)
+	}
+	return nil
+}
+
+// listJournals returns the transfer IDs that have a journal with the given extension
+func listJournals(root string, ext string) []string {
+	entries, err := os.ReadDir(filepath.Join(root, journalFolder))
+	if err != nil {
+		return nil
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ext) {
+			ids = append(ids, strings.TrimSuffix(entry.Name(), ext))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// save persists the journal. The caller holds mu.
+func (j *sendJournal) save() {
+	if err := writeJournal(journalPath(j.root, j.TransferID, sendJournalExt), j); err != nil {
+		fmt.Printf("Failed to save journal of transfer %s: %v\n", j.TransferID, err)
+	}
+}
+
+// setChunks records the chunks the file was cut into
+func (j *sendJournal) setChunks(chunks []ChunkInfo, fileSize int64, fileDigest string, erasure ErasureParams) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Chunks = chunks
+	j.Stored = make([]bool, len(chunks))
+	j.Replicated = make([]bool, len(chunks))
+	j.Replicas = make([][]replicaRecord, len(chunks))
+	j.FileSize = fileSize
+	j.FileDigest = fileDigest
+	j.Erasure = erasure
+	j.save()
+}
+
+func (j *sendJournal) stored(i int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return i < len(j.Stored) && j.Stored[i]
+}
+
+func (j *sendJournal) markStored(i int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Stored[i] = true
+	j.save()
+}
+
+// replicated reports whether Chunks[i] reached every holder it was sent to. Journals written before holders
+// were journaled only know about the owner.
+func (j *sendJournal) replicated(i int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Replicated == nil {
+		return i < len(j.Stored) && j.Stored[i]
+	}
+	if i >= len(j.Replicated) || !j.Replicated[i] {
+		return false
+	}
+	for _, replica := range j.Replicas[i] {
+		if !replica.Done {
+			return false // A holder failed, so a resume tries it again
+		}
+	}
+	return true
+}
+
+func (j *sendJournal) markReplicated(i int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Replicated == nil {
+		return
+	}
+	j.Replicated[i] = true
+	j.save()
+}
+
+// replica returns the record of the holder at ip for Chunks[i]. The caller holds mu.
+func (j *sendJournal) replica(i int, ip string) *replicaRecord {
+	if i >= len(j.Replicas) {
+		return nil
+	}
+	for k := range j.Replicas[i] {
+		if j.Replicas[i][k].IP == ip {
+			return &j.Replicas[i][k]
+		}
+	}
+	return nil
+}
+
+// replicaDone reports whether the holder at ip stored its reference to Chunks[i]
+func (j *sendJournal) replicaDone(i int, ip string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	replica := j.replica(i, ip)
+	return replica != nil && replica.Done
+}
+
+// startReplica records that Chunks[i] is about to be sent to the holder at ip
+func (j *sendJournal) startReplica(i int, ip string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if i >= len(j.Replicas) || j.replica(i, ip) != nil {
+		return
+	}
+	j.Replicas[i] = append(j.Replicas[i], replicaRecord{IP: ip})
+	j.save()
+}
+
+// finishReplica records that the holder at ip stored its reference to Chunks[i]
+func (j *sendJournal) finishReplica(i int, ip string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if replica := j.replica(i, ip); replica != nil {
+		replica.Done = true
+		j.save()
+	}
+}
+
+// targetCompleted reports whether Targets[i] already assembled the file, in which case a resume skips it
+func (j *sendJournal) targetCompleted(i int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return i < len(j.Completed) && j.Completed[i]
+}
+
+func (j *sendJournal) markTargetCompleted(i int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Completed) != len(j.Targets) {
+		j.Completed = make([]bool, len(j.Targets))
+	}
+	j.Completed[i] = true
+	j.save()
+}
+
+// peers returns the IPs of the targets of the transfer
+func (j *sendJournal) peers() []string {
+	if len(j.Targets) == 0 {
+		if j.TargetIP == "" {
+			return nil // A publish has no target
+		}
+		return []string{j.TargetIP}
+	}
+	peers := []string{}
+	for _, target := range j.Targets {
+		peers = append(peers, target.IP)
+	}
+	return peers
+}
+
+// remove deletes the journal once the transfer no longer needs it
+func (j *sendJournal) remove() {
+	os.Remove(journalPath(j.root, j.TransferID, sendJournalExt))
+}
+
+func (n *Node) loadSendJournal(transferID string) (*sendJournal, error) {
+	journal := &sendJournal{root: n.root}
+	if err := readJournal(journalPath(n.root, transferID, sendJournalExt), journal); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (j *receiveJournal) save() {
+	if err := writeJournal(journalPath(j.root, j.TransferID, receiveJournalExt), j); err != nil {
+		fmt.Printf("Failed to save journal of transfer %s: %v\n", j.TransferID, err)
+	}
+}
+
+// haveChunk reports whether chunk was fetched by an earlier run and is still intact in /assemble
+func (j *receiveJournal) haveChunk(chunk ChunkInfo) bool {
+	j.mu.Lock()
+	fetched := j.Fetched[chunk.ChunkName]
+	j.mu.Unlock()
+	if !fetched {
+		return false
+	}
+	digest, err := hashFile(filepath.Join(j.root, assembleFolder, chunk.ChunkName))
+	return err == nil && digest == chunk.Digest
+}
+
+func (j *receiveJournal) markFetched(chunkName string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Fetched == nil {
+		j.Fetched = make(map[string]bool)
+	}
+	j.Fetched[chunkName] = true
+	j.save()
+}
+
+func (j *receiveJournal) remove() {
+	os.Remove(journalPath(j.root, j.TransferID, receiveJournalExt))
+}
+
+// openReceiveJournal returns the journal of the transfer described by message, picking up the chunks an
+// earlier run already fetched when the journal exists
+func (n *Node) openReceiveJournal(message Message) *receiveJournal {
+	journal := &receiveJournal{root: n.root}
+	if message.TransferID != "" {
+		err := readJournal(journalPath(n.root, message.TransferID, receiveJournalExt), journal)
+		if err == nil && journal.FileDigest == message.ChunkTransferParams.FileDigest {
+			return journal
+		}
+	}
+
+	journal = &receiveJournal{
+		root:       n.root,
+		Type:       message.Type,
+		TransferID: message.TransferID,
+		FileName:   message.FileName,
+		SenderID:   message.ID,
+		SenderIP:   message.IP,
+		Chunks:     message.ChunkTransferParams.Chunks,
+		FileSize:   message.FileSize,
+		FileDigest: message.ChunkTransferParams.FileDigest,
+		Erasure:    message.ChunkTransferParams.Erasure,
+	}
+	if journal.TransferID == "" {
+		journal.TransferID = newTransferID()
+	}
+	journal.save()
+	return journal
+}
+
+// message rebuilds the assembler message of the journaled transfer
+func (j *receiveJournal) message() Message {
+	return Message{
+		Type:       j.Type,
+		ID:         j.SenderID,
+		IP:         j.SenderIP,
+		FileName:   j.FileName,
+		FileSize:   j.FileSize,
+		TransferID: j.TransferID,
+		ChunkTransferParams: ChunkTransferRequest{
+			Chunks:     j.Chunks,
+			FileDigest: j.FileDigest,
+			Erasure:    j.Erasure,
+		},
+	}
+}
+
+// PendingSends returns the IDs of the outgoing transfers that were interrupted
+func (n *Node) PendingSends() []string {
+	return listJournals(n.root, sendJournalExt)
+}
+
+// ResumeReceives finishes the incoming transfers that were interrupted by a restart. The chunks stay in the
+// ring until the receiver has assembled the file, so only the chunks missing from /assemble are fetched.
+func (n *Node) ResumeReceives() {
+	pending := listJournals(n.root, receiveJournalExt)
+	if len(pending) > 0 {
+		time.Sleep(2 * timeInterval * time.Second) // Let stabilization find the chunk holders first
+	}
+	for _, transferID := range pending {
+		journal := &receiveJournal{root: n.root}
+		if err := readJournal(journalPath(n.root, transferID, receiveJournalExt), journal); err != nil {
+			fmt.Printf("Skipping transfer %s: %v\n", transferID, err)
+			continue
+		}
+		fmt.Printf("Resuming incoming transfer %s of %s\n", transferID, journal.FileName)
+		ctx, err := n.beginTransfer(transferID, journal.SenderIP)
+		if err == nil {
+			err = n.assemble(ctx, journal.message())
+			n.transfers.end(transferID)
+		}
+		if err != nil {
+			fmt.Printf("Failed to resume transfer %s: %v\n", transferID, err)
+		}
+	}
+}
+
+// ResumeSend continues an interrupted outgoing transfer. The target already accepted it, so it is not asked
+// again, and only the chunks the journal doesn't list as stored are sent.
+func (n *Node) ResumeSend(transferID string) error {
+	journal, err := n.loadSendJournal(transferID)
+	if err != nil {
+		return fmt.Errorf("no interrupted transfer %s: %v", transferID, err)
+	}
+	if len(journal.Targets) > 0 {
+		fmt.Printf("Resuming transfer %s of %s to %d nodes\n", transferID, journal.FileName, len(journal.Targets))
+	} else {
+		fmt.Printf("Resuming transfer %s of %s to node %s\n", transferID, journal.FileName, journal.TargetID)
+	}
+	n.StartReq = time.Now()
+	ctx, err := n.beginTransfer(transferID, journal.peers()...)
+	if err != nil {
+		return err
+	}
+	chunks := n.Chunker(ctx, journal)
+	n.transfers.end(transferID)
+	if len(journal.Targets) > 0 {
+		printRecipientReport(n.recipients.finish(transferID))
+	}
+	if len(chunks) == 0 {
+		return fmt.Errorf("transfer %s did not complete", transferID)
+	}
+	return nil
+}
+
+// DiscardSend gives up an interrupted outgoing transfer and removes its chunks from /local and the ring
+func (n *Node) DiscardSend(transferID string) error {
+	journal, err := n.loadSendJournal(transferID)
+	if err != nil {
+		return fmt.Errorf("no interrupted transfer %s: %v", transferID, err)
+	}
+	n.discardSend(journal)
+	return nil
+}
+
+func (n *Node) discardSend(journal *sendJournal) {
+	stored := []ChunkInfo{}
+	for i, chunk := range journal.Chunks {
+		if journal.stored(i) {
+			stored = append(stored, chunk)
+		}
+	}
+	if len(journal.Chunks) > 0 {
+		n.removeChunksRemotely(localFolder, journal.Chunks)
+	}
+	if len(stored) > 0 {
+		n.releaseChunks(journal.TransferID, stored)
+	}
+	journal.remove()
+}
@@ -0,0 +1,189 @@
+package node
+
+import (
+	"distributed-chord/utils"
+	"fmt"
+	"os"
+)
+
+// Lookup modes
+const (
+	LOOKUP_RECURSIVE = "recursive" // Each node forwards the lookup to its closest preceding finger
+	LOOKUP_ITERATIVE = "iterative" // The node doing the lookup asks every hop for the next one itself
+)
+
+// Steps of an iterative lookup, answered by NextHop
+const (
+	LOOKUP_DONE = "LOOKUP_DONE" // The owner of the key was found
+	LOOKUP_NEXT = "LOOKUP_NEXT" // The lookup goes on at one of the candidates, best first
+)
+
+// A recursive lookup tries this many fingers at each node before it reports the lookup failed. Every node on
+// the path falls back on its own, so trying all of them could multiply the calls along a path full of dead
+// fingers.
+const maxLookupFallbacks = r
+
+// LoadLookupMode reads how lookups are routed from LOOKUP_MODE, LOOKUP_RECURSIVE when it is unset
+func LoadLookupMode() (string, error) {
+	switch mode := os.Getenv("LOOKUP_MODE"); mode {
+	case "", LOOKUP_RECURSIVE:
+		return LOOKUP_RECURSIVE, nil
+	case LOOKUP_ITERATIVE:
+		return LOOKUP_ITERATIVE, nil
+	default:
+		return "", fmt.Errorf("invalid LOOKUP_MODE %q: expected %s or %s", mode, LOOKUP_RECURSIVE, LOOKUP_ITERATIVE)
+	}
+}
+
+// liveSuccessor returns successor if it answers, otherwise the next live node in the successor list, or this
+// node when none of them is alive
+func (n *Node) liveSuccessor(successor Pointer) Pointer {
+	if _, err := n.CallRPCMethod(successor.IP, "Node.Ping", Message{}); err == nil {
+		return successor
+	}
+	// fmt.Printf("[NODE-%s] Successor Node-%s appears to be down.\n", n.ID, successor.ID)
+	nextSuccessor := n.findNextAlive()
+	if nextSuccessor == (Pointer{}) { // null pointer => no successor of node n is alive(very unlikely)
+		fmt.Printf("[NODE-%s] No Successor from the successor list is alive.", n.ID)
+		return Pointer{ID: n.ID, IP: n.IP}
+	}
+	return nextSuccessor
+}
+
+// successorOwner returns the owner of id when id falls in the part of the ring this node's successor list
+// covers: the first live node of the list at or after id. This answers lookups for keys just past a failed
+// node, whose live successor is in the list while no finger precedes the key anymore.
+func (n *Node) successorOwner(id utils.ID) (Pointer, bool) {
+	routing := n.Routing()
+	if utils.Between(id, n.ID, routing.Successor.ID, true) {
+		return n.liveSuccessor(routing.Successor), true
+	}
+	previous := routing.Successor.ID
+	for i, successor := range routing.SuccessorList {
+		if successor.IP == n.IP {
+			break // The list wrapped around a small ring
+		}
+		if successor.IP == "" || successor.ID == previous {
+			continue // The list starts with the successor, and repeats nodes in small rings
+		}
+		if !utils.Between(id, previous, successor.ID, true) {
+			previous = successor.ID
+			continue
+		}
+		for _, candidate := range routing.SuccessorList[i:] {
+			if _, err := n.CallRPCMethod(candidate.IP, "Node.Ping", Message{}); err == nil {
+				return candidate, true
+			}
+		}
+		return Pointer{}, false
+	}
+	return Pointer{}, false
+}
+
+// closestPrecedingNodes returns the fingers and successors that precede id, closest to id first. The first
+// one is the hop Chord takes, the others are the fallbacks when it doesn't answer.
+func (n *Node) closestPrecedingNodes(id utils.ID) []Pointer {
+	routing := n.Routing()
+	candidates := []Pointer{}
+	seen := make(map[string]bool)
+	add := func(node Pointer) {
+		if node.IP == "" || seen[node.IP] || !utils.Between(node.ID, n.ID, id, false) {
+			return
+		}
+		seen[node.IP] = true
+		candidates = append(candidates, node)
+	}
+	for i := len(routing.FingerTable) - 1; i >= 0; i-- {
+		add(routing.FingerTable[i])
+	}
+	for i := len(routing.SuccessorList) - 1; i >= 0; i-- {
+		add(routing.SuccessorList[i])
+	}
+	return candidates
+}
+
+// findSuccessorRecursive answers the lookup if this node's successor or successor list owns the key, and otherwise forwards it
+// to the closest preceding finger, or to the next-best one when that fails
+func (n *Node) findSuccessorRecursive(message Message, reply *Message) error {
+	self := Pointer{ID: n.ID, IP: n.IP}
+	if owner, ok := n.successorOwner(message.ID); ok { // message.ID is between n.ID and a live successor (inclusive)
+		*reply = Message{ID: owner.ID, IP: owner.IP, Path: []Pointer{self}}
+		return nil
+	}
+
+	candidates := n.closestPrecedingNodes(message.ID)
+	if len(candidates) == 0 {
+		// fmt.Printf("[NODE-%s] Successor is self: %v\n", n.ID, reply.ID)
+		*reply = Message{ID: n.ID, IP: n.IP, Path: []Pointer{self}}
+		return nil
+	}
+	var err error
+	for _, closest := range candidates[:min(len(candidates), maxLookupFallbacks)] {
+		var newReply *Message
+		newReply, err = n.CallRPCMethod(closest.IP, "Node.FindSuccessor", message)
+		if err != nil {
+			fmt.Printf("[NODE-%s] Lookup of %s through node %s failed, trying the next-best finger: %v\n", n.ID, message.ID, closest.ID, err)
+			continue
+		}
+		*reply = *newReply
+		reply.Path = append([]Pointer{self}, newReply.Path...)
+		reply.Hops = len(reply.Path) - 1
+		return nil
+	}
+	return fmt.Errorf("[NODE-%s] lookup of %s failed, no finger could forward it: %w", n.ID, message.ID, err)
+}
+
+// findSuccessorIterative runs the lookup from this node, asking each hop for the next one with NextHop. A hop
+// that doesn't answer is skipped for the next-best candidate of the previous hop.
+func (n *Node) findSuccessorIterative(message Message, reply *Message) error {
+	path := []Pointer{{ID: n.ID, IP: n.IP}}
+	visited := map[string]bool{n.IP: true}
+	var step Message
+	n.NextHop(Message{ID: message.ID}, &step)
+
+	for step.Type != LOOKUP_DONE {
+		// Every hop at least halves the distance to the key on a settled ring, so a lookup taking many more
+		// hops than the ring has bits is going in circles
+		if len(path) > 2*utils.M {
+			return fmt.Errorf("[NODE-%s] lookup of %s gave up after %d hops", n.ID, message.ID, len(path)-1)
+		}
+		advanced := false
+		for _, next := range step.Candidates {
+			if visited[next.IP] {
+				continue
+			}
+			visited[next.IP] = true
+			nextStep, err := n.CallRPCMethod(next.IP, "Node.NextHop", Message{ID: message.ID})
+			if err != nil {
+				fmt.Printf("[NODE-%s] Lookup of %s through node %s failed, trying the next-best finger: %v\n", n.ID, message.ID, next.ID, err)
+				continue
+			}
+			path = append(path, next)
+			step = *nextStep
+			advanced = true
+			break
+		}
+		if !advanced {
+			return fmt.Errorf("[NODE-%s] lookup of %s is stuck at node %s, none of its fingers answered", n.ID, message.ID, path[len(path)-1].ID)
+		}
+	}
+
+	*reply = Message{ID: step.ID, IP: step.IP, Path: path, Hops: len(path) - 1}
+	return nil
+}
+
+// NextHop answers one step of an iterative lookup of message.ID: LOOKUP_DONE with the owner when the key
+// falls between this node and a live node of its successor list, otherwise LOOKUP_NEXT with the nodes to ask next, best first
+func (n *Node) NextHop(message Message, reply *Message) error {
+	if owner, ok := n.successorOwner(message.ID); ok {
+		*reply = Message{Type: LOOKUP_DONE, ID: owner.ID, IP: owner.IP}
+		return nil
+	}
+	candidates := n.closestPrecedingNodes(message.ID)
+	if len(candidates) == 0 {
+		*reply = Message{Type: LOOKUP_DONE, ID: n.ID, IP: n.IP}
+		return nil
+	}
+	*reply = Message{Type: LOOKUP_NEXT, Candidates: candidates}
+	return nil
+}
@@ -0,0 +1,347 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"distributed-chord/utils"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const merkleDepth = 6 // The Merkle tree over a key range has 2^merkleDepth leaves
+
+// merkleTree summarises the chunks a node stores in a key range. The range is split into equal ring
+// sub-ranges, one per leaf, and every node hashes its children so two replica holders can find the
+// sub-ranges where they disagree by comparing a handful of hashes.
+type merkleTree struct {
+	keyRange KeyRange
+	hashes   [][]byte      // Heap layout: index 1 is the root and the children of i are 2i and 2i+1
+	leaves   [][]ChunkInfo // Chunks in each leaf, sorted by name
+	digests  map[string]string
+}
+
+// digestCache remembers chunk digests so the tree doesn't re-read every chunk on each sync
+type digestCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedDigest
+}
+
+type cachedDigest struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+// merkleCache keeps the trees GetMerkleHashes built, since a peer walking down a tree asks for it once per
+// level and every replica holder syncs the same range. A change to /shared drops every tree, and a tree built
+// before the last change of the reference counts is not used.
+type merkleCache struct {
+	mu         sync.Mutex
+	generation uint64 // Bumped on every change to /shared
+	trees      map[KeyRange]cachedMerkleTree
+}
+
+type cachedMerkleTree struct {
+	refs uint64 // Generation of the reference counts the tree was built from
+	tree *merkleTree
+}
+
+// invalidate drops the cached trees after a chunk in /shared was written or removed
+func (c *merkleCache) invalidate() {
+	c.mu.Lock()
+	c.generation++
+	c.trees = nil
+	c.mu.Unlock()
+}
+
+func merkleLeaves() int {
+	return 1 << merkleDepth
+}
+
+// rangeSpan is the number of IDs in keyRange. (x, x] is the full ring, like in utils.Between.
+func rangeSpan(keyRange KeyRange) *big.Int {
+	span := keyRange.Start.Distance(keyRange.End)
+	if span.Sign() == 0 {
+		return utils.RingSize()
+	}
+	return span
+}
+
+// leafOffset returns the distance from the start of keyRange at which leaf begins
+func leafOffset(keyRange KeyRange, leaf int) *big.Int {
+	// ceil(leaf * span / leaves), so that leafIndex and leafRange agree on every key
+	leaves := big.NewInt(int64(merkleLeaves()))
+	offset := new(big.Int).Mul(rangeSpan(keyRange), big.NewInt(int64(leaf)))
+	offset.Add(offset, leaves)
+	offset.Sub(offset, big.NewInt(1))
+	return offset.Quo(offset, leaves)
+}
+
+// leafRange returns the sub-range of keyRange covered by a leaf. Leaves can be empty when the range
+// holds fewer IDs than there are leaves, in which case ok is false.
+func leafRange(keyRange KeyRange, leaf int) (KeyRange, bool) {
+	start := leafOffset(keyRange, leaf)
+	end := leafOffset(keyRange, leaf+1)
+	if start.Cmp(end) == 0 {
+		return KeyRange{}, false
+	}
+	return KeyRange{Start: keyRange.Start.Add(start), End: keyRange.Start.Add(end)}, true
+}
+
+// leafIndex returns the leaf a key in keyRange belongs to
+func leafIndex(keyRange KeyRange, key utils.ID) int {
+	offset := keyRange.Start.Distance(key)
+	if offset.Sign() == 0 {
+		offset = rangeSpan(keyRange) // key is the end of a full-ring range
+	}
+	offset.Sub(offset, big.NewInt(1))
+	offset.Mul(offset, big.NewInt(int64(merkleLeaves())))
+	offset.Quo(offset, rangeSpan(keyRange))
+	return int(offset.Int64())
+}
+
+// digestBytes returns the hex SHA-256 digest of data
+func digestBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// chunkDigest returns the digest of a chunk in /shared, reading the file only if it changed since the last call
+func (n *Node) chunkDigest(chunkName string) (string, error) {
+	path := n.path(dataFolder, chunkName)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	n.digests.mu.Lock()
+	cached, ok := n.digests.entries[chunkName]
+	n.digests.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.digest, nil
+	}
+
+	digest, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	n.digests.mu.Lock()
+	if n.digests.entries == nil {
+		n.digests.entries = make(map[string]cachedDigest)
+	}
+	n.digests.entries[chunkName] = cachedDigest{size: info.Size(), modTime: info.ModTime(), digest: digest}
+	n.digests.mu.Unlock()
+	return digest, nil
+}
+
+// forgetDigest drops the cached digest of a chunk whose content was just replaced or removed, along with the
+// cached Merkle trees
+func (n *Node) forgetDigest(chunkName string) {
+	n.digests.mu.Lock()
+	delete(n.digests.entries, chunkName)
+	n.digests.mu.Unlock()
+	n.merkle.invalidate()
+}
+
+// cachedMerkleTree returns the Merkle tree over keyRange, building it only when /shared or the reference
+// counts changed since it was last built
+func (n *Node) cachedMerkleTree(keyRange KeyRange) (*merkleTree, error) {
+	// Read both generations before building, so a change made while building leaves a stale tree behind
+	refs := n.refs.generation()
+	n.merkle.mu.Lock()
+	cached, ok := n.merkle.trees[keyRange]
+	generation := n.merkle.generation
+	n.merkle.mu.Unlock()
+	if ok && cached.refs == refs {
+		return cached.tree, nil
+	}
+
+	tree, err := n.buildMerkleTree(keyRange)
+	if err != nil {
+		return nil, err
+	}
+	n.merkle.mu.Lock()
+	if n.merkle.generation == generation {
+		if n.merkle.trees == nil {
+			n.merkle.trees = make(map[KeyRange]cachedMerkleTree)
+		}
+		n.merkle.trees[keyRange] = cachedMerkleTree{refs: refs, tree: tree}
+	}
+	n.merkle.mu.Unlock()
+	return tree, nil
+}
+
+// buildMerkleTree hashes the chunks this node stores in keyRange
+func (n *Node) buildMerkleTree(keyRange KeyRange) (*merkleTree, error) {
+	chunks, err := n.listSharedChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := merkleLeaves()
+	tree := &merkleTree{
+		keyRange: keyRange,
+		hashes:   make([][]byte, 2*leaves),
+		leaves:   make([][]ChunkInfo, leaves),
+		digests:  make(map[string]string),
+	}
+	for _, chunk := range chunksInRange(chunks, keyRange) {
+		if isShard(chunk.ChunkName) {
+			continue // Shards are protected by parity, not by replicas
+		}
+		digest, err := n.chunkDigest(chunk.ChunkName)
+		if err != nil {
+			continue // Removed while we were listing
+		}
+		tree.digests[chunk.ChunkName] = digest
+		leaf := leafIndex(keyRange, chunk.Key)
+		tree.leaves[leaf] = append(tree.leaves[leaf], chunk)
+	}
+
+	for leaf, leafChunks := range tree.leaves {
+		sort.Slice(leafChunks, func(i, j int) bool { return leafChunks[i].ChunkName < leafChunks[j].ChunkName })
+		h := sha256.New()
+		for _, chunk := range leafChunks {
+			fmt.Fprintf(h, "%s:%s:%d\n", chunk.ChunkName, tree.digests[chunk.ChunkName], n.refs.get(chunk.ChunkName))
+		}
+		tree.hashes[leaves+leaf] = h.Sum(nil)
+	}
+	for i := leaves - 1; i >= 1; i-- {
+		h := sha256.New()
+		h.Write(tree.hashes[2*i])
+		h.Write(tree.hashes[2*i+1])
+		tree.hashes[i] = h.Sum(nil)
+	}
+	return tree, nil
+}
+
+// GetMerkleHashes returns the hashes of the requested tree nodes of this node's Merkle tree over message.Range
+func (n *Node) GetMerkleHashes(message Message, reply *Message) error {
+	tree, err := n.cachedMerkleTree(message.Range)
+	if err != nil {
+		return err
+	}
+	hashes := make([][]byte, len(message.TreeNodes))
+	for i, index := range message.TreeNodes {
+		if index < 1 || index >= len(tree.hashes) {
+			return fmt.Errorf("invalid merkle tree node %d", index)
+		}
+		hashes[i] = tree.hashes[index]
+	}
+	*reply = Message{TreeNodes: message.TreeNodes, TreeHashes: hashes}
+	return nil
+}
+
+// GetChunkDigests returns the digest of each chunk this node stores in message.Range, or of each chunk
+// in message.ChunkTransferParams.Chunks when chunks are given (an empty digest means the chunk is missing)
+func (n *Node) GetChunkDigests(message Message, reply *Message) error {
+	chunks := message.ChunkTransferParams.Chunks
+	if len(chunks) == 0 {
+		stored, err := n.listSharedChunks()
+		if err != nil {
+			return err
+		}
+		chunks = chunksInRange(stored, message.Range)
+	}
+
+	digests := make([]string, len(chunks))
+	refCounts := make([]int, len(chunks))
+	for i, chunk := range chunks {
+		digest, err := n.chunkDigest(chunk.ChunkName)
+		if err == nil {
+			digests[i] = digest
+			refCounts[i] = n.refs.get(chunk.ChunkName)
+		}
+	}
+	*reply = Message{ChunkTransferParams: ChunkTransferRequest{Chunks: chunks}, Digests: digests, RefCounts: refCounts}
+	return nil
+}
+
+// hasChunk reports whether the node at ip already stores chunk with the given digest
+func (n *Node) hasChunk(ip string, chunk ChunkInfo, digest string) bool {
+	reply, err := n.CallRPCMethod(ip, "Node.GetChunkDigests", Message{
+		ChunkTransferParams: ChunkTransferRequest{Chunks: []ChunkInfo{chunk}},
+	})
+	if err != nil || len(reply.Digests) != 1 {
+		return false
+	}
+	return reply.Digests[0] == digest
+}
+
+// syncReplica walks down the Merkle trees of this node and peer, and pushes the chunks of every leaf where
+// peer is missing a chunk or holds different content. It returns the number of chunks pushed.
+func (n *Node) syncReplica(peer Pointer, tree *merkleTree) (int, error) {
+	leaves := merkleLeaves()
+	differing := []int{}
+	frontier := []int{1}
+	for len(frontier) > 0 {
+		reply, err := n.CallRPCMethod(peer.IP, "Node.GetMerkleHashes", Message{Range: tree.keyRange, TreeNodes: frontier})
+		if err != nil {
+			return 0, err
+		}
+		next := []int{}
+		for i, index := range frontier {
+			if i < len(reply.TreeHashes) && bytes.Equal(reply.TreeHashes[i], tree.hashes[index]) {
+				continue
+			}
+			if index >= leaves {
+				differing = append(differing, index-leaves)
+			} else {
+				next = append(next, 2*index, 2*index+1)
+			}
+		}
+		frontier = next
+	}
+
+	pushed := 0
+	for _, leaf := range differing {
+		if len(tree.leaves[leaf]) == 0 {
+			continue // Peer has extra chunks here, which is for pruning to deal with
+		}
+		subRange, ok := leafRange(tree.keyRange, leaf)
+		if !ok {
+			continue
+		}
+		reply, err := n.CallRPCMethod(peer.IP, "Node.GetChunkDigests", Message{Range: subRange})
+		if err != nil {
+			return pushed, err
+		}
+		remoteDigests := make(map[string]string)
+		remoteRefs := make(map[string]int)
+		for i, chunk := range reply.ChunkTransferParams.Chunks {
+			if i < len(reply.Digests) && i < len(reply.RefCounts) {
+				remoteDigests[chunk.ChunkName] = reply.Digests[i]
+				remoteRefs[chunk.ChunkName] = reply.RefCounts[i]
+			}
+		}
+		for _, chunk := range tree.leaves[leaf] {
+			// The owner's reference count wins, so a replica that missed a reference is repaired too. Only a
+			// missing or different chunk is uploaded again, a reference count is simply overwritten.
+			refCount := n.refs.get(chunk.ChunkName)
+			if remoteDigests[chunk.ChunkName] == tree.digests[chunk.ChunkName] {
+				if remoteRefs[chunk.ChunkName] == refCount {
+					continue
+				}
+				_, err := n.CallRPCMethod(peer.IP, "Node.SetChunkRef", Message{
+					ChunkTransferParams: ChunkTransferRequest{ChunkName: chunk.ChunkName, RefCount: refCount},
+				})
+				if err != nil {
+					return pushed, fmt.Errorf("failed to set the reference count of chunk %s: %v", chunk.ChunkName, err)
+				}
+				continue
+			}
+			err := n.pushChunk(peer.IP, chunk.ChunkName)
+			if err != nil {
+				return pushed, fmt.Errorf("failed to push chunk %s: %v", chunk.ChunkName, err)
+			}
+			pushed++
+		}
+	}
+	return pushed, nil
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// storeTestChunk writes a chunk with the given content and reference count into the /shared folder of n
+func storeTestChunk(t *testing.T, n *Node, data []byte, refCount int) string {
+	t.Helper()
+	chunkName := contentChunkName(digestBytes(data))
+	if err := os.WriteFile(n.path(dataFolder, chunkName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	n.refs.set(chunkName, refCount)
+	n.forgetDigest(chunkName)
+	return chunkName
+}
+
+// merkleRoot returns the root hash of the Merkle tree the node at ip builds over keyRange
+func merkleRoot(t *testing.T, from *Node, ip string, keyRange KeyRange) []byte {
+	t.Helper()
+	reply, err := from.CallRPCMethod(ip, "Node.GetMerkleHashes", Message{Range: keyRange, TreeNodes: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply.TreeHashes[0]
+}
+
+func TestMerkleReplicasConverge(t *testing.T) {
+	s := newRing(t, 6)
+	nodes := []*Node{}
+	for _, name := range s.Live() {
+		nodes = append(nodes, s.Node(name))
+	}
+	owner := nodes[0]
+	routing := owner.Routing()
+	keyRange := KeyRange{Start: routing.Predecessor.ID, End: owner.ID}
+	replicas := routing.SuccessorList
+
+	// The owner holds every chunk of its range, and each replica misses a different one of them
+	chunks := []string{}
+	for i := 0; len(chunks) < 8; i++ {
+		data := []byte(fmt.Sprintf("chunk %d", i))
+		if ringOwner(nodes, chunkKey(contentChunkName(digestBytes(data)))) != owner {
+			continue
+		}
+		chunkName := storeTestChunk(t, owner, data, 1)
+		for j, replica := range replicas {
+			if len(chunks)%len(replicas) != j {
+				storeTestChunk(t, s.Node(replica.IP), data, 1)
+			}
+		}
+		chunks = append(chunks, chunkName)
+	}
+	for _, replica := range replicas {
+		if bytes.Equal(merkleRoot(t, owner, replica.IP, keyRange), merkleRoot(t, owner, owner.IP, keyRange)) {
+			t.Fatalf("replica %s has the same Merkle root as the owner before the repair", replica.IP)
+		}
+	}
+
+	owner.repairReplicas()
+	for _, replica := range replicas {
+		if !bytes.Equal(merkleRoot(t, owner, replica.IP, keyRange), merkleRoot(t, owner, owner.IP, keyRange)) {
+			t.Errorf("replica %s has a different Merkle root than the owner after the repair", replica.IP)
+		}
+		for _, chunkName := range chunks {
+			if _, err := os.Stat(s.Node(replica.IP).path(dataFolder, chunkName)); err != nil {
+				t.Errorf("replica %s is missing chunk %s after the repair", replica.IP, chunkName)
+			}
+		}
+	}
+}
+
+func TestMerkleDetectsRefCountDifference(t *testing.T) {
+	s := newRing(t, 6)
+	nodes := []*Node{}
+	for _, name := range s.Live() {
+		nodes = append(nodes, s.Node(name))
+	}
+	owner := nodes[0]
+	routing := owner.Routing()
+	keyRange := KeyRange{Start: routing.Predecessor.ID, End: owner.ID}
+	replica := s.Node(routing.Successor.IP)
+
+	var chunkName string
+	for i := 0; chunkName == ""; i++ {
+		data := []byte(fmt.Sprintf("chunk %d", i))
+		if ringOwner(nodes, chunkKey(contentChunkName(digestBytes(data)))) != owner {
+			continue
+		}
+		chunkName = storeTestChunk(t, owner, data, 2)
+		storeTestChunk(t, replica, data, 1)
+	}
+	if bytes.Equal(merkleRoot(t, owner, replica.IP, keyRange), merkleRoot(t, owner, owner.IP, keyRange)) {
+		t.Fatal("a replica with a different reference count has the same Merkle root as the owner")
+	}
+
+	tree, err := owner.buildMerkleTree(keyRange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := owner.syncReplica(Pointer{ID: replica.ID, IP: replica.IP}, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The content is the same, so only the count is repaired
+	if pushed != 0 {
+		t.Errorf("sync uploaded %d chunks, want 0", pushed)
+	}
+	if count := replica.refs.get(chunkName); count != 2 {
+		t.Errorf("replica counts %d references to the chunk after the sync, want 2", count)
+	}
+	if !bytes.Equal(merkleRoot(t, owner, replica.IP, keyRange), merkleRoot(t, owner, owner.IP, keyRange)) {
+		t.Error("replica has a different Merkle root than the owner after the sync")
+	}
+}
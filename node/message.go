@@ -1,12 +1,35 @@
 package node
 
+import (
+	"distributed-chord/utils"
+	"time"
+)
+
 type Message struct {
 	Type                string
-	ID                  int
+	ID                  utils.ID
 	IP                  string
+	RingBits            int // Width of the sender's identifier space, checked on join
 	SuccessorList       []Pointer
+	Neighbour           Pointer  // Replacement successor/predecessor sent by a departing node
+	Range               KeyRange // Range of keys a request is about
+	TreeNodes           []int    // Merkle tree nodes asked for during anti-entropy
+	TreeHashes          [][]byte // Hashes of TreeNodes
+	Digests             []string // Chunk digests, parallel to ChunkTransferParams.Chunks
+	RefCounts           []int    // Chunk reference counts, parallel to ChunkTransferParams.Chunks
 	DataDir             string
-	FileName string
+	FileName            string
+	FileSize            int64              // Size of the offered or transferred file
+	Offers              []TransferOffer    // Pending transfer offers
+	Query               CatalogQuery       // Catalog search
+	Catalog             []CatalogEntry     // Catalog entries found by a search
+	Unreachable         []Pointer          // Nodes a search across the ring couldn't reach, so its results may be incomplete
+	TransferID          string             // Names a file transfer and its journals, so it can be resumed
+	Progress            []TransferProgress // Progress of transfers, or progress events
+	EventSeq            uint64             // Last progress event the caller received
+	Candidates          []Pointer          // Next hops of an iterative lookup, best first
+	Path                []Pointer          // Nodes a lookup went through, starting where it began
+	Hops                int                // Hops the lookup took, len(Path) - 1
 	ChunkTransferParams ChunkTransferRequest
 }
 
@@ -17,7 +40,22 @@ type FileTransferRequest struct {
 
 // Struct to hold the chunk transfer request
 type ChunkTransferRequest struct {
-	ChunkName string
-	Data      []byte
-	Chunks    []ChunkInfo
+	ChunkName  string
+	Digest     string // SHA-256 of the whole chunk
+	Block      []byte // Part of the chunk starting at Offset, at most blockSize bytes
+	Offset     int64
+	Size       int64  // Size of the whole chunk
+	Final      bool   // Set on the last block of an upload
+	UploadID   string // Tells apart concurrent uploads of the same chunk
+	Chunks     []ChunkInfo
+	FileDigest string        // SHA-256 of the whole file the chunks belong to
+	RefCount   int           // Reference count of a replicated chunk
+	Erasure    ErasureParams // Set when Chunks are erasure-coded shards
+	Wait       time.Duration // How long the caller waits before its next block, so the serving node keeps to its limits
+}
+
+// KeyRange is the half-open interval (Start, End] on the ring
+type KeyRange struct {
+	Start utils.ID
+	End   utils.ID
 }
@@ -1,12 +1,9 @@
 package node
 
 import (
+	"context"
 	"distributed-chord/utils"
 	"fmt"
-	"log"
-	"math"
-	"net"
-	"net/rpc"
 	"os"
 	"path/filepath"
 	"sync"
@@ -15,108 +12,182 @@ import (
 )
 
 type Pointer struct {
-	ID int    // Node ID
-	IP string // Node IP address with the port
+	ID utils.ID // Node ID
+	IP string   // Node IP address with the port
 }
 
 type Node struct {
-	ID              int
+	ID              utils.ID
 	IP              string
-	Successor       Pointer
-	Predecessor     Pointer
-	FingerTable     []Pointer
-	SuccessorList   []Pointer
+	routing         routingTable // Successor, predecessor, successor list and fingers, see Routing
 	StartReq        time.Time
 	Lock            sync.Mutex
-	AssemblerChunks []ChunkInfo // Field to store the assembler chunks
+	AssemblerChunks []ChunkInfo      // Field to store the assembler chunks
+	digests         digestCache      // Digests of the chunks in /shared, used by the Merkle trees
+	merkle          merkleCache      // Merkle trees served to the replica holders, see cachedMerkleTree
+	refs            refCounter       // Reference counts of the chunks in /shared
+	Chunking        ChunkingStrategy // How Chunker cuts files, LogChunking when nil
+	Workers         int              // Chunks uploaded or downloaded at the same time, defaultTransferWorkers when 0
+	Consent         ConsentPolicy    // Answers transfer offers without asking the user
+	offers          offerQueue       // Transfer offers received by this node
+	recipients      recipientTracker // Multi-recipient transfers waiting for their targets to assemble the file
+	Transport       Transport        // How the node serves and makes RPCs, TCPTransport when nil
+	tcp             defaultTransport // The TCPTransport used when Transport is nil, with its connection pool
+	RPCTimeout      time.Duration    // Deadline of an RPC, defaultRPCTimeout when 0, see rpcTimeout
+	LookupMode      string           // LOOKUP_RECURSIVE or LOOKUP_ITERATIVE, recursive when empty
+	root            string           // Directory the node's folders are under, see CreateNodeAt
+	faults          faultInjector    // Faults injected at the fault points, see InjectFault
+	migrations      sync.WaitGroup   // Key migrations running in the background, see startMigration
+	transfers       transferRegistry // Transfers running on this node, so they can be cancelled
+	progress        progressTracker  // Progress of the transfers on this node
+	Bandwidth       BandwidthLimits  // Rate limits for chunk traffic, unlimited when zero
+	traffic         trafficShaper    // Node-wide limiters built from Bandwidth
+	Sleeping        atomic.Bool      // The TCPTransport refuses requests while set, to simulate a network partition
+}
+
+type defaultTransport struct {
+	once      sync.Once
+	transport *TCPTransport
 }
 
 type NodeInfo struct {
-	ID        int
+	ID        utils.ID
 	IP        string
 	Successor Pointer
 }
 
 const (
-	timeInterval = 5         // Time interval for stabilization and fixing fingers
-	r            = 3         // Number of successors to keep in the successor list
-	retries      = 3         // Number of retries for file transfer
-	CONFIRM      = "CONFIRM" // Confirm file transfer
-	REJECT       = "REJECT"  // Deny file transfer
+	timeInterval   = 5         // Time interval for stabilization and fixing fingers
+	r              = 3         // Number of successors to keep in the successor list
+	retries        = 3         // Number of retries for file transfer
+	idSaltAttempts = 5         // Number of IDs a joining node tries before giving up on a collision
+	CONFIRM        = "CONFIRM" // Confirm file transfer
+	REJECT         = "REJECT"  // Deny file transfer
+	PENDING        = "PENDING" // File transfer offer waiting for the receiver's answer
+	EXPIRED        = "EXPIRED" // File transfer offer nobody answered in time
+
+	PREDECESSOR_ACCEPTED = "PREDECESSOR_ACCEPTED" // Notify made the caller the new predecessor
+	CHUNK_REPLICA        = "CHUNK_REPLICA"        // Chunk copied between holders, carrying its reference count
+	FILE_FETCH           = "FILE_FETCH"           // Assembly of a published file fetched by name
+	CANCELLED            = "CANCELLED"            // File transfer cancelled by one of its participants
+	MULTI_TRANSFER       = "MULTI_TRANSFER"       // Transfer to several targets, the sender removes the chunks once all are done
 )
 
-var IsSleeping atomic.Bool
-
 // Starting the RPC server for the nodes
 func (n *Node) StartRPCServer() {
-	IsSleeping.Store(false) // Initially no partition
-	rpc.Register(n)
-	listener, err := net.Listen("tcp", n.IP)
+	n.Sleeping.Store(false) // Initially no partition
+	if err := n.transport().Serve(n); err != nil {
+		fmt.Printf("[NODE-%s] Error serving RPCs: %v\n", n.ID, err)
+	}
+}
+
+// transport returns the transport of the node, TCP unless another one was set
+func (n *Node) transport() Transport {
+	if n.Transport == nil {
+		n.tcp.once.Do(func() { n.tcp.transport = &TCPTransport{} })
+		return n.tcp.transport
+	}
+	return n.Transport
+}
+
+func (n *Node) RequestFileTransfer(targetNodeID utils.ID, fileName string, options TransferOptions) error {
+	targetNodeIP, err := n.locateTarget(targetNodeID)
 	if err != nil {
-		fmt.Printf("[NODE-%d] Error starting RPC server: %v\n", n.ID, err)
-		return
+		return err
 	}
-	defer listener.Close()
-	fmt.Printf("[NODE-%d] Listening on %s\n", n.ID, n.IP)
+	fmt.Printf("Target node IP: %s\n", targetNodeIP)
 
-	for {
-		conn, err := listener.Accept()
-		if IsSleeping.Load() {
-			fmt.Printf("[NODE-%d] Network partition detected. Waiting for recovery...\n", n.ID)
-			conn.Close()
-			time.Sleep(1 * time.Second)
-			continue
+	if n.IP == targetNodeIP {
+		fmt.Println("Cannot send file to the same node.")
+		return nil
+	}
+
+	fileInfo, err := os.Stat(n.path(localFolder, fileName))
+	if err != nil {
+		return fmt.Errorf("cannot offer file %s: %v", fileName, err)
+	}
+
+	// The offer and, once it is accepted, the transfer and its journals share one ID
+	request := Message{
+		ID:         n.ID,
+		IP:         n.IP,
+		FileName:   fileName,
+		FileSize:   fileInfo.Size(),
+		TransferID: newTransferID(),
+	}
+
+	decision, err := n.offerTransfer(targetNodeID, targetNodeIP, request)
+	if err != nil {
+		return err
+	}
+
+	if decision == CONFIRM {
+		fmt.Println("\nTarget accepted the file transfer. Initiating transfer...")
+		n.StartReq = time.Now()
+		journal := &sendJournal{
+			root:       n.root,
+			TransferID: request.TransferID,
+			FileName:   fileName,
+			TargetID:   targetNodeID,
+			TargetIP:   targetNodeIP,
+			Options:    options,
 		}
+		ctx, err := n.beginTransfer(journal.TransferID, targetNodeIP)
 		if err != nil {
-			fmt.Printf("[NODE-%d] accept error: %s\n", n.ID, err)
-			return
+			return err
+		}
+		chunks := n.Chunker(ctx, journal)
+		n.transfers.end(journal.TransferID)
+		if len(chunks) > 0 {
+			//i changed this to chunk transfer, since printing out file transfer completed when simulating target node faliue during assembly may look weird to prof
+			fmt.Printf("\nChunk transfer completed with %d chunks.\n", len(chunks))
+		} else {
+			fmt.Println("\nFile transfer failed - no chunks created.")
 		}
-		go rpc.ServeConn(conn)
+	} else if decision == EXPIRED {
+		fmt.Println("\nTarget did not answer the file transfer offer in time.")
+	} else {
+		fmt.Println("\nTarget declined the file transfer.")
 	}
 
+	fmt.Println("\nReturning to main menu...")
+	return nil
 }
 
-func (n *Node) RequestFileTransfer(targetNodeID int, fileName string) error {
+// locateTarget returns the IP of the node with the given ID, retrying while the ring may still be settling
+func (n *Node) locateTarget(targetNodeID utils.ID) (string, error) {
 	var reply Message
-	var err error
 	message := Message{ID: targetNodeID}
 
 	for i := 0; i < retries; i++ {
 		err := n.FindSuccessor(message, &reply)
 		if err != nil {
-			return fmt.Errorf("failed to find successor: %v", err)
+			return "", fmt.Errorf("failed to find successor: %v", err)
 		}
 		if reply.ID != targetNodeID {
-			fmt.Printf("Node %d not found. Retrying to find successor (attempt %d of %d)\n", targetNodeID, i+1, retries)
+			fmt.Printf("Node %s not found. Retrying to find successor (attempt %d of %d)\n", targetNodeID, i+1, retries)
 			time.Sleep(3 * time.Second) // retry after 3 seconds
 		} else {
-			break
+			// time.Sleep(5 * time.Second) // Sleep for checking if the find successor detects the target node as alive but is actually sleeping.
+			return reply.IP, nil
 		}
 	}
+	return "", fmt.Errorf("node %s not found in the ring", targetNodeID)
+}
 
-	// time.Sleep(5 * time.Second) // Sleep for checking if the find successor detects the target node as alive but is actually sleeping.
-	targetNodeIP := reply.IP
-	fmt.Printf("Target node IP: %s\n", targetNodeIP)
-
-	if n.IP == targetNodeIP {
-		fmt.Println("Cannot send file to the same node.")
-		return nil
-	}
-
-	request := Message{
-		IP:       n.IP,
-		FileName: fileName,
-	}
-
+// offerTransfer offers the file described by request to the target and waits for its answer. It returns
+// CONFIRM, REJECT or EXPIRED.
+func (n *Node) offerTransfer(targetNodeID utils.ID, targetNodeIP string, request Message) (string, error) {
 	var response *Message
+	var err error
 	var success bool
 	for i := 0; i < retries; i++ {
 		success = false
-		response, err = CallRPCMethod(targetNodeIP, "Node.ConfirmFileTransfer", request)
+		response, err = n.CallRPCMethod(targetNodeIP, "Node.ConfirmFileTransfer", request)
 		if err != nil {
 			// target node fail before chunking
-			fmt.Printf("[NODE-%d] Error confirming file transfer.\n", n.ID)
-			fmt.Printf("[NODE-%d] Retrying file transfer confirmation to node %d (attempt %d of %d)\n", n.ID, targetNodeID, i+1, retries)
+			fmt.Printf("[NODE-%s] Error confirming file transfer.\n", n.ID)
+			fmt.Printf("[NODE-%s] Retrying file transfer confirmation to node %s (attempt %d of %d)\n", n.ID, targetNodeID, i+1, retries)
 			time.Sleep(3 * time.Second) // retry after 3 seconds
 		} else {
 			success = true
@@ -125,26 +196,14 @@ func (n *Node) RequestFileTransfer(targetNodeID int, fileName string) error {
 	}
 
 	if !success {
-		return fmt.Errorf("failed to confirm file transfer after %d attempts", retries)
+		return "", fmt.Errorf("failed to confirm file transfer after %d attempts", retries)
 	}
 
-	if response.Type == CONFIRM {
-		fmt.Println("\nTarget accepted the file transfer. Initiating transfer...")
-		startTime := time.Now()
-		n.StartReq = startTime
-		chunks := n.Chunker(fileName, targetNodeIP, startTime)
-		if len(chunks) > 0 {
-			//i changed this to chunk transfer, since printing out file transfer completed when simulating target node faliue during assembly may look weird to prof
-			fmt.Printf("\nChunk transfer completed with %d chunks.\n", len(chunks))
-		} else {
-			fmt.Println("\nFile transfer failed - no chunks created.")
-		}
-	} else {
-		fmt.Println("\nTarget declined the file transfer.")
+	decision := response.Type
+	if decision == PENDING {
+		decision = n.awaitOfferDecision(targetNodeIP, request.TransferID)
 	}
-
-	fmt.Println("\nReturning to main menu...")
-	return nil
+	return decision, nil
 }
 
 // Function to handle sender node failing before chunking (before sending chunk info) and before/during assembly (after sending chunk info)
@@ -164,7 +223,9 @@ func (n *Node) handleReceiverTimeout(senderIP string) {
 			// fmt.Printf("Chunks and length: %v, %d", chunks, len(chunks))
 			if len(chunks) > 0 {
 				fmt.Printf("\nReceived %d chunks successfully\n", len(chunks))
+				n.Lock.Lock()
 				n.AssemblerChunks = []ChunkInfo{} // Clear the assembler chunks
+				n.Lock.Unlock()
 				return
 			}
 			if elapsed >= 35 && len(chunks) == 0 {
@@ -188,289 +249,327 @@ func (n *Node) checkAssemblerChunks() []ChunkInfo {
 	return n.AssemblerChunks
 }
 
-func (n *Node) ConfirmFileTransfer(request Message, reply *Message) error {
-	fmt.Printf("Received file transfer request from %s for file %s\n", request.IP, request.FileName)
-	var userResponse string
-	fmt.Print("Do you want to receive the file? (yes/no):")
-	fmt.Scanln(&userResponse)
-	// fmt.Printf()
-	// fmt.Printf("User response: %s\n", userResponse)
-	if userResponse == "es" {
-		go n.handleReceiverTimeout(request.IP)
-		*reply = Message{
-			Type: CONFIRM,
-		}
-	} else {
-		*reply = Message{
-			Type: REJECT,
+// FindSuccessor finds the node that owns message.ID. The reply carries the owner, the nodes the lookup went
+// through starting with this one, and the number of hops between them. LookupMode sets how the lookup travels.
+func (n *Node) FindSuccessor(message Message, reply *Message) error {
+	if message.Type == "Join" {
+		if err := checkRingWidth(message); err != nil {
+			return err
 		}
 	}
-	// If condition to handle sender node failing before chunking (before sending chunk info) and before/during assembly (after sending chunk info)
-	// if userResponse == "es" {
-
-	// }
-	return nil
+	// fmt.Printf("[NODE-%s] Finding successor for %d...\n", n.ID, message.ID)
+	if n.LookupMode == LOOKUP_ITERATIVE {
+		return n.findSuccessorIterative(message, reply)
+	}
+	return n.findSuccessorRecursive(message, reply)
 }
 
-func (n *Node) FindSuccessor(message Message, reply *Message) error {
-	// fmt.Printf("[NODE-%d] Finding successor for %d...\n", n.ID, message.ID)
-	if utils.Between(message.ID, n.ID, n.Successor.ID, true) { // message.ID is between n.ID and n.Successor.ID (inclusive of Successor ID)
-
-		// Check if the successor is alive
-		_, err := CallRPCMethod(n.Successor.IP, "Node.Ping", Message{})
-		if err != nil { // if the successor is not alive
-			// fmt.Printf("[NODE-%d] Successor Node-%d appears to be down.\n", n.ID, n.Successor.ID)
-			nextSuccessor := n.findNextAlive()
-
-			if nextSuccessor == (Pointer{}) { // null pointer => no successor of node n is alive(very unlikely)
-				fmt.Printf("[NODE-%d] No Successor from the successor list is alive.", n.ID)
-				nextSuccessor = Pointer{ID: n.ID, IP: n.IP}
-			}
-
-			// fmt.Printf("[NODE-%d] next alive successor found %d\n", n.ID, nextSuccessor.ID)
-			*reply = Message{
-				ID: nextSuccessor.ID,
-				IP: nextSuccessor.IP,
-			}
-			return nil
-		}
-		*reply = Message{
-			ID: n.Successor.ID,
-			IP: n.Successor.IP,
-		}
-		// fmt.Printf("[NODE-%d] Successor found: %v\n", n.ID, reply.ID)
-		return nil
-	} else {
-		closest := n.closestPrecedingNode(message.ID)
-		if closest.ID == n.ID {
-			*reply = Message{
-				ID: n.ID,
-				IP: n.IP,
-			}
-			// fmt.Printf("[NODE-%d] Successor is self: %v\n", n.ID, reply.ID)
-			return nil
-		}
-		newReply, _ := CallRPCMethod(closest.IP, "Node.FindSuccessor", message)
-		*reply = *newReply
-		return nil
-	}
+// IDCollisionError is returned by Join when every candidate ID for the node is already owned by another live node
+type IDCollisionError struct {
+	IP       string   // Address of the joining node
+	ID       utils.ID // Last ID that was tried
+	Owner    Pointer  // Node that already owns that ID
+	Attempts int      // Number of IDs tried
 }
 
-func (n *Node) closestPrecedingNode(id int) Pointer {
-	for i := utils.M - 1; i >= 0; i-- {
-		if utils.Between(n.FingerTable[i].ID, n.ID, id, false) {
-			return n.FingerTable[i]
-		}
-	}
-	return Pointer{ID: n.ID, IP: n.IP}
+func (e *IDCollisionError) Error() string {
+	return fmt.Sprintf("node %s could not get a unique ID after %d attempts: ID %s is owned by %s", e.IP, e.Attempts, e.ID, e.Owner.IP)
 }
 
 // Handled by the bootstrap node
-func (n *Node) Join(joinIP string) {
-	// Joining the network
-	message := Message{
-		Type: "Join",
-		ID:   n.ID,
-		IP:   n.IP,
-	}
+func (n *Node) Join(joinIP string) error {
+	var reply *Message
+	var err error
 
-	reply, err := CallRPCMethod(joinIP, "Node.FindSuccessor", message)
+	// Ask the bootstrap node who owns our ID. If it is a different live node, re-derive the ID with a salt and ask again.
+	for attempt := 0; ; attempt++ {
+		message := Message{
+			Type:     "Join",
+			ID:       n.ID,
+			IP:       n.IP,
+			RingBits: utils.M,
+		}
 
-	if err != nil {
-		log.Fatalf("[NODE-%d] Failed to join network: %v", n.ID, err)
+		reply, err = n.CallRPCMethod(joinIP, "Node.FindSuccessor", message)
+		if err != nil {
+			return fmt.Errorf("[NODE-%s] Failed to join network: %v", n.ID, err)
+		}
+
+		// The same IP means a stale entry for this very node, which is safe to take over
+		if reply.ID != n.ID || reply.IP == n.IP {
+			break
+		}
+		if attempt+1 >= idSaltAttempts {
+			return &IDCollisionError{IP: n.IP, ID: n.ID, Owner: Pointer{ID: reply.ID, IP: reply.IP}, Attempts: attempt + 1}
+		}
+		fmt.Printf("ID %s is already owned by %s, re-deriving the ID (attempt %d of %d)\n", n.ID, reply.IP, attempt+1, idSaltAttempts)
+		n.setID(saltedID(n.IP, attempt+1))
 	}
 
-	// fmt.Printf("[NODE-%d] Joining network with successor: %v\n", n.ID, reply.ID)
-	n.Predecessor = Pointer{}
-	n.Successor = Pointer{ID: reply.ID, IP: reply.IP}
+	// fmt.Printf("[NODE-%s] Joining network with successor: %v\n", n.ID, reply.ID)
+	successor := Pointer{ID: reply.ID, IP: reply.IP}
+	n.updateRouting(func(s *RoutingState) {
+		s.Predecessor = Pointer{}
+		s.Successor = successor
+	})
 
 	// Notify the successor of the new predecessor
-	message = Message{
-		Type: "NOTIFY",
-		ID:   n.ID,
-		IP:   n.IP,
+	message := Message{
+		Type:     "NOTIFY",
+		ID:       n.ID,
+		IP:       n.IP,
+		RingBits: utils.M,
 	}
 
-	_, err = CallRPCMethod(n.Successor.IP, "Node.Notify", message)
+	notifyReply, err := n.CallRPCMethod(successor.IP, "Node.Notify", message)
 	if err != nil {
-		log.Fatalf("[NODE-%d] Failed to notify successor: %v", n.ID, err)
+		return fmt.Errorf("[NODE-%s] Failed to notify successor: %v", n.ID, err)
 	}
+	if notifyReply.Type == PREDECESSOR_ACCEPTED {
+		n.startMigration(successor, notifyReply.Neighbour)
+	}
+	return nil
+}
+
+// saltedID derives an alternative ID for a node whose hashed IP collides with another node
+func saltedID(ip string, salt int) utils.ID {
+	return utils.Hash(fmt.Sprintf("%s#%d", ip, salt))
+}
+
+// setID moves a node that has not joined yet to a new ID
+func (n *Node) setID(id utils.ID) {
+	n.ID = id
+	n.updateRouting(func(s *RoutingState) {
+		s.Successor = Pointer{ID: id, IP: n.IP}
+		s.FingerTable = make([]Pointer, utils.M)
+		for i := range s.FingerTable {
+			s.FingerTable[i] = Pointer{ID: id, IP: n.IP}
+		}
+	})
 }
 
 func (n *Node) Stabilize() {
 	for {
 		time.Sleep(timeInterval * time.Second)
+		n.stabilize()
+	}
+}
 
-		// fmt.Printf("[NODE-%d] Stabilizing...\n", n.ID)
+// stabilize runs one round of Stabilize
+func (n *Node) stabilize() {
+	// fmt.Printf("[NODE-%s] Stabilizing...\n", n.ID)
 
-		reply, err := CallRPCMethod(n.Successor.IP, "Node.GetPredecessor", Message{})
-		if err != nil {
-			nextSuccessor := n.findNextAlive()
-			if nextSuccessor == (Pointer{}) {
-				fmt.Printf("[NODE-%d] No Successor from the successor list is alive.", n.ID)
-				fmt.Printf("[NODE-%d] Failed to get successor's predecessor: %v\n", n.ID, err)
-				nextSuccessor = Pointer{ID: n.ID, IP: n.IP}
+	// The successor is only replaced if no one else changed it while its predecessor was asked for
+	asked := n.Routing().Successor
+	reply, err := n.CallRPCMethod(asked.IP, "Node.GetPredecessor", Message{})
+	var successor Pointer
+	if err != nil {
+		nextSuccessor := n.findNextAlive()
+		if nextSuccessor == (Pointer{}) {
+			fmt.Printf("[NODE-%s] No Successor from the successor list is alive.", n.ID)
+			fmt.Printf("[NODE-%s] Failed to get successor's predecessor: %v\n", n.ID, err)
+			nextSuccessor = Pointer{ID: n.ID, IP: n.IP}
+		}
+		successor = n.updateRouting(func(s *RoutingState) {
+			if s.Successor == asked {
+				s.Successor = nextSuccessor
 			}
-			n.Successor = nextSuccessor
-		} else {
-			successorPredecessor := Pointer{ID: reply.ID, IP: reply.IP}
-			if successorPredecessor != (Pointer{}) && utils.Between(successorPredecessor.ID, n.ID, n.Successor.ID, false) {
-				n.Successor = successorPredecessor
-				// fmt.Printf("[NODE-%d] Successor updated to %d\n", n.ID, n.Successor.ID)
+		}).Successor
+	} else {
+		successorPredecessor := Pointer{ID: reply.ID, IP: reply.IP}
+		successor = n.updateRouting(func(s *RoutingState) {
+			if successorPredecessor != (Pointer{}) && utils.Between(successorPredecessor.ID, n.ID, s.Successor.ID, false) {
+				s.Successor = successorPredecessor
+				// fmt.Printf("[NODE-%s] Successor updated to %d\n", n.ID, s.Successor.ID)
 			}
-		}
-
-		// Notify the successor of the new predecessor
-		message := Message{
-			Type: "NOTIFY",
-			ID:   n.ID,
-			IP:   n.IP,
-		}
-		_, err = CallRPCMethod(n.Successor.IP, "Node.Notify", message)
+		}).Successor
+	}
 
-		if err != nil {
-			fmt.Printf("[NODE-%d] Failed to notify successor: %v\n", n.ID, err)
-		}
+	// Notify the successor of the new predecessor
+	message := Message{
+		Type:     "NOTIFY",
+		ID:       n.ID,
+		IP:       n.IP,
+		RingBits: utils.M,
+	}
+	notifyReply, err := n.CallRPCMethod(successor.IP, "Node.Notify", message)
 
-		// Update the successor list
-		n.updateSuccessorList()
+	if err != nil {
+		fmt.Printf("[NODE-%s] Failed to notify successor: %v\n", n.ID, err)
+	} else if notifyReply.Type == PREDECESSOR_ACCEPTED && successor.IP != n.IP {
+		n.startMigration(successor, notifyReply.Neighbour)
 	}
+
+	// Update the successor list
+	n.updateSuccessorList()
 }
 
 func (n *Node) GetSuccessor(message Message, reply *Message) error {
+	successor := n.Routing().Successor
 	*reply = Message{
-		ID: n.Successor.ID,
-		IP: n.Successor.IP,
+		ID: successor.ID,
+		IP: successor.IP,
 	}
 	return nil
 }
 
 func (n *Node) GetSuccessorList(message Message, reply *Message) error {
+	routing := n.Routing()
 	*reply = Message{
-		ID:            n.Successor.ID,
-		SuccessorList: n.SuccessorList,
+		ID:            routing.Successor.ID,
+		SuccessorList: routing.SuccessorList,
 	}
 	return nil
 }
 
 func (n *Node) GetPredecessor(message Message, reply *Message) error {
+	predecessor := n.Routing().Predecessor
 	*reply = Message{
-		ID: n.Predecessor.ID,
-		IP: n.Predecessor.IP,
+		ID: predecessor.ID,
+		IP: predecessor.IP,
 	}
 	return nil
 }
 
 func (n *Node) Notify(message Message, reply *Message) error {
-	// fmt.Printf("[NODE-%d] Notified by node %d...\n", n.ID, message.ID)
-	if n.Predecessor == (Pointer{}) || utils.Between(message.ID, n.Predecessor.ID, n.ID, false) {
-		n.Predecessor = Pointer{ID: message.ID, IP: message.IP}
-		// fmt.Printf("[NODE-%d] Predecessor updated to %d\n", n.ID, n.Predecessor.ID)
-	}
+	if err := checkRingWidth(message); err != nil {
+		return err
+	}
+	if message.ID == n.ID && message.IP != n.IP {
+		return &IDCollisionError{IP: message.IP, ID: message.ID, Owner: Pointer{ID: n.ID, IP: n.IP}, Attempts: 1}
+	}
+	// fmt.Printf("[NODE-%s] Notified by node %d...\n", n.ID, message.ID)
+	n.updateRouting(func(s *RoutingState) {
+		if s.Predecessor == (Pointer{}) || utils.Between(message.ID, s.Predecessor.ID, n.ID, false) {
+			previous := s.Predecessor
+			s.Predecessor = Pointer{ID: message.ID, IP: message.IP}
+			// fmt.Printf("[NODE-%s] Predecessor updated to %d\n", n.ID, s.Predecessor.ID)
+			if previous != s.Predecessor {
+				// Tell the new predecessor who it replaced so it can pull the keys it now owns
+				*reply = Message{Type: PREDECESSOR_ACCEPTED, Neighbour: previous}
+			}
+		}
+	})
 	return nil
 }
 
 func (n *Node) FixFingers() {
 	for {
 		time.Sleep((timeInterval + 2) * time.Second)
+		n.fixFingers()
+	}
+}
 
-		for next := 0; next < utils.M; next++ {
-			// Calculate the start of the finger interval
-			start := (n.ID + int(math.Pow(2, float64(next)))) % int(math.Pow(2, float64(utils.M)))
-
-			// fmt.Printf("[NODE-%d] Fixing finger %d for key %d\n", n.ID, next, start)
-			// Find and update successor for this finger
-			message := Message{ID: start}
-			var reply Message
-			err := n.FindSuccessor(message, &reply)
-			if err != nil {
-				fmt.Printf("[NODE-%d] Failed to find successor for finger %d: %v\n", n.ID, next, err)
-				continue
-			}
-			// fmt.Printf("[NODE-%d] Found successor for key %d: %v\n", n.ID, start, reply.ID)
+// fixFingers runs one round of FixFingers, refreshing every finger
+func (n *Node) fixFingers() {
+	for next := 0; next < utils.M; next++ {
+		// Calculate the start of the finger interval
+		start := n.ID.AddPow2(next)
 
-			n.FingerTable[next] = Pointer{ID: reply.ID, IP: reply.IP}
+		// fmt.Printf("[NODE-%s] Fixing finger %d for key %d\n", n.ID, next, start)
+		// Find and update successor for this finger
+		message := Message{ID: start}
+		var reply Message
+		err := n.FindSuccessor(message, &reply)
+		if err != nil {
+			fmt.Printf("[NODE-%s] Failed to find successor for finger %d: %v\n", n.ID, next, err)
+			continue
 		}
+		// fmt.Printf("[NODE-%s] Found successor for key %d: %v\n", n.ID, start, reply.ID)
+
+		n.updateRouting(func(s *RoutingState) {
+			s.FingerTable[next] = Pointer{ID: reply.ID, IP: reply.IP}
+		})
 	}
 }
 
 // Add the GetNodeInfo method here
 func (n *Node) GetNodeInfo(args struct{}, reply *NodeInfo) error {
-	n.Lock.Lock()
-	defer n.Lock.Unlock()
 	reply.ID = n.ID
 	reply.IP = n.IP
-	reply.Successor = n.Successor
+	reply.Successor = n.Routing().Successor
 	return nil
 }
 
 // Potential failure: When the find successor function is called, it should check if the find successor is alive or not
 // If the find successor is not alive, it should keeping checking the next successor until it finds an alive one(?)
 func (n *Node) updateSuccessorList() {
-	n.Lock.Lock()
-	defer n.Lock.Unlock()
-	next := Pointer{n.ID, n.IP}
-	n.SuccessorList = []Pointer{}
-	for i := 0; i < r; i++ {
-		successorInfo, err := CallRPCMethod(next.IP, "Node.GetSuccessor", Message{})
+	// The first entry is our own successor, so a node that is not serving RPCs yet (joining) can fill its list
+	next := n.Routing().Successor
+	successorList := []Pointer{next}
+	for i := 1; i < r; i++ {
+		successorInfo, err := n.CallRPCMethod(next.IP, "Node.GetSuccessor", Message{})
 		if err != nil {
-			// fmt.Printf("[NODE-%d] Failed to get successor %d: %v\n", n.ID, i, err)
+			// fmt.Printf("[NODE-%s] Failed to get successor %d: %v\n", n.ID, i, err)
 			continue
 		}
 		next = Pointer{ID: successorInfo.ID, IP: successorInfo.IP}
-		n.SuccessorList = append(n.SuccessorList, next)
+		successorList = append(successorList, next)
 	}
+	n.updateRouting(func(s *RoutingState) {
+		s.SuccessorList = successorList
+	})
 }
 
+// findNextAlive returns the first live node after the successor in the successor list, or an empty Pointer
 func (n *Node) findNextAlive() Pointer {
-	n.Lock.Lock()
-	defer n.Lock.Unlock()
-
-	if len(n.SuccessorList) <= 1 {
-		return Pointer{}
-	}
-
-	for i := 1; i < r; i++ {
-		reply, err := CallRPCMethod(n.SuccessorList[i].IP, "Node.Ping", Message{})
+	successorList := n.Routing().SuccessorList
+	for i := 1; i < len(successorList) && i < r; i++ {
+		reply, err := n.CallRPCMethod(successorList[i].IP, "Node.Ping", Message{})
 		if err == nil && reply != nil {
-			return n.SuccessorList[i]
+			return successorList[i]
 		}
 	}
 	return Pointer{}
 }
 
 func CreateNode(ip string) *Node {
-	id := utils.Hash(ip) % int(math.Pow(2, float64(utils.M))) // Ensure ID is within [0, 2^m - 1]
+	return CreateNodeAt(ip, "")
+}
 
+// CreateNodeAt creates a node that keeps its folders (/local, /shared, ...) under root instead of the file
+// system root, so several nodes can run in one process
+func CreateNodeAt(ip string, root string) *Node {
 	node := &Node{
-		ID:            id,
-		IP:            ip,
-		Successor:     Pointer{ID: id, IP: ip},
-		Predecessor:   Pointer{},
-		FingerTable:   make([]Pointer, utils.M),
-		SuccessorList: make([]Pointer, 0),
-		Lock:          sync.Mutex{},
+		IP:   ip,
+		root: root,
+		refs: refCounter{dir: filepath.Join(root, dataFolder)},
+		Lock: sync.Mutex{},
 	}
 
-	// Initialize finger table with self to prevent nil entries
-	for i := 0; i < utils.M; i++ {
-		node.FingerTable[i] = Pointer{ID: node.ID, IP: node.IP}
-	}
+	// Hash already keeps the ID within [0, 2^m - 1]. This also initializes the finger table with self to prevent nil entries
+	node.setID(utils.Hash(ip))
 
 	return node
 }
 
-func CallRPCMethod(ip string, method string, message Message) (*Message, error) {
-	client, err := rpc.Dial("tcp", ip)
-	if err != nil {
-		return &Message{}, fmt.Errorf("[NODE-%d] Failed to connect to node at %s: %v", message.ID, ip, err)
-	}
-	defer client.Close()
+// path returns the path of a file in one of the node's folders. Folders are named by their absolute path
+// (dataFolder, localFolder, ...) in RPCs, and every node resolves them under its own root.
+func (n *Node) path(folder string, elem ...string) string {
+	return filepath.Join(append([]string{n.root, folder}, elem...)...)
+}
 
+// CallRPCMethod calls method on the node at ip, giving up after the deadline rpcTimeout sets for the method
+func (n *Node) CallRPCMethod(ip string, method string, message Message) (*Message, error) {
+	return n.CallRPCMethodContext(context.Background(), ip, method, message)
+}
+
+// CallRPCMethodContext calls method on the node at ip, giving up when ctx ends. A ctx without a deadline gets
+// the one rpcTimeout sets for the method. The error wraps a *DialError when the node can't be reached, a
+// *TimeoutError when it didn't answer in time and a *RemoteError when the method failed, so callers can tell
+// a dead node from a slow one.
+func (n *Node) CallRPCMethodContext(ctx context.Context, ip string, method string, message Message) (*Message, error) {
+	if controlMethods[method] {
+		defer n.controlPlane()()
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.rpcTimeout(method))
+		defer cancel()
+	}
 	var reply Message
-	err = client.Call(method, message, &reply)
-	if err != nil {
-		return &Message{}, fmt.Errorf("[NODE-%d] Failed to call method %s: %v", message.ID, method, err)
+	if err := n.transport().Call(ctx, ip, method, message, &reply); err != nil {
+		return &Message{}, fmt.Errorf("[NODE-%s] call to %s: %w", n.ID, ip, err)
 	}
 
 	return &reply, nil
@@ -483,7 +582,12 @@ func (n *Node) RemoveChunksLocal(request Message, reply *Message) error {
 	dataDir := request.DataDir
 
 	for _, chunk := range request.ChunkTransferParams.Chunks {
-		chunkFilePath := filepath.Join(dataDir, chunk.ChunkName)
+		chunkFilePath := n.path(dataDir, chunk.ChunkName)
+
+		// Chunks in /shared can be shared by several transfers, so only the last reference deletes the file
+		if dataDir == dataFolder && n.refs.removeOnce(chunk.ChunkName, request.TransferID) > 0 {
+			continue
+		}
 
 		// Check if file exists before removal
 		if _, err := os.Stat(chunkFilePath); os.IsNotExist(err) {
@@ -492,6 +596,9 @@ func (n *Node) RemoveChunksLocal(request Message, reply *Message) error {
 		}
 
 		err := os.Remove(chunkFilePath)
+		if dataDir == dataFolder {
+			n.forgetDigest(chunk.ChunkName)
+		}
 		if err != nil {
 			//commenting this out for now since, this message will be printed out when the target node is down during assembly
 			//fmt.Printf("Error deleting chunk file %s: %v\n", chunk.ChunkName, err)
@@ -501,11 +608,15 @@ func (n *Node) RemoveChunksLocal(request Message, reply *Message) error {
 	return nil
 }
 
-// RemoveChunksRemotely handles the RPC call to remove chunks from the target node or other nodes that hold individual chunks
+// removeChunksRemotely removes the chunks of a transfer from one of this node's /local and /assemble folders.
+// Chunks in /shared are released with releaseChunks.
 func (n *Node) removeChunksRemotely(dataDir string, chunkInfo []ChunkInfo) error {
 	if len(chunkInfo) == 0 {
 		return fmt.Errorf("no chunks provided for removal")
 	}
+	if dataDir == dataFolder {
+		return fmt.Errorf("chunks in %s are released with releaseChunks", dataFolder)
+	}
 
 	message := Message{
 		DataDir: dataDir,
@@ -513,18 +624,28 @@ func (n *Node) removeChunksRemotely(dataDir string, chunkInfo []ChunkInfo) error
 			Chunks: chunkInfo,
 		},
 	}
+	_, err := n.CallRPCMethod(n.IP, "Node.RemoveChunksLocal", message)
+	if err != nil {
+		return fmt.Errorf("failed to remove chunks from successor: %v", err)
+	}
+	return nil
+}
 
-	// removing chunks in /local and /assemble folders
-	if dataDir != dataFolder {
-		_, err := CallRPCMethod(n.IP, "Node.RemoveChunksLocal", message)
-		if err != nil {
-			return fmt.Errorf("failed to remove chunks from successor: %v", err)
-		}
-		return nil
+// releaseChunks drops the references transfer transferID holds to chunks in /shared on every holder. A
+// transfer holds one reference to each chunk however often the chunk occurs in its file, so each chunk is
+// released once.
+func (n *Node) releaseChunks(transferID string, chunkInfo []ChunkInfo) error {
+	if len(chunkInfo) == 0 {
+		return fmt.Errorf("no chunks provided for removal")
 	}
 
-	// removing remote /shared folders
+	released := make(map[string]bool)
 	for _, v := range chunkInfo {
+		if released[v.ChunkName] {
+			continue
+		}
+		released[v.ChunkName] = true
+
 		var reply Message
 		err := n.FindSuccessor(Message{ID: v.Key}, &reply)
 		if err != nil {
@@ -532,20 +653,27 @@ func (n *Node) removeChunksRemotely(dataDir string, chunkInfo []ChunkInfo) error
 			continue
 		}
 		// Get the successor list of the node
-		successorReply, err := CallRPCMethod(reply.IP, "Node.GetSuccessorList", Message{})
+		successorReply, err := n.CallRPCMethod(reply.IP, "Node.GetSuccessorList", Message{})
 		if err != nil {
 			fmt.Printf("Failed to get successor list: %v\n", err)
 			continue
 		}
 		successorList := successorReply.SuccessorList
-		listToDelete := []Pointer{{ID: reply.ID, IP: reply.IP}}
+		listToDelete := replicaHolders(Pointer{ID: reply.ID, IP: reply.IP}, successorList)
 
-		listToDelete = append(listToDelete, successorList...)
+		// Each holder drops the reference of this transfer to this chunk only
+		message := Message{
+			DataDir:    dataFolder,
+			TransferID: transferID,
+			ChunkTransferParams: ChunkTransferRequest{
+				Chunks: []ChunkInfo{v},
+			},
+		}
 		for _, successor := range listToDelete {
-			_, err := CallRPCMethod(successor.IP, "Node.RemoveChunksLocal", message)
+			_, err := n.CallRPCMethod(successor.IP, "Node.RemoveChunksLocal", message)
 			if err != nil {
 				//commenting this out for now since, this message will be printed out when the target node is down during assembly
-				//fmt.Printf("Failed to remove chunk %s from node %d: %v\n", v.ChunkName, successor.ID, err)
+				//fmt.Printf("Failed to remove chunk %s from node %s: %v\n", v.ChunkName, successor.ID, err)
 			}
 		}
 	}
@@ -557,23 +685,39 @@ func (n *Node) removeChunksRemotely(dataDir string, chunkInfo []ChunkInfo) error
 func (n *Node) CheckPredecessor() {
 	for {
 		time.Sleep(timeInterval * time.Second)
-		if n.Predecessor != (Pointer{}) {
-			// Try to ping the predecessor
-			_, err := CallRPCMethod(n.Predecessor.IP, "Node.Ping", Message{})
-			if err != nil {
-				// fmt.Printf("[NODE-%d] Predecessor (Node-%d) appears to be down: %v\n", n.ID, n.Predecessor.ID, err)
+		n.checkPredecessor()
+	}
+}
 
-				// Clear predecessor pointer
-				n.Lock.Lock()
-				n.Predecessor = Pointer{}
-				n.Lock.Unlock()
+// checkPredecessor runs one round of CheckPredecessor
+func (n *Node) checkPredecessor() {
+	predecessor := n.Routing().Predecessor
+	if predecessor != (Pointer{}) {
+		// Try to ping the predecessor
+		_, err := n.CallRPCMethod(predecessor.IP, "Node.Ping", Message{})
+		if err != nil {
+			// fmt.Printf("[NODE-%s] Predecessor (Node-%s) appears to be down: %v\n", n.ID, predecessor.ID, err)
 
-				fmt.Printf("[NODE-%d] Predecessor appears to be down. Predecessor pointer cleared\n", n.ID)
-			}
+			// Clear predecessor pointer, unless a new predecessor notified us in the meantime
+			n.updateRouting(func(s *RoutingState) {
+				if s.Predecessor == predecessor {
+					s.Predecessor = Pointer{}
+				}
+			})
+
+			fmt.Printf("[NODE-%s] Predecessor appears to be down. Predecessor pointer cleared\n", n.ID)
 		}
 	}
 }
 
+// checkRingWidth rejects peers configured with a different identifier space, since their IDs can't be compared with ours
+func checkRingWidth(message Message) error {
+	if message.RingBits != utils.M {
+		return fmt.Errorf("ring width mismatch: peer %s uses %d-bit IDs, this ring uses %d-bit IDs", message.IP, message.RingBits, utils.M)
+	}
+	return nil
+}
+
 func (n *Node) Ping(message Message, reply *Message) error {
 	*reply = Message{
 		ID: n.ID,
@@ -582,14 +726,15 @@ func (n *Node) Ping(message Message, reply *Message) error {
 	return nil
 }
 
-func getAllNodes(n *Node) ([]Pointer, error) {
+// GetAllNodes walks the ring from n through the successors and returns every node on it
+func GetAllNodes(n *Node) ([]Pointer, error) {
 	nodes := []Pointer{}
-	visited := make(map[int]bool)
+	visited := make(map[utils.ID]bool)
 	currentID := n.ID
 	currentIP := n.IP
 	nodes = append(nodes, Pointer{ID: currentID, IP: currentIP})
 	visited[currentID] = true
-	currentSuccessor := n.Successor
+	currentSuccessor := n.Routing().Successor
 
 	for {
 		if currentSuccessor.ID == n.ID {
@@ -601,13 +746,10 @@ func getAllNodes(n *Node) ([]Pointer, error) {
 			break
 		}
 
-		client, err := rpc.Dial("tcp", currentSuccessor.IP)
-		if err != nil {
-			return nil, err
-		}
 		var successorInfo NodeInfo
-		err = client.Call("Node.GetNodeInfo", struct{}{}, &successorInfo)
-		client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), n.rpcTimeout("Node.GetNodeInfo"))
+		err := n.transport().Call(ctx, currentSuccessor.IP, "Node.GetNodeInfo", struct{}{}, &successorInfo)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
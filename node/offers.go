@@ -0,0 +1,249 @@
+package node
+
+import (
+	"distributed-chord/utils"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOfferTTL     = 60 * time.Second // How long an offer waits for an answer when OFFER_TTL is not set
+	offerPollInterval   = 2 * time.Second  // How often the sender asks whether its offer was answered
+	offerPollMaxFailure = 3                // Failed polls in a row before the sender gives up
+
+	// How long an answer is kept after the offer's expiry, for the sender to collect it
+	answeredOfferTTL = 2 * offerPollMaxFailure * offerPollInterval
+)
+
+// TransferOffer is a file the sender wants to transfer, waiting for the receiver to accept or reject it
+type TransferOffer struct {
+	TransferID string
+	SenderID   utils.ID
+	SenderIP   string
+	FileName   string
+	FileSize   int64
+	Expires    time.Time
+	Decision   string // PENDING, CONFIRM or REJECT
+}
+
+// ConsentPolicy answers offers without asking the user
+type ConsentPolicy struct {
+	TrustedIDs  []utils.ID    // Offers from these nodes are accepted right away
+	MaxFileSize int64         // Offers of larger files are rejected right away, 0 for no limit
+	OfferTTL    time.Duration // How long an offer waits for an answer before it expires
+}
+
+// offerQueue holds the offers this node received, until they expire
+type offerQueue struct {
+	mu     sync.Mutex
+	offers map[string]*TransferOffer
+}
+
+// LoadConsentPolicy reads the consent policy from TRUSTED_NODES (comma-separated node IDs), MAX_OFFER_SIZE
+// (bytes) and OFFER_TTL (seconds)
+func LoadConsentPolicy() (ConsentPolicy, error) {
+	policy := ConsentPolicy{OfferTTL: defaultOfferTTL}
+
+	for _, field := range strings.Split(os.Getenv("TRUSTED_NODES"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := utils.ParseID(field)
+		if err != nil {
+			return policy, fmt.Errorf("invalid TRUSTED_NODES entry: %v", err)
+		}
+		policy.TrustedIDs = append(policy.TrustedIDs, id)
+	}
+
+	if value := os.Getenv("MAX_OFFER_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return policy, fmt.Errorf("invalid MAX_OFFER_SIZE %q: must be a number of bytes", value)
+		}
+		policy.MaxFileSize = size
+	}
+
+	if value := os.Getenv("OFFER_TTL"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 1 {
+			return policy, fmt.Errorf("invalid OFFER_TTL %q: must be a positive number of seconds", value)
+		}
+		policy.OfferTTL = time.Duration(seconds) * time.Second
+	}
+	return policy, nil
+}
+
+// decide returns the decision the policy takes on an offer, or PENDING when the user has to answer it
+func (p ConsentPolicy) decide(offer *TransferOffer) string {
+	if p.MaxFileSize > 0 && offer.FileSize > p.MaxFileSize {
+		return REJECT
+	}
+	for _, id := range p.TrustedIDs {
+		if id == offer.SenderID {
+			return CONFIRM
+		}
+	}
+	return PENDING
+}
+
+// expire drops the offers nobody answered in time. The caller holds mu.
+func (q *offerQueue) expire(now time.Time) {
+	for id, offer := range q.offers {
+		if offer.Decision == PENDING && now.After(offer.Expires) {
+			fmt.Printf("Transfer offer %s for %s expired\n", id, offer.FileName)
+			delete(q.offers, id)
+		} else if offer.Decision != PENDING && now.After(offer.Expires.Add(answeredOfferTTL)) {
+			delete(q.offers, id) // The sender had time to collect the answer
+		}
+	}
+}
+
+// ConfirmFileTransfer queues an incoming offer and returns right away. The reply is CONFIRM or REJECT when
+// the consent policy answers the offer, and PENDING otherwise, in which case the sender polls
+// GetOfferDecision until the user answers with DecideOffer or the offer expires.
+func (n *Node) ConfirmFileTransfer(request Message, reply *Message) error {
+	fmt.Printf("Received file transfer request from %s for file %s\n", request.IP, request.FileName)
+	if request.TransferID == "" {
+		return fmt.Errorf("transfer offer without a transfer ID")
+	}
+
+	policy := n.Consent
+	if policy.OfferTTL <= 0 {
+		policy.OfferTTL = defaultOfferTTL
+	}
+	offer := &TransferOffer{
+		TransferID: request.TransferID,
+		SenderID:   request.ID,
+		SenderIP:   request.IP,
+		FileName:   request.FileName,
+		FileSize:   request.FileSize,
+		Expires:    time.Now().Add(policy.OfferTTL),
+	}
+	offer.Decision = policy.decide(offer)
+
+	n.offers.mu.Lock()
+	if n.offers.offers == nil {
+		n.offers.offers = make(map[string]*TransferOffer)
+	}
+	n.offers.expire(time.Now())
+	n.offers.offers[offer.TransferID] = offer
+	n.offers.mu.Unlock()
+
+	switch offer.Decision {
+	case CONFIRM:
+		fmt.Printf("Accepted transfer %s from trusted node %s\n", offer.TransferID, offer.SenderID)
+		go n.handleReceiverTimeout(offer.SenderIP)
+	case REJECT:
+		fmt.Printf("Rejected transfer %s: %d bytes is over the %d byte limit\n", offer.TransferID, offer.FileSize, policy.MaxFileSize)
+	default:
+		fmt.Printf("Transfer offer %s from node %s: %s (%d bytes). Choose option 10 to accept or reject it within %v\n",
+			offer.TransferID, offer.SenderID, offer.FileName, offer.FileSize, policy.OfferTTL)
+	}
+	*reply = Message{Type: offer.Decision, TransferID: offer.TransferID}
+	return nil
+}
+
+// GetOfferDecision tells the sender of an offer whether it was answered. Offers that expired or are unknown
+// are reported as EXPIRED.
+func (n *Node) GetOfferDecision(request Message, reply *Message) error {
+	n.offers.mu.Lock()
+	defer n.offers.mu.Unlock()
+	n.offers.expire(time.Now())
+
+	decision := EXPIRED
+	if offer, ok := n.offers.offers[request.TransferID]; ok {
+		decision = offer.Decision
+	}
+	*reply = Message{Type: decision, TransferID: request.TransferID}
+	return nil
+}
+
+// PendingOffers returns the offers waiting for an answer, oldest first
+func (n *Node) PendingOffers() []TransferOffer {
+	n.offers.mu.Lock()
+	defer n.offers.mu.Unlock()
+	n.offers.expire(time.Now())
+
+	pending := []TransferOffer{}
+	for _, offer := range n.offers.offers {
+		if offer.Decision == PENDING {
+			pending = append(pending, *offer)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Expires.Before(pending[j].Expires) })
+	return pending
+}
+
+// AnswerOffer accepts or rejects a pending offer
+func (n *Node) AnswerOffer(transferID string, accept bool) error {
+	n.offers.mu.Lock()
+	n.offers.expire(time.Now())
+	offer, ok := n.offers.offers[transferID]
+	if !ok {
+		n.offers.mu.Unlock()
+		return fmt.Errorf("no pending offer %s (it may have expired)", transferID)
+	}
+	if offer.Decision != PENDING {
+		n.offers.mu.Unlock()
+		return fmt.Errorf("offer %s was already answered", transferID)
+	}
+	offer.Decision = REJECT
+	if accept {
+		offer.Decision = CONFIRM
+	}
+	offer.Expires = time.Now() // The answer is kept answeredOfferTTL longer for the sender to collect
+	senderIP := offer.SenderIP
+	n.offers.mu.Unlock()
+
+	if accept {
+		go n.handleReceiverTimeout(senderIP)
+	}
+	return nil
+}
+
+// DecideOffer is the RPC form of AnswerOffer, for answering offers from outside the CLI. message.Type is
+// CONFIRM or REJECT.
+func (n *Node) DecideOffer(message Message, reply *Message) error {
+	if message.Type != CONFIRM && message.Type != REJECT {
+		return fmt.Errorf("invalid decision %q: expected %s or %s", message.Type, CONFIRM, REJECT)
+	}
+	if err := n.AnswerOffer(message.TransferID, message.Type == CONFIRM); err != nil {
+		return err
+	}
+	*reply = Message{Type: message.Type, TransferID: message.TransferID}
+	return nil
+}
+
+// ListOffers is the RPC form of PendingOffers
+func (n *Node) ListOffers(message Message, reply *Message) error {
+	*reply = Message{Offers: n.PendingOffers()}
+	return nil
+}
+
+// awaitOfferDecision polls the target until it answers the offer, and returns CONFIRM, REJECT or EXPIRED
+func (n *Node) awaitOfferDecision(targetNodeIP string, transferID string) string {
+	fmt.Printf("Waiting for the target to accept transfer %s...\n", transferID)
+	failures := 0
+	for {
+		time.Sleep(offerPollInterval)
+		reply, err := n.CallRPCMethod(targetNodeIP, "Node.GetOfferDecision", Message{TransferID: transferID})
+		if err != nil {
+			failures++
+			fmt.Printf("Failed to get the decision on transfer %s: %v\n", transferID, err)
+			if failures >= offerPollMaxFailure {
+				return EXPIRED
+			}
+			continue
+		}
+		failures = 0
+		if reply.Type != PENDING {
+			return reply.Type
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	maxIdleConns        = 4                // Idle connections kept per peer
+	idleConnTimeout     = 60 * time.Second // Idle connections unused for longer are closed
+	healthCheckInterval = 15 * time.Second // How often idle connections are pinged
+	healthCheckTimeout  = 2 * time.Second  // How long the ping of an idle connection may take
+)
+
+// pooledConn is an RPC client on one TCP connection to a peer
+type pooledConn struct {
+	client   *rpc.Client
+	lastUsed time.Time
+	reused   bool // Taken from the pool rather than freshly dialed
+}
+
+// connPool keeps idle connections to the peers of a node, keyed by address, so the ring's frequent small
+// calls don't each pay for a TCP handshake. Connections that break are closed rather than put back, and a
+// background health check pings the idle ones, closing those that don't answer or sat unused too long.
+type connPool struct {
+	mu      sync.Mutex
+	idle    map[string][]*pooledConn
+	checker sync.Once
+}
+
+// get returns an idle connection to addr, or dials a new one. Dialing gives up when ctx ends.
+func (p *connPool) get(ctx context.Context, addr string) (*pooledConn, error) {
+	p.mu.Lock()
+	conns := p.idle[addr]
+	for len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(conn.lastUsed) < idleConnTimeout {
+			p.idle[addr] = conns
+			p.mu.Unlock()
+			conn.reused = true
+			return conn, nil
+		}
+		conn.client.Close()
+	}
+	delete(p.idle, addr)
+	p.mu.Unlock()
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{client: rpc.NewClient(netConn)}, nil
+}
+
+// put returns a healthy connection to the pool, or closes it when the pool for addr is full
+func (p *connPool) put(addr string, conn *pooledConn) {
+	p.checker.Do(func() { go p.healthCheck() })
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[string][]*pooledConn)
+	}
+	if len(p.idle[addr]) >= maxIdleConns {
+		conn.client.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], conn)
+}
+
+// evict closes every idle connection to addr, once a call showed the peer went away
+func (p *connPool) evict(addr string) {
+	p.mu.Lock()
+	conns := p.idle[addr]
+	delete(p.idle, addr)
+	p.mu.Unlock()
+	for _, conn := range conns {
+		conn.client.Close()
+	}
+}
+
+// healthCheck runs for the lifetime of the pool. Each round takes the idle connections out of the pool,
+// pings them without holding the lock, and puts back the ones that answered.
+func (p *connPool) healthCheck() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = make(map[string][]*pooledConn)
+		p.mu.Unlock()
+
+		for addr, conns := range idle {
+			for _, conn := range conns {
+				if time.Since(conn.lastUsed) >= idleConnTimeout || !conn.ping() {
+					conn.client.Close()
+					continue
+				}
+				p.put(addr, conn)
+			}
+		}
+	}
+}
+
+// ping checks that the peer still answers on this connection
+func (c *pooledConn) ping() bool {
+	var reply Message
+	call := c.client.Go("Node.Ping", Message{}, &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error == nil
+	case <-time.After(healthCheckTimeout):
+		return false
+	}
+}
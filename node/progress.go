@@ -0,0 +1,303 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Phases of a transfer. The sender goes through chunking, replicating and locating, the receiver through
+// fetching and assembling, and both end in done, failed or cancelled.
+const (
+	PHASE_CHUNKING    = "chunking"    // Cutting the file into chunks in /local
+	PHASE_REPLICATING = "replicating" // Storing the chunks on their owners and replica holders
+	PHASE_LOCATING    = "locating"    // Handing the chunk locations to the targets, which assemble the file
+	PHASE_FETCHING    = "fetching"    // Downloading the chunks into /assemble
+	PHASE_ASSEMBLING  = "assembling"  // Joining the chunks into the output file
+	PHASE_DONE        = "done"
+	PHASE_FAILED      = "failed"
+	PHASE_CANCELLED   = "cancelled"
+)
+
+// Roles of a node in a transfer
+const (
+	ROLE_SENDER   = "sender"
+	ROLE_RECEIVER = "receiver"
+)
+
+const (
+	progressHistory   = 256              // Events kept for WatchProgress
+	progressRetention = 10 * time.Minute // How long a finished transfer can still be queried
+	progressWatchWait = 10 * time.Second // How long WatchProgress waits for a new event
+)
+
+// TransferProgress is the state of a transfer on one node. Done and total counts are for the current phase.
+type TransferProgress struct {
+	Seq          uint64 // Number of the event that produced this state
+	TransferID   string
+	FileName     string
+	Role         string // ROLE_SENDER or ROLE_RECEIVER
+	Phase        string
+	ChunksDone   int
+	ChunksTotal  int // 0 when not known yet
+	BytesDone    int64
+	BytesTotal   int64         // 0 when not known
+	ETA          time.Duration // Estimated time left in the current phase, 0 when unknown
+	Started      time.Time
+	PhaseStarted time.Time
+	Updated      time.Time
+}
+
+// finished reports whether the transfer reached its final phase
+func (p TransferProgress) finished() bool {
+	return p.Phase == PHASE_DONE || p.Phase == PHASE_FAILED || p.Phase == PHASE_CANCELLED
+}
+
+// estimate sets ETA from the rate of the current phase so far, by bytes when the total is known and by
+// chunks otherwise
+func (p *TransferProgress) estimate() {
+	p.ETA = 0
+	elapsed := p.Updated.Sub(p.PhaseStarted)
+	if p.finished() || elapsed <= 0 {
+		return
+	}
+	if p.BytesTotal > 0 && p.BytesDone > 0 && p.BytesDone < p.BytesTotal {
+		p.ETA = time.Duration(float64(elapsed) * float64(p.BytesTotal-p.BytesDone) / float64(p.BytesDone))
+	} else if p.ChunksTotal > 0 && p.ChunksDone > 0 && p.ChunksDone < p.ChunksTotal {
+		p.ETA = time.Duration(float64(elapsed) * float64(p.ChunksTotal-p.ChunksDone) / float64(p.ChunksDone))
+	}
+}
+
+func (p TransferProgress) String() string {
+	s := fmt.Sprintf("%s %s (%s): %s", p.TransferID, p.FileName, p.Role, p.Phase)
+	if p.finished() {
+		return s
+	}
+	if p.ChunksTotal > 0 {
+		s += fmt.Sprintf(", %d/%d chunks", p.ChunksDone, p.ChunksTotal)
+	} else if p.ChunksDone > 0 {
+		s += fmt.Sprintf(", %d chunks", p.ChunksDone)
+	}
+	if p.BytesTotal > 0 {
+		s += fmt.Sprintf(", %d/%d bytes", p.BytesDone, p.BytesTotal)
+	}
+	if eta := p.ETA.Round(time.Second); eta > 0 {
+		s += fmt.Sprintf(", about %v left", eta)
+	}
+	return s
+}
+
+// progressTracker holds the progress of the transfers on this node and streams every change to subscribers
+type progressTracker struct {
+	mu          sync.Mutex
+	transfers   map[string]*TransferProgress
+	events      []TransferProgress // The most recent events, oldest first
+	seq         uint64
+	subscribers map[chan TransferProgress]bool
+	changed     chan struct{} // Closed and replaced on every event, to wake WatchProgress
+}
+
+// init creates the maps on first use. The caller holds mu.
+func (t *progressTracker) init() {
+	if t.transfers == nil {
+		t.transfers = make(map[string]*TransferProgress)
+		t.subscribers = make(map[chan TransferProgress]bool)
+		t.changed = make(chan struct{})
+	}
+}
+
+// begin starts tracking a transfer. A resumed transfer starts over from its first phase.
+func (t *progressTracker) begin(transferID string, fileName string, role string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	for id, p := range t.transfers {
+		if p.finished() && time.Since(p.Updated) > progressRetention {
+			delete(t.transfers, id)
+		}
+	}
+	now := time.Now()
+	t.transfers[transferID] = &TransferProgress{
+		TransferID:   transferID,
+		FileName:     fileName,
+		Role:         role,
+		Started:      now,
+		PhaseStarted: now,
+	}
+}
+
+// phase moves a transfer to a new phase with the given totals
+func (t *progressTracker) phase(transferID string, phase string, chunksTotal int, bytesTotal int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.transfers[transferID]
+	if !ok {
+		return
+	}
+	p.Phase = phase
+	p.ChunksDone, p.ChunksTotal = 0, chunksTotal
+	p.BytesDone, p.BytesTotal = 0, bytesTotal
+	p.PhaseStarted = time.Now()
+	t.emit(p)
+}
+
+// advance counts chunks and bytes done in the current phase
+func (t *progressTracker) advance(transferID string, chunks int, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.transfers[transferID]
+	if !ok {
+		return
+	}
+	p.ChunksDone += chunks
+	p.BytesDone += bytes
+	t.emit(p)
+}
+
+// finish ends a transfer in PHASE_DONE, PHASE_FAILED or PHASE_CANCELLED
+func (t *progressTracker) finish(transferID string, phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.transfers[transferID]
+	if !ok || p.finished() {
+		return
+	}
+	p.Phase = phase
+	p.PhaseStarted = time.Now()
+	t.emit(p)
+}
+
+// emit records a change as an event and hands it to the subscribers. A subscriber that doesn't keep up
+// misses events rather than slowing the transfer down. The caller holds mu.
+func (t *progressTracker) emit(p *TransferProgress) {
+	t.seq++
+	p.Seq = t.seq
+	p.Updated = time.Now()
+	p.estimate()
+
+	event := *p
+	t.events = append(t.events, event)
+	if len(t.events) > progressHistory {
+		t.events = t.events[len(t.events)-progressHistory:]
+	}
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// SubscribeProgress streams the progress events of every transfer on this node. The returned function
+// stops the stream and closes the channel.
+func (n *Node) SubscribeProgress() (<-chan TransferProgress, func()) {
+	n.progress.mu.Lock()
+	defer n.progress.mu.Unlock()
+	n.progress.init()
+	events := make(chan TransferProgress, progressHistory)
+	n.progress.subscribers[events] = true
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			n.progress.mu.Lock()
+			defer n.progress.mu.Unlock()
+			delete(n.progress.subscribers, events)
+			close(events)
+		})
+	}
+}
+
+// Progress returns the progress of the given transfer, or of every transfer on this node when transferID is
+// empty, oldest first
+func (n *Node) Progress(transferID string) []TransferProgress {
+	n.progress.mu.Lock()
+	defer n.progress.mu.Unlock()
+	result := []TransferProgress{}
+	for id, p := range n.progress.transfers {
+		if transferID == "" || id == transferID {
+			result = append(result, *p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return result
+}
+
+// GetProgress is the RPC form of Progress, so either side of a transfer can follow the other one
+func (n *Node) GetProgress(message Message, reply *Message) error {
+	*reply = Message{Progress: n.Progress(message.TransferID)}
+	return nil
+}
+
+// PeerProgress asks the other participants of a transfer running on this node for their progress, so the
+// sender can follow the receiver and the other way round
+func (n *Node) PeerProgress(transferID string) []TransferProgress {
+	n.transfers.mu.Lock()
+	var peers []string
+	if transfer, ok := n.transfers.active[transferID]; ok {
+		peers = transfer.peers
+	}
+	n.transfers.mu.Unlock()
+
+	result := []TransferProgress{}
+	for _, peer := range peers {
+		reply, err := n.CallRPCMethod(peer, "Node.GetProgress", Message{TransferID: transferID})
+		if err != nil {
+			fmt.Printf("Failed to get the progress of transfer %s from %s: %v\n", transferID, peer, err)
+			continue
+		}
+		result = append(result, reply.Progress...)
+	}
+	return result
+}
+
+// WatchProgress returns the progress events after message.EventSeq, waiting up to progressWatchWait for one
+// when there is none yet. Calling it again with the Seq of the last event received streams the events to
+// another process. Events older than the last progressHistory are dropped, so a caller that falls behind
+// should call GetProgress to catch up.
+func (n *Node) WatchProgress(message Message, reply *Message) error {
+	deadline := time.After(progressWatchWait)
+	for {
+		n.progress.mu.Lock()
+		n.progress.init()
+		events := []TransferProgress{}
+		for _, event := range n.progress.events {
+			if event.Seq > message.EventSeq && (message.TransferID == "" || event.TransferID == message.TransferID) {
+				events = append(events, event)
+			}
+		}
+		changed := n.progress.changed
+		n.progress.mu.Unlock()
+
+		if len(events) > 0 {
+			*reply = Message{Progress: events}
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			*reply = Message{Progress: events}
+			return nil
+		}
+	}
+}
+
+// LogProgress prints every progress event, for nodes run with PROGRESS_LOG set
+func (n *Node) LogProgress() {
+	events, _ := n.SubscribeProgress()
+	for event := range events {
+		fmt.Printf("[NODE-%s] Transfer %s\n", n.ID, event)
+	}
+}
+
+// fileSize returns the size of the file at path, or 0 when it can't be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
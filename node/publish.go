@@ -0,0 +1,215 @@
+package node
+
+import (
+	"context"
+	"distributed-chord/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestExt = ".manifest"
+
+// FileManifest describes a published file. It is stored like a chunk under Hash(FileName), on the owner of
+// that key and its successor list, and lists the chunks in file order.
+type FileManifest struct {
+	FileName   string
+	FileSize   int64
+	FileDigest string
+	Chunks     []ChunkInfo
+	TransferID string // Publish that holds the references to the chunks, released when the file is published again
+	Erasure    ErasureParams
+	Publisher  utils.ID
+	Published  time.Time
+}
+
+// manifestChunkName is the name the manifest of fileName is stored under
+func manifestChunkName(fileName string) string {
+	return fileName + manifestExt
+}
+
+func isManifest(chunkName string) bool {
+	return strings.HasSuffix(chunkName, manifestExt)
+}
+
+// manifestFileName returns the name of the file a manifest describes
+func manifestFileName(chunkName string) string {
+	return strings.TrimSuffix(chunkName, manifestExt)
+}
+
+// checkPublishName rejects names that can't be stored as a manifest in /shared
+func checkPublishName(fileName string) error {
+	if fileName == "" || fileName != filepath.Base(fileName) || strings.HasPrefix(fileName, ".") {
+		return fmt.Errorf("invalid file name %q: must be a plain file name not starting with a dot", fileName)
+	}
+	return nil
+}
+
+// Publish cuts a file from /local into the ring and stores its manifest under the file name, so any node can
+// fetch it with FetchFile. Publishing a name again replaces the previous version. Like a transfer, a publish
+// is journaled and can be resumed with ResumeSend.
+func (n *Node) Publish(fileName string, options TransferOptions) error {
+	if err := checkPublishName(fileName); err != nil {
+		return err
+	}
+	journal := &sendJournal{
+		root:       n.root,
+		TransferID: newTransferID(),
+		FileName:   fileName,
+		Options:    options,
+		Publish:    true,
+	}
+	n.StartReq = time.Now()
+	ctx, err := n.beginTransfer(journal.TransferID)
+	if err != nil {
+		return err
+	}
+	defer n.transfers.end(journal.TransferID)
+	if chunks := n.Chunker(ctx, journal); len(chunks) == 0 {
+		return fmt.Errorf("publishing %s did not complete", fileName)
+	}
+	fmt.Printf("Published %s. Any node can now fetch it by name.\n", fileName)
+	return nil
+}
+
+// publishManifest stores the manifest of a journaled publish on the owner of Hash(fileName) and its successor
+// list, then releases the chunks of the version it replaces
+func (n *Node) publishManifest(ctx context.Context, journal *sendJournal) error {
+	fileInfo, err := os.Stat(n.path(localFolder, journal.FileName))
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", journal.FileName, err)
+	}
+	manifest := FileManifest{
+		FileName:   journal.FileName,
+		FileSize:   fileInfo.Size(),
+		FileDigest: journal.FileDigest,
+		Chunks:     journal.Chunks,
+		TransferID: journal.TransferID,
+		Erasure:    journal.Erasure,
+		Publisher:  n.ID,
+		Published:  time.Now(),
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	// Look up the version being replaced first, its chunks are released once the new manifest is in place
+	previous, previousErr := n.fetchManifest(ctx, journal.FileName)
+
+	if err := n.storeRecord(ctx, manifestChunkName(journal.FileName), data); err != nil {
+		return fmt.Errorf("failed to store the manifest: %v", err)
+	}
+
+	if previousErr == nil && len(previous.Chunks) > 0 {
+		fmt.Printf("Releasing the chunks of the previous version of %s\n", journal.FileName)
+		n.releaseChunks(previous.TransferID, previous.Chunks)
+	}
+	// The entry of a file published again by the same node is replaced, the one of another publisher removed
+	if previousErr == nil && previous.Publisher != n.ID {
+		n.removeFromCatalog(previous.FileName, previous.Publisher, CATALOG_PUBLISHED)
+	}
+	n.addToCatalog(ctx, manifest.FileName, manifest.FileSize, CATALOG_PUBLISHED)
+	return nil
+}
+
+// storeRecord stores a small record such as a manifest on the owner of its key and its successor list. It is
+// sent as a replica with a single reference, so storing a record again replaces it.
+func (n *Node) storeRecord(ctx context.Context, recordName string, data []byte) error {
+	recordPath := n.path(localFolder, recordName)
+	if err := os.WriteFile(recordPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", recordName, err)
+	}
+	defer os.Remove(recordPath)
+
+	var reply Message
+	if err := n.FindSuccessor(Message{ID: chunkKey(recordName)}, &reply); err != nil {
+		return fmt.Errorf("failed to find the owner of %s: %v", recordName, err)
+	}
+	successorReply, err := n.CallRPCMethodContext(ctx, reply.IP, "Node.GetSuccessorList", Message{})
+	if err != nil {
+		return fmt.Errorf("failed to get successor list: %v", err)
+	}
+
+	request := Message{
+		Type: CHUNK_REPLICA,
+		ChunkTransferParams: ChunkTransferRequest{
+			ChunkName: recordName,
+			Digest:    digestBytes(data),
+			RefCount:  1,
+		},
+	}
+	holders := replicaHolders(Pointer{ID: reply.ID, IP: reply.IP}, successorReply.SuccessorList)
+	for i, holder := range holders {
+		err := n.uploadChunk(ctx, holder.IP, recordPath, request)
+		if err != nil {
+			if i == 0 {
+				return fmt.Errorf("failed to store %s on node %s: %v", recordName, holder.ID, err)
+			}
+			fmt.Printf("Failed to store %s on node %s: %v\n", recordName, holder.ID, err)
+		}
+	}
+	return nil
+}
+
+// fetchManifest looks up the manifest of a published file
+func (n *Node) fetchManifest(ctx context.Context, fileName string) (FileManifest, error) {
+	var manifest FileManifest
+	if err := os.MkdirAll(n.path(assembleFolder), 0755); err != nil {
+		return manifest, fmt.Errorf("error creating assemble folder: %v", err)
+	}
+
+	// The manifest's digest isn't known before it is read, so its content is checked by parsing it, and the
+	// file it describes by the chunk and file digests it lists
+	manifestName := manifestChunkName(fileName)
+	manifestPath := n.path(assembleFolder, manifestName)
+	chunk := ChunkInfo{Key: chunkKey(manifestName), ChunkName: manifestName}
+	if err := n.fetchChunk(ctx, chunk, manifestPath); err != nil {
+		return manifest, fmt.Errorf("file %s is not published: %v", fileName, err)
+	}
+	defer os.Remove(manifestPath)
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.FileName != fileName {
+		return manifest, fmt.Errorf("the manifest of %s is corrupted", fileName)
+	}
+	return manifest, nil
+}
+
+// FetchFile rebuilds a published file into the output folder, from its manifest and chunks. Unlike a
+// transfer, the chunks stay in the ring afterwards so other nodes can fetch the file too.
+func (n *Node) FetchFile(fileName string) error {
+	if err := checkPublishName(fileName); err != nil {
+		return err
+	}
+	transferID := newTransferID()
+	ctx, err := n.beginTransfer(transferID)
+	if err != nil {
+		return err
+	}
+	defer n.transfers.end(transferID)
+	manifest, err := n.fetchManifest(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Fetching %s (%d bytes in %d chunks, published by node %s)\n", fileName, manifest.FileSize, len(manifest.Chunks), manifest.Publisher)
+
+	return n.assemble(ctx, Message{
+		Type:       FILE_FETCH,
+		ID:         manifest.Publisher,
+		FileName:   manifest.FileName,
+		FileSize:   manifest.FileSize,
+		TransferID: transferID,
+		ChunkTransferParams: ChunkTransferRequest{
+			Chunks:     manifest.Chunks,
+			FileDigest: manifest.FileDigest,
+			Erasure:    manifest.Erasure,
+		},
+	})
+}
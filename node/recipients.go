@@ -0,0 +1,326 @@
+package node
+
+import (
+	"context"
+	"distributed-chord/utils"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long the sender of a multi-recipient transfer waits for the targets that got the chunk list to report
+// back with AssemblerComplete, before it removes the chunks from the ring anyway
+const recipientTimeout = 60 * time.Second
+
+// States of a recipient of a multi-recipient transfer
+const (
+	RECIPIENT_UNREACHABLE = "UNREACHABLE" // The target could not be found or offered the file
+	RECIPIENT_REJECTED    = "REJECTED"    // The target declined the offer
+	RECIPIENT_EXPIRED     = "EXPIRED"     // The target did not answer the offer in time
+	RECIPIENT_ACCEPTED    = "ACCEPTED"    // The target accepted, the chunk list was not handed over yet
+	RECIPIENT_ASSEMBLING  = "ASSEMBLING"  // The target has the chunk list and is assembling the file
+	RECIPIENT_COMPLETE    = "COMPLETE"    // The target assembled the file and called AssemblerComplete
+	RECIPIENT_FAILED      = "FAILED"      // The target could not be given the chunk list or failed to assemble
+	RECIPIENT_TIMEOUT     = "TIMEOUT"     // The target did not report back in time
+	RECIPIENT_CANCELLED   = "CANCELLED"   // The target cancelled its part of the transfer
+)
+
+// RecipientStatus is the outcome of a multi-recipient transfer for one target
+type RecipientStatus struct {
+	TargetID utils.ID
+	TargetIP string
+	State    string
+	Err      string
+}
+
+// multiTransfer tracks the recipients of one multi-recipient transfer on the sender
+type multiTransfer struct {
+	journal    *sendJournal
+	recipients []RecipientStatus
+	done       chan struct{} // Closed once no recipient is assembling anymore
+}
+
+// recipientTracker holds the multi-recipient transfers this node is sending, so AssemblerComplete can tick
+// the recipients off
+type recipientTracker struct {
+	mu        sync.Mutex
+	transfers map[string]*multiTransfer
+}
+
+// start registers a transfer with the status of every recipient, replacing an earlier registration
+func (t *recipientTracker) start(transferID string, journal *sendJournal, recipients []RecipientStatus) *multiTransfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.transfers == nil {
+		t.transfers = make(map[string]*multiTransfer)
+	}
+	transfer := &multiTransfer{journal: journal, recipients: recipients, done: make(chan struct{})}
+	t.transfers[transferID] = transfer
+	return transfer
+}
+
+func (t *recipientTracker) get(transferID string) *multiTransfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.transfers[transferID]
+}
+
+// set changes the state of a recipient. A recipient that cancelled stays cancelled. The caller holds mu.
+func (m *multiTransfer) set(i int, state string, err error) {
+	if m.recipients[i].State == RECIPIENT_CANCELLED {
+		return
+	}
+	m.recipients[i].State = state
+	m.recipients[i].Err = ""
+	if err != nil {
+		m.recipients[i].Err = err.Error()
+	}
+	for _, recipient := range m.recipients {
+		if recipient.State == RECIPIENT_ASSEMBLING {
+			return
+		}
+	}
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+}
+
+// hasTarget reports whether the node with the given ID and IP is a target of the transfer
+func (m *multiTransfer) hasTarget(id utils.ID, ip string) bool {
+	for _, target := range m.journal.Targets {
+		if target.ID == id && target.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// update changes the state of the recipient with the given ID
+func (t *recipientTracker) update(transferID string, targetID utils.ID, state string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transfer, ok := t.transfers[transferID]
+	if !ok {
+		return
+	}
+	for i, recipient := range transfer.recipients {
+		if recipient.TargetID == targetID {
+			transfer.set(i, state, err)
+		}
+	}
+}
+
+// complete records that a recipient assembled the file. It reports false when transferID is not a
+// multi-recipient transfer this node is sending.
+func (t *recipientTracker) complete(transferID string, targetID utils.ID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transfer, ok := t.transfers[transferID]
+	if !ok {
+		return false
+	}
+	for i, recipient := range transfer.recipients {
+		if recipient.TargetID != targetID {
+			continue
+		}
+		transfer.set(i, RECIPIENT_COMPLETE, nil)
+		for j, target := range transfer.journal.Targets {
+			if target.ID == targetID {
+				transfer.journal.markTargetCompleted(j)
+			}
+		}
+	}
+	return true
+}
+
+// finish unregisters a transfer and returns the final status of its recipients. Recipients still assembling
+// are reported as timed out.
+func (t *recipientTracker) finish(transferID string) []RecipientStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transfer, ok := t.transfers[transferID]
+	if !ok {
+		return nil
+	}
+	delete(t.transfers, transferID)
+	for i, recipient := range transfer.recipients {
+		if recipient.State == RECIPIENT_ASSEMBLING {
+			transfer.recipients[i].State = RECIPIENT_TIMEOUT
+		}
+	}
+	return transfer.recipients
+}
+
+// RequestMultiTransfer sends one file to several nodes. Every target is offered the file, and the file is
+// chunked and stored in the ring once for all the targets that accept. The chunk list is then handed to each
+// of them, and the chunks are removed from the ring once every target assembled the file or timed out. It
+// returns the status of every target.
+func (n *Node) RequestMultiTransfer(targetNodeIDs []utils.ID, fileName string, options TransferOptions) ([]RecipientStatus, error) {
+	fileInfo, err := os.Stat(n.path(localFolder, fileName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot offer file %s: %v", fileName, err)
+	}
+	request := Message{
+		ID:         n.ID,
+		IP:         n.IP,
+		FileName:   fileName,
+		FileSize:   fileInfo.Size(),
+		TransferID: newTransferID(),
+	}
+
+	recipients := []RecipientStatus{}
+	seen := make(map[utils.ID]bool)
+	for _, id := range targetNodeIDs {
+		if !seen[id] {
+			seen[id] = true
+			recipients = append(recipients, RecipientStatus{TargetID: id})
+		}
+	}
+
+	// Every target is offered the file at the same time, since each may wait for its user to answer
+	var wg sync.WaitGroup
+	for i := range recipients {
+		wg.Add(1)
+		go func(recipient *RecipientStatus) {
+			defer wg.Done()
+			recipient.State = RECIPIENT_UNREACHABLE
+			targetNodeIP, err := n.locateTarget(recipient.TargetID)
+			if err != nil {
+				recipient.Err = err.Error()
+				return
+			}
+			recipient.TargetIP = targetNodeIP
+			if targetNodeIP == n.IP {
+				recipient.Err = "cannot send file to the same node"
+				return
+			}
+			decision, err := n.offerTransfer(recipient.TargetID, targetNodeIP, request)
+			switch {
+			case err != nil:
+				recipient.Err = err.Error()
+			case decision == CONFIRM:
+				recipient.State = RECIPIENT_ACCEPTED
+			case decision == EXPIRED:
+				recipient.State = RECIPIENT_EXPIRED
+			default:
+				recipient.State = RECIPIENT_REJECTED
+			}
+		}(&recipients[i])
+	}
+	wg.Wait()
+
+	targets := []Pointer{}
+	for _, recipient := range recipients {
+		if recipient.State == RECIPIENT_ACCEPTED {
+			targets = append(targets, Pointer{ID: recipient.TargetID, IP: recipient.TargetIP})
+		}
+	}
+	if len(targets) == 0 {
+		printRecipientReport(recipients)
+		return recipients, nil
+	}
+
+	fmt.Printf("\n%d of %d targets accepted the file transfer. Initiating transfer...\n", len(targets), len(recipients))
+	n.StartReq = time.Now()
+	journal := &sendJournal{
+		root:       n.root,
+		TransferID: request.TransferID,
+		FileName:   fileName,
+		Targets:    targets,
+		Options:    options,
+	}
+	ctx, err := n.beginTransfer(journal.TransferID, journal.peers()...)
+	if err != nil {
+		return recipients, err
+	}
+	n.recipients.start(journal.TransferID, journal, recipients)
+	n.Chunker(ctx, journal)
+	n.transfers.end(journal.TransferID)
+
+	recipients = n.recipients.finish(journal.TransferID)
+	printRecipientReport(recipients)
+	return recipients, nil
+}
+
+// sendToTargets hands the chunk list of a multi-recipient transfer to every target that hasn't assembled the
+// file yet, waits until they all report back or time out, then removes the chunks from the ring. When no
+// target could be given the chunk list it returns false and leaves the chunks in place, so the transfer can
+// be resumed from its journal. It also returns false once ctx is cancelled.
+func (n *Node) sendToTargets(ctx context.Context, journal *sendJournal, message Message) bool {
+	transfer := n.recipients.get(journal.TransferID)
+	if transfer == nil {
+		// The transfer is being resumed, only the targets that accepted it are left
+		recipients := make([]RecipientStatus, len(journal.Targets))
+		for i, target := range journal.Targets {
+			recipients[i] = RecipientStatus{TargetID: target.ID, TargetIP: target.IP, State: RECIPIENT_ACCEPTED}
+			if journal.targetCompleted(i) {
+				recipients[i].State = RECIPIENT_COMPLETE
+			}
+		}
+		transfer = n.recipients.start(journal.TransferID, journal, recipients)
+	}
+
+	pending := []Pointer{}
+	for i, target := range journal.Targets {
+		if !journal.targetCompleted(i) {
+			pending = append(pending, target)
+			n.recipients.update(journal.TransferID, target.ID, RECIPIENT_ASSEMBLING, nil)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	delivered := len(journal.Targets) - len(pending)
+	for _, target := range pending {
+		wg.Add(1)
+		go func(target Pointer) {
+			defer wg.Done()
+			fmt.Printf("Sending chunk info to target node %s at %s\n", target.ID, target.IP)
+			if err := n.handChunkLocations(ctx, target.IP, message); err != nil {
+				n.recipients.update(journal.TransferID, target.ID, RECIPIENT_FAILED, err)
+				return
+			}
+			mu.Lock()
+			delivered++
+			mu.Unlock()
+			n.progress.advance(journal.TransferID, 1, 0)
+		}(target)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return false
+	}
+	if delivered == 0 {
+		fmt.Printf("No target of transfer %s could be given the chunk list\n", journal.TransferID)
+		return false
+	}
+	n.removeChunksRemotely(localFolder, message.ChunkTransferParams.Chunks)
+
+	// The targets that timed out on their side may still finish and report back
+	if len(pending) > 0 {
+		select {
+		case <-transfer.done:
+		case <-ctx.Done():
+			return false
+		case <-time.After(recipientTimeout):
+			fmt.Printf("Some targets of transfer %s did not report back within %v\n", journal.TransferID, recipientTimeout)
+		}
+	}
+	n.releaseChunks(journal.TransferID, message.ChunkTransferParams.Chunks)
+	return true
+}
+
+func printRecipientReport(recipients []RecipientStatus) {
+	fmt.Println("\nTransfer status per recipient:")
+	for _, recipient := range recipients {
+		if recipient.Err != "" {
+			fmt.Printf("- Node %s: %s (%s)\n", recipient.TargetID, recipient.State, recipient.Err)
+		} else {
+			fmt.Printf("- Node %s: %s\n", recipient.TargetID, recipient.State)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// refCountFile keeps the reference counts of the chunks in /shared across restarts. It starts with a dot so
+// it is never listed as a chunk.
+const refCountFile = ".refcounts.json"
+
+// refCounter counts how many transfers still need each chunk stored in /shared. Chunks are content-addressed,
+// so the same chunk can be shared by several files or by repeated sends of the same file.
+type refCounter struct {
+	mu        sync.Mutex
+	dir       string // The node's /shared folder
+	counts    map[string]int
+	transfers map[string][]string // Transfers that added a reference to each chunk, see addOnce
+	changes   uint64              // Number of changes to the counts, see generation
+}
+
+// refCountState is what refCountFile holds. Files written before transfers were remembered hold the counts only.
+type refCountState struct {
+	Counts    map[string]int
+	Transfers map[string][]string
+}
+
+// load reads the persisted counts the first time they are needed. The caller holds mu.
+func (c *refCounter) load() {
+	if c.counts != nil {
+		return
+	}
+	c.counts = make(map[string]int)
+	c.transfers = make(map[string][]string)
+	data, err := os.ReadFile(filepath.Join(c.dir, refCountFile))
+	if err != nil {
+		return
+	}
+	var state refCountState
+	if err := json.Unmarshal(data, &state); err == nil && state.Counts != nil {
+		c.counts = state.Counts
+		if state.Transfers != nil {
+			c.transfers = state.Transfers
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &c.counts); err != nil {
+		fmt.Printf("Ignoring unreadable reference counts: %v\n", err)
+		c.counts = make(map[string]int)
+	}
+}
+
+// generation changes whenever a count changes, so caches built from the counts can tell they are stale
+func (c *refCounter) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changes
+}
+
+// save persists the counts. The caller holds mu.
+func (c *refCounter) save() {
+	c.changes++
+	data, err := json.Marshal(refCountState{Counts: c.counts, Transfers: c.transfers})
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, refCountFile), data, 0644); err != nil {
+		fmt.Printf("Failed to save reference counts: %v\n", err)
+	}
+}
+
+// get returns the count of a chunk. A chunk on disk that was never counted has one reference.
+func (c *refCounter) get(chunkName string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	if count, ok := c.counts[chunkName]; ok {
+		return count
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, chunkName)); err == nil {
+		return 1
+	}
+	return 0
+}
+
+// add changes the count of a chunk by delta and returns the new count
+func (c *refCounter) add(chunkName string, delta int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	count, ok := c.counts[chunkName]
+	if !ok && delta < 0 {
+		count = 1 // Uncounted chunk on disk
+	}
+	count += delta
+	c.store(chunkName, count)
+	c.save()
+	return max(count, 0)
+}
+
+// addOnce adds the reference of a transfer to a chunk and returns the new count. A transfer that already
+// added its reference, before it was interrupted and resumed, doesn't add a second one.
+func (c *refCounter) addOnce(chunkName string, transferID string) int {
+	if transferID == "" {
+		return c.add(chunkName, 1)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	if slices.Contains(c.transfers[chunkName], transferID) {
+		return c.counts[chunkName]
+	}
+	c.store(chunkName, c.counts[chunkName]+1)
+	c.transfers[chunkName] = append(c.transfers[chunkName], transferID)
+	c.save()
+	return c.counts[chunkName]
+}
+
+// removeOnce drops the reference of a transfer to a chunk and returns the new count. A transfer whose reference
+// was already dropped, or that never added one, doesn't drop another. A count copied from another holder
+// doesn't list its transfers, so there every call drops one reference.
+func (c *refCounter) removeOnce(chunkName string, transferID string) int {
+	if transferID == "" {
+		return c.add(chunkName, -1)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	transfers := c.transfers[chunkName]
+	i := slices.Index(transfers, transferID)
+	if i < 0 && len(transfers) > 0 {
+		return c.counts[chunkName]
+	}
+	count, ok := c.counts[chunkName]
+	if !ok {
+		count = 1 // Uncounted chunk on disk
+	}
+	if i >= 0 {
+		c.transfers[chunkName] = slices.Delete(transfers, i, i+1)
+		if len(c.transfers[chunkName]) == 0 {
+			delete(c.transfers, chunkName)
+		}
+	}
+	c.store(chunkName, count-1)
+	c.save()
+	return max(count-1, 0)
+}
+
+// store sets the count of a chunk, forgetting the chunk once it has no references left. The caller holds mu.
+func (c *refCounter) store(chunkName string, count int) {
+	if count <= 0 {
+		delete(c.counts, chunkName)
+		delete(c.transfers, chunkName)
+	} else {
+		c.counts[chunkName] = count
+	}
+}
+
+// set overwrites the count of a chunk, used when a replica is copied from another holder
+func (c *refCounter) set(chunkName string, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	c.store(chunkName, count)
+	c.save()
+}
+
+// AddChunkRef records the reference of transfer message.TransferID to a chunk this node already stores, so a
+// sender doesn't have to upload it again. Adding the reference of the same transfer twice has no effect.
+func (n *Node) AddChunkRef(message Message, reply *Message) error {
+	chunkName := message.ChunkTransferParams.ChunkName
+	if _, err := os.Stat(n.path(dataFolder, chunkName)); err != nil {
+		return fmt.Errorf("chunk %s is not stored on this node", chunkName)
+	}
+	refCount := n.refs.addOnce(chunkName, message.TransferID)
+	*reply = Message{ChunkTransferParams: ChunkTransferRequest{ChunkName: chunkName, RefCount: refCount}}
+	return nil
+}
+
+// SetChunkRef overwrites the reference count of a chunk this node already stores. Replica maintenance uses it
+// when only the count of a replica is out of date, so the chunk isn't uploaded again.
+func (n *Node) SetChunkRef(message Message, reply *Message) error {
+	chunkName := message.ChunkTransferParams.ChunkName
+	if _, err := os.Stat(n.path(dataFolder, chunkName)); err != nil {
+		return fmt.Errorf("chunk %s is not stored on this node", chunkName)
+	}
+	n.refs.set(chunkName, max(message.ChunkTransferParams.RefCount, 1))
+	*reply = Message{ChunkTransferParams: ChunkTransferRequest{ChunkName: chunkName, RefCount: n.refs.get(chunkName)}}
+	return nil
+}
@@ -0,0 +1,56 @@
+package node
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRepeatedChunksReleasedOnce(t *testing.T) {
+	c := &refCounter{dir: t.TempDir()}
+	for i := 0; i < 3; i++ {
+		c.addOnce("x.chunk", "first") // The chunk occurs three times in the first file
+	}
+	c.addOnce("x.chunk", "second")
+	for i := 0; i < 3; i++ {
+		c.removeOnce("x.chunk", "first")
+	}
+	if count := c.get("x.chunk"); count != 1 {
+		t.Fatalf("chunk has %d references after the first transfer released it, want 1", count)
+	}
+	c.removeOnce("x.chunk", "second")
+	if count := c.get("x.chunk"); count != 0 {
+		t.Fatalf("chunk has %d references after both transfers released it, want 0", count)
+	}
+	if len(c.transfers) != 0 {
+		t.Fatalf("released transfers are still remembered: %v", c.transfers)
+	}
+}
+
+func TestSharedChunksSurviveRelease(t *testing.T) {
+	block := fileData(64 * 1024)
+	repeated := bytes.Join([][]byte{block, block, block, fileData(64*1024 + 1)}, nil)
+	shared := bytes.Join([][]byte{block, fileData(64*1024 + 2)}, nil)
+
+	s := runScenario(t, Scenario{Name: "ring", Steps: ringSteps("a", "b", "c", "d", "e", "f")})
+	for _, name := range []string{"a", "c"} {
+		s.Node(name).Chunking = FixedChunking{Size: 64 * 1024}
+	}
+
+	steps := []Step{
+		{Action: SIM_WRITE, Node: "a", File: "repeated.bin", Data: repeated},
+		{Action: SIM_WRITE, Node: "c", File: "shared.bin", Data: shared},
+		// While d is about to assemble shared.bin, a sends a file that repeats one of its chunks three times.
+		// Once b assembled it, a releases the chunks that d still needs.
+		{
+			Action: SIM_FAULT, Node: "d", Fault: fault(t, "before-assembly=sleep:1ms"),
+			Steps: []Step{{Action: SIM_TRANSFER, Node: "a", Target: "b", File: "repeated.bin"}},
+		},
+		{Action: SIM_TRANSFER, Node: "c", Target: "d", File: "shared.bin"},
+		{Action: SIM_CHECK, Check: ExpectOutput("b", "a", "repeated.bin", repeated)},
+		{Action: SIM_CHECK, Check: ExpectOutput("d", "c", "shared.bin", shared)},
+		{Action: SIM_CHECK, Check: ExpectChunks(0, 0)},
+	}
+	if err := s.Run(Scenario{Name: "shared chunks survive release", Steps: steps}); err != nil {
+		t.Fatal(err)
+	}
+}
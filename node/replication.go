@@ -0,0 +1,52 @@
+package node
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaintainReplicas periodically makes sure every chunk this node owns is also stored on each node in its
+// successor list, so the replication factor goes back to r after nodes fail.
+func (n *Node) MaintainReplicas() {
+	for {
+		time.Sleep(timeInterval * 3 * time.Second)
+		n.repairReplicas()
+	}
+}
+
+// repairReplicas pushes the owned chunks each successor is missing
+func (n *Node) repairReplicas() {
+	routing := n.Routing()
+	predecessor := routing.Predecessor
+	successorList := routing.SuccessorList
+
+	if predecessor == (Pointer{}) {
+		// Without a predecessor we don't know which keys we own yet
+		return
+	}
+
+	keyRange := KeyRange{Start: predecessor.ID, End: n.ID}
+	tree, err := n.buildMerkleTree(keyRange)
+	if err != nil {
+		fmt.Printf("[NODE-%s] Replica maintenance failed: %v\n", n.ID, err)
+		return
+	}
+
+	seen := map[string]bool{n.IP: true}
+	for _, successor := range successorList {
+		if seen[successor.IP] {
+			continue // Small rings wrap around, so the list can contain this node or repeat nodes
+		}
+		seen[successor.IP] = true
+
+		// Only the sub-ranges whose Merkle hashes differ are compared chunk by chunk
+		repaired, err := n.syncReplica(successor, tree)
+		if err != nil {
+			// The successor list will skip this node once Stabilize notices it is down
+			fmt.Printf("[NODE-%s] Failed to sync replicas with node %s: %v\n", n.ID, successor.ID, err)
+		}
+		if repaired > 0 {
+			fmt.Printf("[NODE-%s] Re-replicated %d chunks to node %s\n", n.ID, repaired, successor.ID)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package node
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RoutingState is a node's view of the ring
+type RoutingState struct {
+	Successor     Pointer
+	Predecessor   Pointer
+	SuccessorList []Pointer
+	FingerTable   []Pointer
+}
+
+func (s RoutingState) clone() RoutingState {
+	s.SuccessorList = append(make([]Pointer, 0, len(s.SuccessorList)), s.SuccessorList...)
+	s.FingerTable = append(make([]Pointer, 0, len(s.FingerTable)), s.FingerTable...)
+	return s
+}
+
+// routingTable holds the routing state of a node as an immutable snapshot that is replaced as a whole on every
+// change (copy-on-write). Readers load the current snapshot without locking. Writers hold mu only while they
+// copy the snapshot, change the copy and swap it in, never across a call to another node.
+type routingTable struct {
+	mu      sync.Mutex
+	current atomic.Pointer[RoutingState]
+}
+
+// Routing returns a consistent snapshot of the node's routing state, which later changes don't affect. The
+// slices in it are shared with other readers and must not be modified.
+func (n *Node) Routing() RoutingState {
+	if s := n.routing.current.Load(); s != nil {
+		return *s
+	}
+	return RoutingState{}
+}
+
+// updateRouting applies change to a copy of the routing state and makes the copy current, returning it.
+// Changes don't interleave, but change runs under the routing lock so it must not call other nodes. Decisions
+// based on an RPC are made on a snapshot first, and change checks that the state they rest on still holds.
+func (n *Node) updateRouting(change func(s *RoutingState)) RoutingState {
+	n.routing.mu.Lock()
+	defer n.routing.mu.Unlock()
+	next := n.Routing().clone()
+	change(&next)
+	n.routing.current.Store(&next)
+	return next
+}
@@ -0,0 +1,60 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"distributed-chord/utils"
+)
+
+// TestConcurrentMaintenance runs stabilize, fixFingers, Notify and lookups on every node at the same time. Run
+// it with -race to check the routing state is only changed through updateRouting.
+func TestConcurrentMaintenance(t *testing.T) {
+	s := newRing(t, 8)
+	names := s.Live()
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		n := s.Node(name)
+		predecessor := s.Node(names[(i+len(names)-1)%len(names)])
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 5; round++ {
+				n.stabilize()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 2; round++ {
+				n.fixFingers()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				var reply Message
+				message := Message{Type: "NOTIFY", ID: predecessor.ID, IP: predecessor.IP, RingBits: utils.M}
+				if err := n.Notify(message, &reply); err != nil {
+					t.Errorf("notify of %s failed: %v", n.IP, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for key := 0; key < 50; key++ {
+				var reply Message
+				if err := n.FindSuccessor(Message{ID: utils.Hash(fmt.Sprintf("key-%d", key))}, &reply); err != nil {
+					t.Errorf("lookup from %s failed: %v", n.IP, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !s.Settle() {
+		t.Fatal("ring did not settle after concurrent maintenance")
+	}
+	checkLookups(t, s, 100)
+}
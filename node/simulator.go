@@ -0,0 +1,395 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many maintenance rounds Settle runs at most before it gives up on the ring settling
+const maxSettleRounds = 64
+
+// Simulation runs a ring of in-process nodes on a MemoryNetwork, each keeping its folders in a directory of
+// its own. Nodes are named, and the name is also their address. Maintenance (stabilize, fix fingers, check
+// predecessor, repair replicas) runs in rounds driven by the simulation instead of on timers, one node at a
+// time in the order they joined, and transfers move one chunk at a time, so a scenario plays out the same
+// way every run.
+type Simulation struct {
+	Network *MemoryNetwork
+	dir     string
+
+	mu      sync.Mutex // Crashes come from the goroutines of the nodes
+	nodes   map[string]*Node
+	names   []string                 // In the order the nodes joined
+	crashed map[string]chan struct{} // Closed when the node crashes
+}
+
+// NewSimulation returns an empty simulation keeping the folders of its nodes under dir. seed drives the
+// latency jitter and message drops of the network.
+func NewSimulation(dir string, seed int64) *Simulation {
+	return &Simulation{
+		Network: NewMemoryNetwork(seed),
+		dir:     dir,
+		nodes:   make(map[string]*Node),
+		crashed: make(map[string]chan struct{}),
+	}
+}
+
+// Node returns the node with the given name, or nil
+func (s *Simulation) Node(name string) *Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodes[name]
+}
+
+// Live returns the names of the nodes that have not crashed, in the order they joined
+func (s *Simulation) Live() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := []string{}
+	for _, name := range s.names {
+		select {
+		case <-s.crashed[name]:
+		default:
+			live = append(live, name)
+		}
+	}
+	return live
+}
+
+// AddNode starts a node and joins it to the ring through the first live node, then lets the ring settle
+func (s *Simulation) AddNode(name string) (*Node, error) {
+	if s.Node(name) != nil {
+		return nil, fmt.Errorf("node %s already exists", name)
+	}
+	n := CreateNodeAt(name, filepath.Join(s.dir, name))
+	n.Transport = s.Network.Transport(name)
+	n.Workers = 1
+	n.faults.crash = func() {
+		s.Crash(name)
+		select {} // The goroutine that reached the fault point freezes with the node, without running its defers
+	}
+	for _, folder := range []string{localFolder, dataFolder, assembleFolder, outputFolder} {
+		if err := os.MkdirAll(n.path(folder), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if live := s.Live(); len(live) > 0 {
+		if err := n.Join(live[0]); err != nil {
+			return nil, err
+		}
+		n.migrations.Wait()
+	}
+	if _, err := s.Network.listen(name, n); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.nodes[name] = n
+	s.names = append(s.names, name)
+	s.crashed[name] = make(chan struct{})
+	s.mu.Unlock()
+	s.Settle()
+	return n, nil
+}
+
+// Crash takes a node off the network. Its folders are left as they were.
+func (s *Simulation) Crash(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	crashed, ok := s.crashed[name]
+	if !ok {
+		return
+	}
+	select {
+	case <-crashed:
+		return
+	default:
+	}
+	fmt.Printf("[SIM] Node %s crashed\n", name)
+	close(crashed)
+	s.Network.Stop(name)
+}
+
+// Round runs one round of maintenance on every live node
+func (s *Simulation) Round() {
+	for _, name := range s.Live() {
+		n := s.Node(name)
+		n.stabilize()
+		n.migrations.Wait()
+		n.checkPredecessor()
+		n.fixFingers()
+		n.repairReplicas()
+	}
+}
+
+// Settle runs rounds until no live node changes its successor, predecessor, successor list or fingers
+// anymore. It reports whether the ring settled within maxSettleRounds.
+func (s *Simulation) Settle() bool {
+	previous := s.routingState()
+	for round := 0; round < maxSettleRounds; round++ {
+		s.Round()
+		state := s.routingState()
+		if state == previous {
+			return true
+		}
+		previous = state
+	}
+	return false
+}
+
+func (s *Simulation) routingState() string {
+	var state bytes.Buffer
+	for _, name := range s.Live() {
+		routing := s.Node(name).Routing()
+		fmt.Fprintf(&state, "%s %v %v %v %v\n", name, routing.Successor, routing.Predecessor, routing.SuccessorList, routing.FingerTable)
+	}
+	return state.String()
+}
+
+// Ring returns the names of the live nodes by walking the successors from the first live node
+func (s *Simulation) Ring() ([]string, error) {
+	live := s.Live()
+	if len(live) == 0 {
+		return nil, nil
+	}
+	nodes, err := GetAllNodes(s.Node(live[0]))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, node := range nodes {
+		names = append(names, node.IP)
+	}
+	return names, nil
+}
+
+// WriteFile puts a file into the /local folder of a node, ready to be sent
+func (s *Simulation) WriteFile(name string, fileName string, data []byte) error {
+	n := s.Node(name)
+	if n == nil {
+		return fmt.Errorf("unknown node %s", name)
+	}
+	return os.WriteFile(n.path(localFolder, fileName), data, 0644)
+}
+
+// Transfer sends a file from the /local folder of one node to another and returns once the sender is done,
+// which includes the target assembling the file. The target accepts the offer without asking. An error means
+// the transfer failed, as reported by the sender's progress, or the sender crashed on the way.
+func (s *Simulation) Transfer(from string, to string, fileName string, options TransferOptions) error {
+	sender, target := s.Node(from), s.Node(to)
+	if sender == nil || target == nil {
+		return fmt.Errorf("unknown node %s or %s", from, to)
+	}
+	target.Consent.TrustedIDs = append(target.Consent.TrustedIDs, sender.ID)
+
+	// The sender runs in a goroutine of its own, since a crash freezes the goroutine that reached the fault point
+	started := len(sender.Progress(""))
+	done := make(chan error, 1)
+	go func() {
+		done <- sender.RequestFileTransfer(target.ID, fileName, options)
+	}()
+	s.mu.Lock()
+	crashed := s.crashed[from]
+	s.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-crashed:
+		return fmt.Errorf("node %s crashed during the transfer", from)
+	}
+
+	transfers := sender.Progress("")
+	if len(transfers) == started {
+		return fmt.Errorf("%s did not start the transfer of %s", from, fileName)
+	}
+	if last := transfers[len(transfers)-1]; last.Phase != PHASE_DONE {
+		return fmt.Errorf("transfer %s of %s ended %s", last.TransferID, fileName, last.Phase)
+	}
+	return nil
+}
+
+// Chunks returns, for every file chunk stored in /shared on a live node, the names of the nodes storing it.
+// Records such as manifests and catalog entries are left out.
+func (s *Simulation) Chunks() map[string][]string {
+	placement := make(map[string][]string)
+	for _, name := range s.Live() {
+		chunks, err := s.Node(name).listSharedChunks()
+		if err != nil {
+			continue
+		}
+		for _, chunk := range chunks {
+			if isManifest(chunk.ChunkName) || strings.HasSuffix(chunk.ChunkName, catalogExt) {
+				continue
+			}
+			placement[chunk.ChunkName] = append(placement[chunk.ChunkName], name)
+		}
+	}
+	return placement
+}
+
+// Output reads the file a node received from another node
+func (s *Simulation) Output(name string, sender string, fileName string) ([]byte, error) {
+	n, from := s.Node(name), s.Node(sender)
+	if n == nil || from == nil {
+		return nil, fmt.Errorf("unknown node %s or %s", name, sender)
+	}
+	outputFileName, err := getFileNames(fileName, from.ID)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(n.path(outputFolder, outputFileName))
+}
+
+// Steps of a scenario
+const (
+	SIM_JOIN     = "join"     // Node joins the ring
+	SIM_CRASH    = "crash"    // Node crashes
+	SIM_SETTLE   = "settle"   // Maintenance runs until the ring settles
+	SIM_WRITE    = "write"    // File with Data is put into the /local folder of Node
+	SIM_FAULT    = "fault"    // Fault is armed on Node, running Steps when it fires
+	SIM_TRANSFER = "transfer" // Node sends File to Target, WantErr tells whether it should fail
+	SIM_CHECK    = "check"    // Check asserts on the state of the simulation
+)
+
+// Step is one action of a scenario
+type Step struct {
+	Action  string
+	Node    string
+	Target  string
+	File    string
+	Data    []byte
+	Options TransferOptions
+	Fault   Fault
+	Steps   []Step // For SIM_FAULT, run when the fault fires, before its Action
+	WantErr bool
+	Check   func(s *Simulation) error
+}
+
+// Scenario is a script of joins, crashes, faults and transfers, with checks on the outcome
+type Scenario struct {
+	Name  string
+	Steps []Step
+}
+
+// Run plays a scenario and returns the first step that failed
+func (s *Simulation) Run(scenario Scenario) error {
+	for i, step := range scenario.Steps {
+		if err := s.step(step); err != nil {
+			return fmt.Errorf("scenario %q, step %d (%s): %v", scenario.Name, i+1, step.Action, err)
+		}
+	}
+	return nil
+}
+
+func (s *Simulation) step(step Step) error {
+	switch step.Action {
+	case SIM_JOIN:
+		_, err := s.AddNode(step.Node)
+		return err
+	case SIM_CRASH:
+		s.Crash(step.Node)
+		return nil
+	case SIM_SETTLE:
+		if !s.Settle() {
+			return fmt.Errorf("ring did not settle within %d rounds", maxSettleRounds)
+		}
+		return nil
+	case SIM_WRITE:
+		return s.WriteFile(step.Node, step.File, step.Data)
+	case SIM_FAULT:
+		return s.armFault(step)
+	case SIM_TRANSFER:
+		err := s.Transfer(step.Node, step.Target, step.File, step.Options)
+		if step.WantErr && err == nil {
+			return fmt.Errorf("transfer of %s succeeded, expected it to fail", step.File)
+		}
+		if !step.WantErr && err != nil {
+			return err
+		}
+		return nil
+	case SIM_CHECK:
+		return step.Check(s)
+	default:
+		return fmt.Errorf("unknown step %q", step.Action)
+	}
+}
+
+// armFault injects the fault of a SIM_FAULT step. Its nested steps run on the goroutine that reached the
+// fault point, then the fault's own action applies.
+func (s *Simulation) armFault(step Step) error {
+	n := s.Node(step.Node)
+	if n == nil {
+		return fmt.Errorf("unknown node %s", step.Node)
+	}
+	fault := step.Fault
+	if len(step.Steps) > 0 {
+		action := fault
+		fault.Do = func() {
+			for _, nested := range step.Steps {
+				if err := s.step(nested); err != nil {
+					fmt.Printf("[SIM] Step %s at fault point %s failed: %v\n", nested.Action, action.Point, err)
+				}
+			}
+			switch action.Action {
+			case FAULT_CRASH:
+				n.faults.crash()
+			case FAULT_SLEEP:
+				time.Sleep(action.Duration)
+			}
+		}
+	}
+	return n.InjectFault(fault)
+}
+
+// ExpectOutput checks that node received fileName from sender with the given content
+func ExpectOutput(node string, sender string, fileName string, data []byte) func(s *Simulation) error {
+	return func(s *Simulation) error {
+		output, err := s.Output(node, sender, fileName)
+		if err != nil {
+			return fmt.Errorf("%s did not receive %s: %v", node, fileName, err)
+		}
+		if !bytes.Equal(output, data) {
+			return fmt.Errorf("%s received a different %s (%d bytes, expected %d)", node, fileName, len(output), len(data))
+		}
+		return nil
+	}
+}
+
+// ExpectNoOutput checks that node did not receive fileName from sender
+func ExpectNoOutput(node string, sender string, fileName string) func(s *Simulation) error {
+	return func(s *Simulation) error {
+		if _, err := s.Output(node, sender, fileName); err == nil {
+			return fmt.Errorf("%s received %s", node, fileName)
+		}
+		return nil
+	}
+}
+
+// ExpectChunks checks that the live nodes store exactly count distinct chunks, each on at least copies nodes
+func ExpectChunks(count int, copies int) func(s *Simulation) error {
+	return func(s *Simulation) error {
+		placement := s.Chunks()
+		if len(placement) != count {
+			return fmt.Errorf("%d chunks stored in the ring, expected %d: %v", len(placement), count, placement)
+		}
+		names := make([]string, 0, len(placement))
+		for chunk := range placement {
+			names = append(names, chunk)
+		}
+		sort.Strings(names)
+		for _, chunk := range names {
+			if len(placement[chunk]) < copies {
+				return fmt.Errorf("chunk %s is stored on %v, expected at least %d nodes", chunk, placement[chunk], copies)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package node
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"distributed-chord/utils"
+)
+
+// fault parses a single fault in the FAULTS syntax
+func fault(t *testing.T, spec string) Fault {
+	t.Helper()
+	faults, err := ParseFaults(spec)
+	if err != nil || len(faults) != 1 {
+		t.Fatalf("invalid fault %q: %v", spec, err)
+	}
+	return faults[0]
+}
+
+// fileData returns size bytes that are the same on every run
+func fileData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// ringSteps joins the named nodes and lets the ring settle
+func ringSteps(names ...string) []Step {
+	steps := []Step{}
+	for _, name := range names {
+		steps = append(steps, Step{Action: SIM_JOIN, Node: name})
+	}
+	return append(steps, Step{Action: SIM_SETTLE})
+}
+
+// setRingBits widens the ring for the test, so node names don't collide, and restores it afterwards
+func setRingBits(t *testing.T) {
+	t.Helper()
+	old := utils.M
+	if err := utils.SetM(32); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.SetM(old) })
+}
+
+func runScenario(t *testing.T, scenario Scenario) *Simulation {
+	t.Helper()
+	setRingBits(t)
+	s := NewSimulation(t.TempDir(), 1)
+	if err := s.Run(scenario); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSenderDiesAfterSecondChunk(t *testing.T) {
+	data := fileData(1600000)
+	steps := append(ringSteps("a", "b", "c", "d", "e", "f"),
+		Step{Action: SIM_WRITE, Node: "a", File: "f.bin", Data: data},
+		Step{Action: SIM_FAULT, Node: "a", Fault: fault(t, "chunk-stored@2=crash")},
+		Step{Action: SIM_TRANSFER, Node: "a", Target: "b", File: "f.bin", WantErr: true},
+		Step{Action: SIM_CHECK, Check: ExpectNoOutput("b", "a", "f.bin")},
+		Step{Action: SIM_CHECK, Check: ExpectChunks(2, 1)},
+	)
+	s := runScenario(t, Scenario{Name: "sender dies after chunk 2", Steps: steps})
+
+	// The first chunk reached its replicas, the second only its owner before the sender died. Chunks counts
+	// live nodes only, so a replica held by the crashed sender is missing from the counts.
+	copies := []int{}
+	for _, holders := range s.Chunks() {
+		copies = append(copies, len(holders))
+	}
+	if min(copies[0], copies[1]) != 1 || max(copies[0], copies[1]) < 2 {
+		t.Fatalf("chunks stored on %v nodes, expected one replicated and one on its owner only", copies)
+	}
+}
+
+func TestTargetSleepsBeforeAssembly(t *testing.T) {
+	data := fileData(1600000)
+	steps := append(ringSteps("a", "b", "c", "d", "e", "f"),
+		Step{Action: SIM_WRITE, Node: "a", File: "f.bin", Data: data},
+		Step{Action: SIM_FAULT, Node: "b", Fault: fault(t, "before-assembly=sleep:2s")},
+		Step{Action: SIM_TRANSFER, Node: "a", Target: "b", File: "f.bin"},
+		Step{Action: SIM_CHECK, Check: ExpectOutput("b", "a", "f.bin", data)},
+		// The target releases the chunks once it assembled the file
+		Step{Action: SIM_CHECK, Check: ExpectChunks(0, 0)},
+	)
+	runScenario(t, Scenario{Name: "target sleeps before assembly", Steps: steps})
+}
+
+func TestHolderCrashesWhileTargetFetches(t *testing.T) {
+	data := fileData(1600000)
+	steps := append(ringSteps("a", "b", "c", "d", "e", "f"),
+		Step{Action: SIM_WRITE, Node: "a", File: "f.bin", Data: data},
+		Step{
+			Action: SIM_FAULT, Node: "b", Fault: fault(t, "fetch-chunk@1=sleep:1ms"),
+			Steps: []Step{{Action: SIM_CRASH, Node: "d"}},
+		},
+		// Every chunk has replicas on other nodes, so the target fetches it from one of them
+		Step{Action: SIM_TRANSFER, Node: "a", Target: "b", File: "f.bin"},
+		Step{Action: SIM_CHECK, Check: ExpectOutput("b", "a", "f.bin", data)},
+	)
+	runScenario(t, Scenario{Name: "holder crashes while the target fetches", Steps: steps})
+}
+
+func TestScenarioFailsOnUnexpectedOutcome(t *testing.T) {
+	setRingBits(t)
+	s := NewSimulation(t.TempDir(), 1)
+	steps := append(ringSteps("a", "b", "c"),
+		Step{Action: SIM_WRITE, Node: "a", File: "f.bin", Data: fileData(1000)},
+		Step{Action: SIM_TRANSFER, Node: "a", Target: "b", File: "f.bin"},
+		Step{Action: SIM_CHECK, Check: ExpectNoOutput("b", "a", "f.bin")},
+	)
+	err := s.Run(Scenario{Name: "wrong expectation", Steps: steps})
+	if err == nil {
+		t.Fatal("scenario with a failing check succeeded")
+	}
+	if want := fmt.Sprintf("step %d (%s)", len(steps), SIM_CHECK); !strings.Contains(err.Error(), want) {
+		t.Fatalf("error %q does not name the failing step %q", err, want)
+	}
+}
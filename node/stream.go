@@ -0,0 +1,315 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Chunks move between nodes in blocks of at most blockSize bytes, one RPC per block, so neither side ever
+// holds a whole chunk in memory
+const blockSize = 256 * 1024
+
+// incomingFolder holds partial uploads inside /shared until their digest is checked. It starts with a dot
+// so it is never listed as a chunk.
+const incomingFolder = ".incoming"
+
+// A partial upload that got no block for this long was abandoned by a sender that crashed, and is removed
+const incomingTTL = 10 * time.Minute
+
+// hashFile returns the hex SHA-256 digest of a file, reading it block by block
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestWriter writes a chunk or shard block by block to a temporary file in dir, and names it after its
+// digest once it is complete, so it is never held in memory whole
+type digestWriter struct {
+	dir  string
+	name func(digest string) string // Name of the complete file, e.g. contentChunkName
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+func newDigestWriter(dir string, name func(digest string) string) (*digestWriter, error) {
+	// Dot-prefixed so a partial file is never listed as a chunk
+	file, err := os.CreateTemp(dir, ".chunk-*.part")
+	if err != nil {
+		return nil, fmt.Errorf("error creating chunk file: %v", err)
+	}
+	return &digestWriter{dir: dir, name: name, file: file, hash: sha256.New()}, nil
+}
+
+func (w *digestWriter) write(block []byte) error {
+	if _, err := w.file.Write(block); err != nil {
+		return fmt.Errorf("error writing chunk file %s: %v", w.file.Name(), err)
+	}
+	w.hash.Write(block)
+	w.size += int64(len(block))
+	return nil
+}
+
+// finish closes the file and renames it after its digest, returning the name and the digest
+func (w *digestWriter) finish() (string, string, error) {
+	digest := hex.EncodeToString(w.hash.Sum(nil))
+	name := w.name(digest)
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return "", "", fmt.Errorf("error writing chunk file %s: %v", name, err)
+	}
+	if err := os.Rename(w.file.Name(), filepath.Join(w.dir, name)); err != nil {
+		os.Remove(w.file.Name())
+		return "", "", fmt.Errorf("error writing chunk file %s: %v", name, err)
+	}
+	return name, digest, nil
+}
+
+// abort drops an unfinished file
+func (w *digestWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func newUploadID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// uploadChunk streams the file at path to the /shared folder of the node at ip. The request carries the
+// chunk name, digest and transfer type; the blocks, offsets and upload ID are filled in here. Every block waits
+// for the upload limits carried in ctx, and for as long as the node asks so it keeps to its download limit.
+// Cancelling ctx stops the upload between two blocks. An upload that stops early asks the node to drop the
+// part it received.
+func (n *Node) uploadChunk(ctx context.Context, ip string, path string, request Message) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open chunk %s: %v", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat chunk %s: %v", path, err)
+	}
+
+	request.ChunkTransferParams.UploadID = newUploadID()
+	request.ChunkTransferParams.Size = info.Size()
+	buffer := make([]byte, blockSize)
+	var offset int64
+	defer func() {
+		if err != nil && offset > 0 {
+			n.abortUpload(ip, request.ChunkTransferParams)
+		}
+	}()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bytesRead, err := io.ReadFull(file, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("failed to read chunk %s: %v", path, err)
+		}
+		request.ChunkTransferParams.Block = buffer[:bytesRead]
+		request.ChunkTransferParams.Offset = offset
+		request.ChunkTransferParams.Final = offset+int64(bytesRead) >= info.Size()
+		if err := throttleUpload(ctx, bytesRead); err != nil {
+			return err
+		}
+
+		reply, callErr := n.CallRPCMethodContext(ctx, ip, "Node.ReceiveChunk", request)
+		if callErr != nil {
+			return callErr
+		}
+		offset += int64(bytesRead)
+		if request.ChunkTransferParams.Final {
+			return nil
+		}
+		if err := pause(ctx, reply.ChunkTransferParams.Wait); err != nil {
+			return err
+		}
+	}
+}
+
+// abortUpload asks the node at ip to drop the part of an upload it received. A node that can't be reached
+// removes the part once it is older than incomingTTL.
+func (n *Node) abortUpload(ip string, params ChunkTransferRequest) {
+	_, err := n.CallRPCMethod(ip, "Node.AbortUpload", Message{
+		ChunkTransferParams: ChunkTransferRequest{ChunkName: params.ChunkName, UploadID: params.UploadID},
+	})
+	if err != nil {
+		fmt.Printf("Failed to drop the partial upload of chunk %s on %s: %v\n", params.ChunkName, ip, err)
+	}
+}
+
+// AbortUpload removes the partial file of an upload that its sender gave up
+func (n *Node) AbortUpload(message Message, reply *Message) error {
+	partialPath, err := n.incomingPath(message.ChunkTransferParams)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(partialPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove partial chunk %s: %v", message.ChunkTransferParams.ChunkName, err)
+	}
+	return nil
+}
+
+// incomingPath returns the path of the partial file of an upload
+func (n *Node) incomingPath(params ChunkTransferRequest) (string, error) {
+	if strings.ContainsAny(params.ChunkName+params.UploadID, `/\`) {
+		return "", fmt.Errorf("invalid chunk name %q", params.ChunkName)
+	}
+	return filepath.Join(n.path(dataFolder, incomingFolder), params.ChunkName+"."+params.UploadID), nil
+}
+
+// removeStaleUploads removes the partial files that got no block for incomingTTL
+func removeStaleUploads(incomingDir string) {
+	entries, err := os.ReadDir(incomingDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > incomingTTL {
+			os.Remove(filepath.Join(incomingDir, entry.Name()))
+		}
+	}
+}
+
+// receiveBlock appends one uploaded block to the partial file of its upload. On the final block the file is
+// checked against the digest and the path of the complete file is returned, otherwise the path is empty.
+func (n *Node) receiveBlock(params ChunkTransferRequest) (string, error) {
+	incomingDir := n.path(dataFolder, incomingFolder)
+	if err := os.MkdirAll(incomingDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", incomingDir, err)
+	}
+	partialPath, err := n.incomingPath(params)
+	if err != nil {
+		return "", err
+	}
+
+	flags := os.O_WRONLY | os.O_APPEND
+	if params.Offset == 0 {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		removeStaleUploads(incomingDir)
+	}
+	file, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to open partial chunk %s: %v", params.ChunkName, err)
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() != params.Offset {
+		err = fmt.Errorf("block at offset %d does not follow the %d bytes received so far", params.Offset, info.Size())
+	}
+	if err == nil {
+		_, err = file.Write(params.Block)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("failed to write chunk %s: %v", params.ChunkName, err)
+	}
+	if !params.Final {
+		return "", nil
+	}
+
+	// Reject chunks that were corrupted on the way or by the sender
+	digest, err := hashFile(partialPath)
+	if err != nil {
+		os.Remove(partialPath)
+		return "", err
+	}
+	if digest != params.Digest {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("digest mismatch for chunk %s: expected %q, got %s", params.ChunkName, params.Digest, digest)
+	}
+	return partialPath, nil
+}
+
+// downloadChunk streams a chunk from the /shared folder of the node at ip into destinationPath and checks it
+// against digest, unless digest is empty. It returns the reference count the node holds for the chunk. Every
+// block is charged to the download limits carried in ctx, and waits as long as the node asks so it keeps to its
+// upload limit. Cancelling ctx stops the download between two blocks.
+func (n *Node) downloadChunk(ctx context.Context, ip string, chunkName string, digest string, destinationPath string) (int, error) {
+	// Dot-prefixed so a partial chunk in /shared is never listed as a chunk, and named apart from the other
+	// downloads of the same chunk running at the same time
+	file, err := os.CreateTemp(filepath.Dir(destinationPath), "."+filepath.Base(destinationPath)+".*.part")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create a partial file for %s: %v", destinationPath, err)
+	}
+	partialPath := file.Name()
+	fail := func(err error) (int, error) {
+		file.Close()
+		os.Remove(partialPath)
+		return 0, err
+	}
+
+	h := sha256.New()
+	var offset int64
+	var refCount int
+	for {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		reply, err := n.CallRPCMethodContext(ctx, ip, "Node.SendChunk", Message{
+			ChunkTransferParams: ChunkTransferRequest{ChunkName: chunkName, Offset: offset},
+		})
+		if err != nil {
+			return fail(err)
+		}
+		params := reply.ChunkTransferParams
+		if params.Size == 0 {
+			return fail(fmt.Errorf("node does not have the chunk %s", chunkName))
+		}
+		if _, err := file.Write(params.Block); err != nil {
+			return fail(fmt.Errorf("failed to write %s: %v", partialPath, err))
+		}
+		h.Write(params.Block)
+		offset += int64(len(params.Block))
+		refCount = params.RefCount
+		if err := throttleDownload(ctx, len(params.Block)); err != nil {
+			return fail(err)
+		}
+		if offset >= params.Size || len(params.Block) == 0 {
+			break
+		}
+		if err := pause(ctx, params.Wait); err != nil {
+			return fail(err)
+		}
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); digest != "" && got != digest {
+		return fail(fmt.Errorf("corrupted copy of chunk %s: expected digest %s, got %s", chunkName, digest, got))
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(partialPath)
+		return 0, err
+	}
+	if err := os.Rename(partialPath, destinationPath); err != nil {
+		os.Remove(partialPath)
+		return 0, err
+	}
+	return refCount, nil
+}
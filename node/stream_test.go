@@ -0,0 +1,103 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowDownloadLimitDoesNotHoldTheRPC(t *testing.T) {
+	s := runScenario(t, Scenario{Name: "ring", Steps: ringSteps("a", "b")})
+	a, b := s.Node("a"), s.Node("b")
+	b.Bandwidth.Download = 1000 // Far below a block per RPC deadline
+
+	data := fileData(2 * blockSize)
+	params := ChunkTransferRequest{ChunkName: contentChunkName(digestBytes(data)), Digest: digestBytes(data), UploadID: "slow", Size: int64(len(data))}
+	var waits []time.Duration
+	for offset := 0; offset < len(data); offset += blockSize {
+		params.Block = data[offset : offset+blockSize]
+		params.Offset = int64(offset)
+		started := time.Now()
+		reply, err := a.CallRPCMethod(b.IP, "Node.ReceiveChunk", Message{Type: CHUNK_REPLICA, ChunkTransferParams: params})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Fatalf("block took %v to be received, the node waited for its limit inside the RPC", elapsed)
+		}
+		waits = append(waits, reply.ChunkTransferParams.Wait)
+	}
+	// The bucket starts with a block, the second block has to wait for a whole block at 1000 bytes a second
+	if want := time.Duration(blockSize/1000) * time.Second * 9 / 10; waits[1] < want {
+		t.Errorf("node asked to wait %v after the second block, want at least %v", waits[1], want)
+	}
+
+	partialPath, _ := b.incomingPath(params)
+	if _, err := os.Stat(partialPath); err != nil {
+		t.Fatalf("partial upload missing: %v", err)
+	}
+	if _, err := a.CallRPCMethod(b.IP, "Node.AbortUpload", Message{ChunkTransferParams: params}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Errorf("partial upload left behind after it was aborted: %v", err)
+	}
+}
+
+func TestCancelledUploadRemovesPartialFile(t *testing.T) {
+	s := runScenario(t, Scenario{Name: "ring", Steps: ringSteps("a", "b")})
+	a, b := s.Node("a"), s.Node("b")
+	a.Bandwidth.Upload = blockSize // The second block waits a second, long enough to cancel the upload
+
+	data := fileData(3 * blockSize)
+	path := a.path(localFolder, "upload.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	request := Message{Type: CHUNK_REPLICA, ChunkTransferParams: ChunkTransferRequest{ChunkName: contentChunkName(digestBytes(data)), Digest: digestBytes(data)}}
+	if err := a.uploadChunk(a.bulkContext(ctx), b.IP, path, request); err == nil {
+		t.Fatal("upload finished although it was cancelled")
+	}
+
+	entries, _ := os.ReadDir(b.path(dataFolder, incomingFolder))
+	if len(entries) != 0 {
+		t.Errorf("%d partial uploads left behind after the upload was cancelled", len(entries))
+	}
+}
+
+func TestConcurrentDownloadsOfTheSameChunk(t *testing.T) {
+	s := runScenario(t, Scenario{Name: "ring", Steps: ringSteps("a", "b")})
+	a, b := s.Node("a"), s.Node("b")
+
+	data := fileData(3*blockSize + 17)
+	chunkName := contentChunkName(digestBytes(data))
+	if err := os.WriteFile(b.path(dataFolder, chunkName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	destinationPath := a.path(assembleFolder, chunkName)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.downloadChunk(context.Background(), b.IP, chunkName, digestBytes(data), destinationPath); err != nil {
+				t.Errorf("download failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	downloaded, err := os.ReadFile(destinationPath)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("downloaded chunk differs from the original: %v", err)
+	}
+	entries, _ := os.ReadDir(a.path(assembleFolder))
+	if len(entries) != 1 {
+		t.Errorf("%d files in the destination folder, want only the chunk", len(entries))
+	}
+}
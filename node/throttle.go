@@ -0,0 +1,328 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// While control-plane RPCs are in flight, chunk blocks wait up to controlYieldMax before they go out, so
+// stabilization pings are not stuck behind bulk data and don't time out on a busy link
+const (
+	controlYieldStep = 2 * time.Millisecond
+	controlYieldMax  = 100 * time.Millisecond
+)
+
+// controlMethods are the RPCs that keep the ring together, and get priority over chunk data
+var controlMethods = map[string]bool{
+	"Node.Ping":             true,
+	"Node.Notify":           true,
+	"Node.GetPredecessor":   true,
+	"Node.GetSuccessor":     true,
+	"Node.GetSuccessorList": true,
+	"Node.FindSuccessor":    true,
+	"Node.NextHop":          true,
+}
+
+// controlPlane marks a control-plane RPC as in flight until the returned function is called, see CallRPCMethod
+func (n *Node) controlPlane() func() {
+	n.traffic.control.Add(1)
+	return func() { n.traffic.control.Add(-1) }
+}
+
+// controlCodec is the gob codec of net/rpc, which also counts the control-plane requests it read in calls
+// until their reply is written. Chunk blocks going out or being received then wait for the replies of the
+// ring's RPCs this node serves, like they wait for the ones it makes.
+type controlCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	calls  *atomic.Int32 // The serving node's count of control-plane RPCs in flight
+
+	mu      sync.Mutex
+	pending map[uint64]bool // Sequence numbers of the control-plane requests not answered yet
+}
+
+func newControlCodec(conn io.ReadWriteCloser, calls *atomic.Int32) *controlCodec {
+	buf := bufio.NewWriter(conn)
+	return &controlCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		calls:   calls,
+		pending: make(map[uint64]bool),
+	}
+}
+
+func (c *controlCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	if controlMethods[r.ServiceMethod] {
+		c.mu.Lock()
+		c.pending[r.Seq] = true
+		c.mu.Unlock()
+		c.calls.Add(1)
+	}
+	return nil
+}
+
+func (c *controlCodec) ReadRequestBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+func (c *controlCodec) WriteResponse(r *rpc.Response, body any) error {
+	defer c.answered(r.Seq)
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close() // Gob couldn't encode the header, the connection can't be used anymore
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+// answered stops counting the request with sequence number seq, if it is a control-plane request
+func (c *controlCodec) answered(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[seq] {
+		delete(c.pending, seq)
+		c.calls.Add(-1)
+	}
+}
+
+// Close closes the connection and stops counting the requests that won't be answered on it
+func (c *controlCodec) Close() error {
+	c.mu.Lock()
+	c.calls.Add(-int32(len(c.pending)))
+	c.pending = make(map[uint64]bool)
+	c.mu.Unlock()
+	return c.rwc.Close()
+}
+
+// yieldToControl holds chunk data back while control-plane RPCs of the node in ctx are in flight, for at most
+// controlYieldMax
+func yieldToControl(ctx context.Context) {
+	calls := limitsFrom(ctx).control
+	if calls == nil {
+		return
+	}
+	for waited := time.Duration(0); calls.Load() > 0 && waited < controlYieldMax; waited += controlYieldStep {
+		select {
+		case <-time.After(controlYieldStep):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// BandwidthLimits caps chunk traffic in bytes per second, 0 for no limit. Control-plane RPCs are not limited.
+type BandwidthLimits struct {
+	Upload      int64 // Chunk data sent by this node, to all nodes together
+	Download    int64 // Chunk data received by this node, from all nodes together
+	PerTransfer int64 // Chunk data of each transfer this node runs, in either direction
+}
+
+// LoadBandwidthLimits reads the limits from UPLOAD_LIMIT, DOWNLOAD_LIMIT and TRANSFER_LIMIT (bytes per second)
+func LoadBandwidthLimits() (BandwidthLimits, error) {
+	var limits BandwidthLimits
+	for _, setting := range []struct {
+		name  string
+		limit *int64
+	}{
+		{"UPLOAD_LIMIT", &limits.Upload},
+		{"DOWNLOAD_LIMIT", &limits.Download},
+		{"TRANSFER_LIMIT", &limits.PerTransfer},
+	} {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		rate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || rate < 0 {
+			return limits, fmt.Errorf("invalid %s %q: must be a number of bytes per second", setting.name, value)
+		}
+		*setting.limit = rate
+	}
+	return limits, nil
+}
+
+// rateLimiter is a token bucket. Callers reserve tokens in the order they arrive and sleep until the bucket
+// has refilled, so transfers sharing a limiter get their turns fairly. A nil limiter doesn't limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens (bytes) per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, or nil when rate is 0. The bucket holds a
+// second worth of traffic, and at least one block.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(max(rate, blockSize))
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes size tokens and returns how long the caller has to wait before they are available
+func (l *rateLimiter) reserve(size int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(size) // May go negative, later callers then wait for this reservation too
+	return max(time.Duration(-l.tokens/l.rate*float64(time.Second)), 0)
+}
+
+// wait takes size tokens, sleeping until they are available or ctx is cancelled
+func (l *rateLimiter) wait(ctx context.Context, size int) error {
+	return pause(ctx, l.reserve(size))
+}
+
+// pause sleeps for delay, or until ctx is cancelled
+func pause(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trafficShaper holds the node-wide limiters, built from Node.Bandwidth on first use
+type trafficShaper struct {
+	once     sync.Once
+	upload   *rateLimiter
+	download *rateLimiter
+	control  atomic.Int32 // Control-plane RPCs the node is waiting on or serving, see yieldToControl
+}
+
+func (n *Node) shaper() *trafficShaper {
+	n.traffic.once.Do(func() {
+		n.traffic.upload = newRateLimiter(n.Bandwidth.Upload)
+		n.traffic.download = newRateLimiter(n.Bandwidth.Download)
+	})
+	return &n.traffic
+}
+
+// trafficLimits are the limiters a chunk upload or download goes through, carried in its context, along with
+// the control-plane RPCs of the node it yields to
+type trafficLimits struct {
+	upload   []*rateLimiter
+	download []*rateLimiter
+	control  *atomic.Int32
+}
+
+type trafficLimitsKey struct{}
+
+func limitsFrom(ctx context.Context) trafficLimits {
+	limits, _ := ctx.Value(trafficLimitsKey{}).(trafficLimits)
+	return limits
+}
+
+// withLimits adds limiters to the ones ctx already carries
+func withLimits(ctx context.Context, upload *rateLimiter, download *rateLimiter) context.Context {
+	limits := limitsFrom(ctx)
+	added := trafficLimits{
+		upload:   append(limits.upload[:len(limits.upload):len(limits.upload)], upload),
+		download: append(limits.download[:len(limits.download):len(limits.download)], download),
+		control:  limits.control,
+	}
+	return context.WithValue(ctx, trafficLimitsKey{}, added)
+}
+
+// bulkContext returns ctx limited by the node-wide upload and download limits, for chunk traffic that is not
+// part of a transfer, such as replica repair and key hand-off
+func (n *Node) bulkContext(ctx context.Context) context.Context {
+	shaper := n.shaper()
+	ctx = withLimits(ctx, shaper.upload, shaper.download)
+	limits := limitsFrom(ctx)
+	limits.control = &shaper.control
+	return context.WithValue(ctx, trafficLimitsKey{}, limits)
+}
+
+// beginTransfer registers a transfer (see transferRegistry.begin) and returns its context, limited by the
+// node-wide limits and by a limiter of its own
+func (n *Node) beginTransfer(transferID string, peers ...string) (context.Context, error) {
+	ctx, err := n.transfers.begin(transferID, peers...)
+	if err != nil {
+		return nil, err
+	}
+	perTransfer := newRateLimiter(n.Bandwidth.PerTransfer)
+	return withLimits(n.bulkContext(ctx), perTransfer, perTransfer), nil
+}
+
+// throttleUpload waits until a block of size bytes may be sent under the limits in ctx
+func throttleUpload(ctx context.Context, size int) error {
+	yieldToControl(ctx)
+	for _, limiter := range limitsFrom(ctx).upload {
+		if err := limiter.wait(ctx, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttleDownload waits until a block of size bytes may be received under the limits in ctx
+func throttleDownload(ctx context.Context, size int) error {
+	yieldToControl(ctx)
+	for _, limiter := range limitsFrom(ctx).download {
+		if err := limiter.wait(ctx, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveUpload charges a block of size bytes that a node sends while serving an RPC to the upload limits in
+// ctx, and returns how long the caller has to wait before it asks for the next block. The serving node doesn't
+// wait itself, since the wait would count against the caller's RPC deadline, which a low limit could exceed on
+// every block.
+func reserveUpload(ctx context.Context, size int) time.Duration {
+	yieldToControl(ctx)
+	var delay time.Duration
+	for _, limiter := range limitsFrom(ctx).upload {
+		delay = max(delay, limiter.reserve(size))
+	}
+	return delay
+}
+
+// reserveDownload charges a block of size bytes that a node receives while serving an RPC to the download
+// limits in ctx, and returns how long the caller has to wait before it sends the next block, see reserveUpload
+func reserveDownload(ctx context.Context, size int) time.Duration {
+	yieldToControl(ctx)
+	var delay time.Duration
+	for _, limiter := range limitsFrom(ctx).download {
+		delay = max(delay, limiter.reserve(size))
+	}
+	return delay
+}
@@ -0,0 +1,490 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport carries the RPCs between nodes. TCPTransport is the real network, a MemoryNetwork connects nodes
+// running in the same process, for tests.
+type Transport interface {
+	// Serve makes the RPC methods of n reachable at n.IP, and returns when the node can't be served anymore
+	Serve(n *Node) error
+	// Call calls an RPC method of the node at addr, giving up when ctx ends. It fails with a *DialError when
+	// the node can't be reached, a *TimeoutError when ctx's deadline passes first and a *RemoteError when the
+	// method itself returned an error.
+	Call(ctx context.Context, addr string, method string, args any, reply any) error
+}
+
+const defaultRPCTimeout = 5 * time.Second // Deadline of a call when RPC_TIMEOUT is not set
+
+// Calls that take longer than a ring RPC by design, with the deadline they get when the caller sets none. A
+// chunk block can wait for the bandwidth limit of the peer, and the chunk info is only answered once the
+// target assembled the file.
+var slowMethods = map[string]time.Duration{
+	"Node.ReceiveChunk":          time.Minute,
+	"Node.SendChunk":             time.Minute,
+	"Node.ChunkLocationReceiver": assemblyTimeout + defaultRPCTimeout,
+}
+
+// LoadRPCTimeout reads the deadline of an RPC, in seconds, from RPC_TIMEOUT. The slow calls listed in
+// slowMethods keep their own deadline.
+func LoadRPCTimeout() (time.Duration, error) {
+	value := os.Getenv("RPC_TIMEOUT")
+	if value == "" {
+		return defaultRPCTimeout, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 1 {
+		return 0, fmt.Errorf("invalid RPC_TIMEOUT %q: must be a positive number of seconds", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// rpcTimeout returns the deadline a call of method gets when the caller sets none
+func (n *Node) rpcTimeout(method string) time.Duration {
+	if timeout, ok := slowMethods[method]; ok {
+		return timeout
+	}
+	if n.RPCTimeout <= 0 {
+		return defaultRPCTimeout
+	}
+	return n.RPCTimeout
+}
+
+// newRPCServer registers the RPC methods of n on a server of its own, so several nodes can run in one process
+func newRPCServer(n *Node) (*rpc.Server, error) {
+	server := rpc.NewServer()
+	if err := server.Register(n); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// serveConn answers the RPCs arriving on conn until it is closed. Control-plane RPCs count as in flight while
+// they are served, so the chunk blocks of this node make way for them, see controlCodec.
+func serveConn(server *rpc.Server, conn io.ReadWriteCloser, n *Node) {
+	server.ServeCodec(newControlCodec(conn, &n.traffic.control))
+}
+
+// TCPTransport is the default transport. Calls reuse pooled connections to each peer, see connPool.
+// Requests are refused while Node.Sleeping is set, to simulate a network partition.
+type TCPTransport struct {
+	pool connPool
+}
+
+func (*TCPTransport) Serve(n *Node) error {
+	server, err := newRPCServer(n)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", n.IP)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Printf("[NODE-%s] Listening on %s\n", n.ID, n.IP)
+
+	for {
+		conn, err := listener.Accept()
+		if n.Sleeping.Load() {
+			fmt.Printf("[NODE-%s] Network partition detected. Waiting for recovery...\n", n.ID)
+			conn.Close()
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("accept error: %v", err)
+		}
+		go serveConn(server, sleepyConn{Conn: conn, node: n}, n)
+	}
+}
+
+// sleepyConn drops a pooled connection when a request arrives on it while its node is sleeping, so a sleeping
+// node is unreachable over the connections it accepted before falling asleep too
+type sleepyConn struct {
+	net.Conn
+	node *Node
+}
+
+func (c sleepyConn) Read(b []byte) (int, error) {
+	count, err := c.Conn.Read(b)
+	if c.node.Sleeping.Load() {
+		c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	return count, err
+}
+
+func (t *TCPTransport) Call(ctx context.Context, addr string, method string, args any, reply any) error {
+	conn, err := t.pool.get(ctx, addr)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return ctx.Err()
+		}
+		return &DialError{Addr: addr, Err: err}
+	}
+
+	err = waitCall(ctx, conn.client, addr, method, args, reply)
+	var remoteErr *RemoteError
+	switch {
+	case err == nil || errors.As(err, &remoteErr):
+		// The connection carried the call and its answer, so it can carry the next one
+		conn.lastUsed = time.Now()
+		t.pool.put(addr, conn)
+		return err
+	case ctx.Err() != nil:
+		conn.client.Close() // The answer may still come, so the connection can't be reused
+		return err
+	}
+
+	// The connection broke. A pooled one may just have gone stale (the peer restarted), so the call is
+	// tried once more on a fresh connection before the peer is taken for gone.
+	conn.client.Close()
+	t.pool.evict(addr)
+	if conn.reused {
+		return t.Call(ctx, addr, method, args, reply)
+	}
+	return &DialError{Addr: addr, Err: err}
+}
+
+// waitCall makes a call on client and waits for its answer or the end of ctx. A deadline that passes is
+// reported as a *TimeoutError and an error returned by the method as a *RemoteError. Any other error means the
+// connection broke.
+func waitCall(ctx context.Context, client *rpc.Client, addr string, method string, args any, reply any) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		var serverErr rpc.ServerError
+		if errors.As(call.Error, &serverErr) {
+			return &RemoteError{Addr: addr, Method: method, Err: serverErr}
+		}
+		return call.Error
+	case <-ctx.Done():
+		return contextError(ctx, addr, method)
+	}
+}
+
+// contextError is the error of a call that ctx ended
+func contextError(ctx context.Context, addr string, method string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Addr: addr, Method: method}
+	}
+	return ctx.Err()
+}
+
+// DialError is returned by a transport when the node at Addr can't be reached at all
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("failed to connect to node at %s: %v", e.Addr, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned by a transport when the node at Addr didn't answer a call before its deadline. The
+// node may be slow, asleep or gone; the call may or may not have been carried out.
+type TimeoutError struct {
+	Addr   string
+	Method string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("call %s to node at %s timed out", e.Method, e.Addr)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// RemoteError is returned by a transport when the node at Addr was reached and its method returned Err
+type RemoteError struct {
+	Addr   string
+	Method string
+	Err    error
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s failed on node at %s: %v", e.Method, e.Addr, e.Err)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// Errors of a MemoryNetwork, standing in for the ones a real network gives
+var (
+	ErrNoListener  = errors.New("connection refused")
+	ErrPartitioned = errors.New("network is unreachable")
+)
+
+// MemoryNetwork connects nodes in the same process, each through the Transport for its address. Every call
+// goes through a pipe with the same gob encoding as TCP, so nodes never share memory. Latency, dropped
+// messages, partitions and crashes can be injected while the nodes run.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	servers   map[string]*memoryListener
+	latency   time.Duration
+	jitter    time.Duration
+	dropRate  float64
+	partition map[string]int  // Group of each address, 0 for the addresses not listed in Partition
+	down      map[string]bool // Addresses of stopped nodes, which can't make calls either
+	rand      *rand.Rand
+}
+
+type memoryListener struct {
+	node   *Node
+	server *rpc.Server
+	stop   chan struct{}
+	conns  map[net.Conn]bool // Open connections to the node, cut when it stops
+}
+
+// NewMemoryNetwork returns a network with no latency, drops or partitions. seed makes the jitter and drops
+// repeatable.
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		servers:   make(map[string]*memoryListener),
+		partition: make(map[string]int),
+		down:      make(map[string]bool),
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Transport returns the transport of the node at addr, which serves it at addr and makes its calls from there
+func (t *MemoryNetwork) Transport(addr string) Transport {
+	return &memoryTransport{network: t, addr: addr}
+}
+
+// SetLatency delays every message, requests and replies alike, by latency plus up to jitter
+func (t *MemoryNetwork) SetLatency(latency time.Duration, jitter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.latency, t.jitter = latency, jitter
+}
+
+// SetDropRate drops each request and each reply with probability rate. A dropped request is never handled,
+// a dropped reply is handled, and either way the caller waits for its deadline and gets a *TimeoutError.
+func (t *MemoryNetwork) SetDropRate(rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dropRate = rate
+}
+
+// Partition splits the network: addresses in different groups can't reach each other, and the addresses in
+// no group form one more group. It replaces the previous partition.
+func (t *MemoryNetwork) Partition(groups ...[]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			t.partition[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes the partition
+func (t *MemoryNetwork) Heal() {
+	t.Partition()
+}
+
+// Stop takes the node at addr off the network, as if it crashed: the calls it is handling are cut off, it
+// can't make calls anymore and its Serve returns. Serving it again brings it back.
+func (t *MemoryNetwork) Stop(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.down[addr] = true
+	if listener, ok := t.servers[addr]; ok {
+		close(listener.stop)
+		for conn := range listener.conns {
+			conn.Close()
+		}
+		delete(t.servers, addr)
+	}
+}
+
+// deliver decides the fate of one message: how long it takes and whether it is dropped. It fails when the
+// partition keeps from and to apart.
+func (t *MemoryNetwork) deliver(from string, to string) (time.Duration, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.down[from] {
+		return 0, false, ErrNoListener
+	}
+	if t.partition[from] != t.partition[to] {
+		return 0, false, ErrPartitioned
+	}
+	delay := t.latency
+	if t.jitter > 0 {
+		delay += time.Duration(t.rand.Int63n(int64(t.jitter)))
+	}
+	dropped := t.dropRate > 0 && t.rand.Float64() < t.dropRate
+	return delay, dropped, nil
+}
+
+// memoryTransport is the Transport of one address on a MemoryNetwork
+type memoryTransport struct {
+	network *MemoryNetwork
+	addr    string
+
+	mu   sync.Mutex
+	idle map[string][]memoryConn // Connections kept between calls, like the pool of TCPTransport
+}
+
+// memoryConn is an RPC client on a pipe to a listener. Reusing it saves setting up the gob encoding of the
+// messages on every call.
+type memoryConn struct {
+	listener *memoryListener
+	client   *rpc.Client
+}
+
+// listen makes n reachable at addr right away, and returns the listener so the caller can wait for Stop
+func (t *MemoryNetwork) listen(addr string, n *Node) (*memoryListener, error) {
+	server, err := newRPCServer(n)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.servers[addr]; ok {
+		return nil, fmt.Errorf("address %s already in use", addr)
+	}
+	listener := &memoryListener{node: n, server: server, stop: make(chan struct{}), conns: make(map[net.Conn]bool)}
+	t.servers[addr] = listener
+	delete(t.down, addr)
+	return listener, nil
+}
+
+func (m *memoryTransport) Serve(n *Node) error {
+	listener, err := m.network.listen(m.addr, n)
+	if err != nil {
+		return err
+	}
+	<-listener.stop
+	return nil
+}
+
+// Call delivers the request to the node at addr and its reply back, each subject to the latency, drops and
+// partition of the network
+func (m *memoryTransport) Call(ctx context.Context, addr string, method string, args any, reply any) error {
+	delay, dropped, err := m.network.deliver(m.addr, addr)
+	if err != nil {
+		return &DialError{Addr: addr, Err: err}
+	}
+	if err := m.transit(ctx, addr, method, delay, dropped); err != nil {
+		return err
+	}
+
+	conn, err := m.get(addr)
+	if err != nil {
+		return err
+	}
+	callErr := waitCall(ctx, conn.client, addr, method, args, reply)
+	var remoteErr *RemoteError
+	if callErr == nil || errors.As(callErr, &remoteErr) {
+		m.put(addr, conn)
+	} else {
+		conn.client.Close() // Timed out or cut off, the reply may still come on this connection
+	}
+	if ctx.Err() != nil {
+		return callErr
+	}
+	if callErr != nil && remoteErr == nil {
+		return &DialError{Addr: addr, Err: callErr} // The node stopped while handling the call
+	}
+
+	// The reply can be lost too, also when a partition started while the request was handled
+	delay, dropped, err = m.network.deliver(addr, m.addr)
+	if err != nil {
+		dropped = true
+	}
+	if err := m.transit(ctx, addr, method, delay, dropped); err != nil {
+		return err
+	}
+	return callErr
+}
+
+// get returns an idle connection to the node at addr, or opens a new one. Connections to an earlier run of
+// the node, before it was stopped and served again, are dropped.
+func (m *memoryTransport) get(addr string) (memoryConn, error) {
+	m.network.mu.Lock()
+	listener := m.network.servers[addr]
+	m.network.mu.Unlock()
+	if listener == nil {
+		return memoryConn{}, &DialError{Addr: addr, Err: ErrNoListener}
+	}
+
+	m.mu.Lock()
+	conns := m.idle[addr]
+	for len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if conn.listener == listener {
+			m.idle[addr] = conns
+			m.mu.Unlock()
+			return conn, nil
+		}
+		conn.client.Close()
+	}
+	delete(m.idle, addr)
+	m.mu.Unlock()
+
+	serverConn, clientConn := net.Pipe()
+	m.network.mu.Lock()
+	if m.network.servers[addr] != listener {
+		m.network.mu.Unlock()
+		return memoryConn{}, &DialError{Addr: addr, Err: ErrNoListener}
+	}
+	listener.conns[serverConn] = true
+	m.network.mu.Unlock()
+	go func() {
+		serveConn(listener.server, serverConn, listener.node)
+		m.network.mu.Lock()
+		delete(listener.conns, serverConn)
+		m.network.mu.Unlock()
+	}()
+	return memoryConn{listener: listener, client: rpc.NewClient(clientConn)}, nil
+}
+
+// put keeps a connection that is still usable for the next call to addr
+func (m *memoryTransport) put(addr string, conn memoryConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.idle == nil {
+		m.idle = make(map[string][]memoryConn)
+	}
+	if len(m.idle[addr]) >= maxIdleConns {
+		conn.client.Close()
+		return
+	}
+	m.idle[addr] = append(m.idle[addr], conn)
+}
+
+// transit waits while a message is on its way. A dropped message never arrives, so the caller waits until ctx
+// ends.
+func (m *memoryTransport) transit(ctx context.Context, addr string, method string, delay time.Duration, dropped bool) error {
+	if dropped {
+		<-ctx.Done()
+		return contextError(ctx, addr, method)
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx, addr, method)
+	}
+}
@@ -0,0 +1,132 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+
+	"distributed-chord/utils"
+)
+
+// ringOwner returns the node that owns key on a ring of the given nodes: the first one at or after key
+func ringOwner(nodes []*Node, key utils.ID) *Node {
+	sorted := append([]*Node{}, nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID.Cmp(sorted[j].ID) < 0 })
+	for i, node := range sorted {
+		predecessor := sorted[(i+len(sorted)-1)%len(sorted)]
+		if utils.Between(key, predecessor.ID, node.ID, true) {
+			return node
+		}
+	}
+	return sorted[0]
+}
+
+// checkLookups looks up keys from every node and fails the test when a lookup doesn't return the owner
+func checkLookups(t *testing.T, s *Simulation, keys int) {
+	t.Helper()
+	nodes := []*Node{}
+	for _, name := range s.Live() {
+		nodes = append(nodes, s.Node(name))
+	}
+	for i := 0; i < keys; i++ {
+		key := utils.Hash(fmt.Sprintf("key-%d", i))
+		want := ringOwner(nodes, key)
+		from := nodes[i%len(nodes)]
+		var reply Message
+		if err := from.FindSuccessor(Message{ID: key}, &reply); err != nil {
+			t.Errorf("lookup of %s from %s failed: %v", key, from.IP, err)
+			continue
+		}
+		if reply.IP != want.IP {
+			t.Errorf("lookup of %s from %s returned %s, want %s", key, from.IP, reply.IP, want.IP)
+		}
+	}
+}
+
+func newRing(t *testing.T, size int) *Simulation {
+	t.Helper()
+	setRingBits(t)
+	s := NewSimulation(t.TempDir(), 1)
+	for i := 0; i < size; i++ {
+		if _, err := s.AddNode(fmt.Sprintf("node-%02d", i)); err != nil {
+			t.Fatalf("failed to add node %d: %v", i, err)
+		}
+	}
+	if !s.Settle() {
+		t.Fatal("ring did not settle")
+	}
+	return s
+}
+
+func TestMemoryNetworkLookups(t *testing.T) {
+	s := newRing(t, 50)
+
+	ring, err := s.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring) != 50 {
+		t.Fatalf("ring has %d nodes, want 50", len(ring))
+	}
+	checkLookups(t, s, 200)
+}
+
+func TestMemoryNetworkPartitionHeal(t *testing.T) {
+	s := newRing(t, 50)
+	names := s.Live()
+	left, right := names[:25], names[25:]
+
+	s.Network.Partition(left, right)
+	_, err := s.Node(left[0]).CallRPCMethod(right[0], "Node.Ping", Message{})
+	if !errors.Is(err, ErrPartitioned) {
+		t.Fatalf("call across the partition returned %v, want ErrPartitioned", err)
+	}
+	if _, err := s.Node(left[0]).CallRPCMethod(left[1], "Node.Ping", Message{}); err != nil {
+		t.Fatalf("call within a group failed: %v", err)
+	}
+
+	// Lookups either end at a node on the caller's side or fail to reach the other side. A lookup forwarded
+	// to a node on the same side that failed there comes back as a RemoteError, whose cause is only a string
+	// once it crossed the wire.
+	side := map[string][]string{}
+	for _, group := range [][]string{left, right} {
+		for _, name := range group {
+			side[name] = group
+		}
+	}
+	for i, name := range names {
+		var reply Message
+		err := s.Node(name).FindSuccessor(Message{ID: utils.Hash(fmt.Sprintf("key-%d", i))}, &reply)
+		var remoteErr *RemoteError
+		var dialErr *DialError
+		var timeoutErr *TimeoutError
+		switch {
+		case err == nil:
+			if !slices.Contains(side[name], reply.IP) {
+				t.Errorf("lookup from %s during the partition ended at %s on the other side", name, reply.IP)
+			}
+		case errors.As(err, &remoteErr):
+			if !slices.Contains(side[name], remoteErr.Addr) {
+				t.Errorf("lookup from %s during the partition was forwarded to %s on the other side", name, remoteErr.Addr)
+			}
+		case errors.As(err, &dialErr):
+			if slices.Contains(side[name], dialErr.Addr) || !errors.Is(err, ErrPartitioned) {
+				t.Errorf("lookup from %s during the partition could not reach %s: %v", name, dialErr.Addr, err)
+			}
+		case !errors.As(err, &timeoutErr):
+			t.Errorf("lookup from %s during the partition failed with %v, want a DialError or TimeoutError", name, err)
+		}
+	}
+
+	// No maintenance runs during the partition: halves that stabilize apart become two rings, which Chord
+	// doesn't merge again once they can reach each other. Without it the ring is whole as soon as the
+	// network heals.
+	s.Network.Heal()
+	checkLookups(t, s, 200)
+	if !s.Settle() {
+		t.Fatal("ring did not settle after the partition healed")
+	}
+	checkLookups(t, s, 200)
+}
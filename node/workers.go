@@ -0,0 +1,92 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultTransferWorkers = 4 // Chunks moved at the same time when TRANSFER_WORKERS is not set
+
+// ChunkError records why one chunk of a transfer failed
+type ChunkError struct {
+	ChunkName string
+	Err       error
+}
+
+// TransferErrors collects every chunk that failed in a parallel upload or download
+type TransferErrors []ChunkError
+
+func (e TransferErrors) Error() string {
+	failures := make([]string, len(e))
+	for i, chunkErr := range e {
+		failures[i] = fmt.Sprintf("%s: %v", chunkErr.ChunkName, chunkErr.Err)
+	}
+	return fmt.Sprintf("%d chunks failed (%s)", len(e), strings.Join(failures, "; "))
+}
+
+// LoadTransferWorkers reads the size of the transfer worker pool from TRANSFER_WORKERS
+func LoadTransferWorkers() (int, error) {
+	value := os.Getenv("TRANSFER_WORKERS")
+	if value == "" {
+		return defaultTransferWorkers, nil
+	}
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 1 {
+		return 0, fmt.Errorf("invalid TRANSFER_WORKERS %q: must be a positive integer", value)
+	}
+	return workers, nil
+}
+
+func (n *Node) transferWorkers() int {
+	if n.Workers < 1 {
+		return defaultTransferWorkers
+	}
+	return n.Workers
+}
+
+// forEachChunk runs work on every chunk and its index with at most n.Workers chunks in flight. Failed chunks
+// don't stop the others and are returned together as TransferErrors. Once ctx is cancelled no new chunk is
+// started, and ctx.Err() is returned after the chunks already in flight have finished.
+func (n *Node) forEachChunk(ctx context.Context, chunks []ChunkInfo, work func(ctx context.Context, i int, chunk ChunkInfo) error) error {
+	jobs := make(chan int)
+	errs := make([]error, len(chunks))
+	var wg sync.WaitGroup
+	for w := 0; w < min(n.transferWorkers(), len(chunks)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = work(ctx, i, chunks[i])
+			}
+		}()
+	}
+
+dispatch:
+	for i := range chunks {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var failed TransferErrors
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, ChunkError{ChunkName: chunks[i].ChunkName, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// ID is a position on the Chord ring. It holds an arbitrary-precision integer
+// stored as its minimal big-endian bytes, so IDs stay comparable with == and
+// usable as map keys. The zero value is the ID 0.
+type ID struct {
+	b string
+}
+
+// NewID builds an ID from a non-negative big integer
+func NewID(v *big.Int) ID {
+	return ID{b: string(v.Bytes())}
+}
+
+// IDFromInt builds an ID from a non-negative int
+func IDFromInt(v int) ID {
+	return NewID(big.NewInt(int64(v)))
+}
+
+// ParseID parses a decimal ID (as printed by String) and checks that it fits in the ring
+func ParseID(s string) (ID, error) {
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok || v.Sign() < 0 {
+		return ID{}, fmt.Errorf("invalid ring ID %q", s)
+	}
+	if v.Cmp(RingSize()) >= 0 {
+		return ID{}, fmt.Errorf("ring ID %s is outside the %d-bit identifier space", s, M)
+	}
+	return NewID(v), nil
+}
+
+// Big returns the ID as a new big integer
+func (id ID) Big() *big.Int {
+	return new(big.Int).SetBytes([]byte(id.b))
+}
+
+// Cmp compares two IDs as integers and returns -1, 0 or +1
+func (id ID) Cmp(other ID) int {
+	return id.Big().Cmp(other.Big())
+}
+
+// IsZero reports whether the ID is 0
+func (id ID) IsZero() bool {
+	return id.b == ""
+}
+
+// Add returns (id + v) mod 2^M
+func (id ID) Add(v *big.Int) ID {
+	sum := id.Big()
+	sum.Add(sum, v)
+	return NewID(sum.Mod(sum, RingSize()))
+}
+
+// AddPow2 returns (id + 2^k) mod 2^M, the start of the k-th finger interval
+func (id ID) AddPow2(k int) ID {
+	return id.Add(new(big.Int).Lsh(big.NewInt(1), uint(k)))
+}
+
+// Distance returns the clockwise distance (to - id) mod 2^M
+func (id ID) Distance(to ID) *big.Int {
+	d := to.Big()
+	d.Sub(d, id.Big())
+	return d.Mod(d, RingSize())
+}
+
+func (id ID) String() string {
+	return id.Big().String()
+}
+
+// GobEncode lets IDs travel inside RPC messages
+func (id ID) GobEncode() ([]byte, error) {
+	return []byte(id.b), nil
+}
+
+// GobDecode restores an ID encoded by GobEncode
+func (id *ID) GobDecode(data []byte) error {
+	// Normalise through big.Int so leading zero bytes never break equality
+	*id = NewID(new(big.Int).SetBytes(data))
+	return nil
+}
+
+// MarshalText writes the ID in decimal, so IDs can be stored in JSON files
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText reads an ID written by MarshalText
+func (id *ID) UnmarshalText(text []byte) error {
+	v, ok := new(big.Int).SetString(string(text), 10)
+	if !ok || v.Sign() < 0 {
+		return fmt.Errorf("invalid ring ID %q", text)
+	}
+	*id = NewID(v)
+	return nil
+}
@@ -2,33 +2,67 @@ package utils
 
 import (
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
+	"math/big"
 	"net"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 )
 
 const (
-	M = 5 // number of bits to consider for the final hash value or number of rows in the finger table
+	DefaultM = 5   // default number of bits in the identifier space
+	MaxM     = 160 // SHA-1 produces 160 bits, so the ring can't be wider than that
 )
 
 var (
+	// M is the number of bits to consider for the final hash value or number of rows in the finger table.
+	// It is set once per deployment through SetM/LoadM before the node is created.
+	M = DefaultM
+
 	transferStartTime time.Time
 	transferMutex     sync.RWMutex
 )
 
+// SetM changes the width of the identifier space
+func SetM(bits int) error {
+	if bits < 1 || bits > MaxM {
+		return fmt.Errorf("ring width must be between 1 and %d bits, got %d", MaxM, bits)
+	}
+	M = bits
+	return nil
+}
+
+// LoadM reads the ring width from the CHORD_BITS environment variable, keeping the default if it is unset
+func LoadM() error {
+	value := os.Getenv("CHORD_BITS")
+	if value == "" {
+		return nil
+	}
+	bits, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid CHORD_BITS %q: %v", value, err)
+	}
+	return SetM(bits)
+}
+
+// RingSize returns 2^M, the number of IDs on the ring
+func RingSize() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(M))
+}
+
 // Add hash function here
-func Hash(s string) int {
+func Hash(s string) ID {
 	h := sha1.New()
 	h.Write([]byte(s))
 
 	hashBytes := h.Sum(nil)
 
-	unModdedID := binary.BigEndian.Uint64(hashBytes[:8]) // Gets the first 8 bytes of the hash
-	moddedID := unModdedID % (1 << M)                    // Mod the ID by 2^m
+	unModdedID := new(big.Int).SetBytes(hashBytes)     // The full 160-bit hash
+	moddedID := unModdedID.Mod(unModdedID, RingSize()) // Mod the ID by 2^m
 
-	return int(moddedID)
+	return NewID(moddedID)
 }
 
 func GetContainerIP() (string, error) {
@@ -54,21 +88,19 @@ func GetContainerIP() (string, error) {
 	return "", fmt.Errorf("no IPv4 address found for eth0")
 }
 
-func Between(id int, a int, b int, equalsTo bool) bool {
+func Between(id ID, a ID, b ID, equalsTo bool) bool {
 	if a == b {
 		return true
 	}
-	if a < b {
-		if equalsTo {
-			return id > a && id <= b
-		}
-		return id > a && id < b
-	} else {
-		if equalsTo {
-			return id > a || id <= b
-		}
-		return id > a || id < b
+	afterA := id.Cmp(a) > 0
+	beforeB := id.Cmp(b) < 0
+	if equalsTo {
+		beforeB = id.Cmp(b) <= 0
+	}
+	if a.Cmp(b) < 0 {
+		return afterA && beforeB
 	}
+	return afterA || beforeB
 }
 
 // StartTransferTimer sets the start time for file transfer
@@ -90,4 +122,4 @@ func GetTransferStartTime() time.Time {
 	transferMutex.RLock()
 	defer transferMutex.RUnlock()
 	return transferStartTime
-}
\ No newline at end of file
+}